@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// emitBatcherMaxPendingFactor bounds how many failed batches an emitBatcher
+// keeps for retry (in multiples of its batch size) before dropping entries.
+const emitBatcherMaxPendingFactor = 10
+
+// emitBatcher collects entries produced outside an HTTP request (syslog,
+// file tail, deferred enrichment) and emits them through emitBatch in
+// batches, either when the batch is full or on every tick.
+type emitBatcher struct {
+	name     string
+	max      int
+	interval time.Duration
+	full     chan struct{}
+
+	mu    sync.Mutex
+	queue []logEvent
+
+	// dropped counts entries given up after emit failures.
+	dropped atomic.Uint64
+}
+
+func newEmitBatcher(name string, max int, interval time.Duration) *emitBatcher {
+	return &emitBatcher{
+		name:     name,
+		max:      max,
+		interval: interval,
+		full:     make(chan struct{}, 1),
+		queue:    make([]logEvent, 0, max),
+	}
+}
+
+func (b *emitBatcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+func (b *emitBatcher) add(entries ...logEvent) {
+	if len(entries) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	b.queue = append(b.queue, entries...)
+	full := len(b.queue) >= b.max
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush emits everything queued so far. On failure the entries are put back
+// at the head of the queue unless that would exceed the pending bound.
+func (b *emitBatcher) flush() {
+	b.mu.Lock()
+	if len(b.queue) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	batch := b.queue
+	b.queue = make([]logEvent, 0, b.max)
+	b.mu.Unlock()
+
+	if err := emitBatch(batch); err != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if len(batch)+len(b.queue) > b.max*emitBatcherMaxPendingFactor {
+			logError("%s: dropping %d entries after emit failure: %v", b.name, len(batch), err)
+			b.dropped.Add(uint64(len(batch)))
+			return
+		}
+		logWarn("%s: emit failed, retrying %d entries on next flush: %v", b.name, len(batch), err)
+		b.queue = append(batch, b.queue...)
+		return
+	}
+	logDebug("%s: emitted %d entries", b.name, len(batch))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// errBodyTooLarge reports a body whose decompressed size exceeds the limit.
+var errBodyTooLarge = errors.New("decompressed body exceeds limit")
+
+// errUnsupportedEncoding reports a Content-Encoding the proxy cannot decode.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// readIngestBody reads an ingest request body, transparently decoding a
+// gzip, zstd or deflate Content-Encoding. vectorMaxBodyBytes bounds both the
+// bytes on the wire and the decompressed size, so a decompression bomb is
+// cut off instead of being buffered. The returned status is meant for the
+// HTTP response when err != nil.
+func readIngestBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, vectorMaxBodyBytes)
+
+	decoded, err := decodeContentEncoding(r.Header.Get("Content-Encoding"), r.Body)
+	if err != nil {
+		if errors.Is(err, errUnsupportedEncoding) {
+			return nil, http.StatusUnsupportedMediaType, err
+		}
+		return nil, bodyErrorStatus(err, http.StatusBadRequest), err
+	}
+	defer decoded.Close()
+
+	body, err := readAllLimited(decoded, vectorMaxBodyBytes)
+	if err != nil {
+		fallback := http.StatusInternalServerError
+		if decoded != r.Body {
+			// The wire read worked but the payload did not decompress.
+			fallback = http.StatusBadRequest
+		}
+		return nil, bodyErrorStatus(err, fallback), err
+	}
+	return body, http.StatusOK, nil
+}
+
+func bodyErrorStatus(err error, fallback int) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || errors.Is(err, errBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return fallback
+}
+
+// decodeContentEncoding wraps body in a decompressor for the given
+// Content-Encoding. Stacked encodings ("gzip, zstd") are not supported.
+func decodeContentEncoding(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return zr, nil
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		return zr, nil
+	case "zstd":
+		zr, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(vectorMaxBodyBytes),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedEncoding, encoding)
+	}
+}
+
+// readAllLimited reads r fully but fails with errBodyTooLarge as soon as more
+// than limit bytes come out of it.
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// bodySpool holds a request body for a second pass. The first limit bytes
+// stay in memory and anything beyond goes to a temp file, so large
+// bodies cost disk instead of heap.
+type bodySpool struct {
+	limit int64
+	mem   bytes.Buffer
+	file  *os.File
+}
+
+func newBodySpool(limit int64) *bodySpool {
+	return &bodySpool{limit: limit}
+}
+
+func (s *bodySpool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.mem.Len()+len(p)) <= s.limit {
+		return s.mem.Write(p)
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "xray-loki-proxy-ingest-*")
+		if err != nil {
+			return 0, fmt.Errorf("spool: %w", err)
+		}
+		s.file = f
+		if _, err := s.file.Write(s.mem.Bytes()); err != nil {
+			return 0, fmt.Errorf("spool: %w", err)
+		}
+		s.mem = bytes.Buffer{}
+	}
+	return s.file.Write(p)
+}
+
+// Reader returns the spooled body from its first byte.
+func (s *bodySpool) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return bytes.NewReader(s.mem.Bytes()), nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("spool: %w", err)
+	}
+	return s.file, nil
+}
+
+func (s *bodySpool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	s.file.Close()
+	return os.Remove(name)
+}
+
+// spoolIngestBody is the streaming counterpart of readIngestBody: the decoded
+// body is hashed while it is copied into a bodySpool, so the batch id is
+// known before any line is processed without holding the body in memory.
+func spoolIngestBody(w http.ResponseWriter, r *http.Request) (*bodySpool, string, int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, vectorMaxBodyBytes)
+
+	decoded, err := decodeContentEncoding(r.Header.Get("Content-Encoding"), r.Body)
+	if err != nil {
+		if errors.Is(err, errUnsupportedEncoding) {
+			return nil, "", http.StatusUnsupportedMediaType, err
+		}
+		return nil, "", bodyErrorStatus(err, http.StatusBadRequest), err
+	}
+	defer decoded.Close()
+
+	spool := newBodySpool(int64(INGEST_SPOOL_MEMORY))
+	hasher := sha256.New()
+	n, err := io.Copy(io.MultiWriter(spool, hasher), io.LimitReader(decoded, vectorMaxBodyBytes+1))
+	if err == nil && n > vectorMaxBodyBytes {
+		err = errBodyTooLarge
+	}
+	if err != nil {
+		spool.Close()
+		fallback := http.StatusInternalServerError
+		if decoded != r.Body {
+			fallback = http.StatusBadRequest
+		}
+		return nil, "", bodyErrorStatus(err, fallback), err
+	}
+	return spool, hex.EncodeToString(hasher.Sum(nil)), http.StatusOK, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func compressBody(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch encoding {
+	case "gzip":
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+	case "deflate":
+		zw := zlib.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("zstd.NewWriter: %v", err)
+		}
+		zw.Write(data)
+		zw.Close()
+	default:
+		buf.Write(data)
+	}
+	return buf.Bytes()
+}
+
+func TestReadIngestBody(t *testing.T) {
+	plain := []byte("line-one\nline-two\n")
+	bomb := make([]byte, vectorMaxBodyBytes+1)
+
+	tests := []struct {
+		name       string
+		encoding   string
+		body       []byte
+		want       []byte
+		wantStatus int
+	}{
+		{name: "identity", encoding: "", body: plain, want: plain, wantStatus: http.StatusOK},
+		{name: "gzip", encoding: "gzip", body: compressBody(t, "gzip", plain), want: plain, wantStatus: http.StatusOK},
+		{name: "deflate", encoding: "deflate", body: compressBody(t, "deflate", plain), want: plain, wantStatus: http.StatusOK},
+		{name: "zstd", encoding: "zstd", body: compressBody(t, "zstd", plain), want: plain, wantStatus: http.StatusOK},
+		{name: "unsupported", encoding: "br", body: plain, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "corrupt gzip", encoding: "gzip", body: plain, wantStatus: http.StatusBadRequest},
+		{name: "gzip bomb", encoding: "gzip", body: compressBody(t, "gzip", bomb), wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "zstd bomb", encoding: "zstd", body: compressBody(t, "zstd", bomb), wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/vector/ingest", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.encoding)
+			got, status, err := readIngestBody(httptest.NewRecorder(), req)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (err=%v)", status, tt.wantStatus, err)
+			}
+			if tt.wantStatus == http.StatusOK && !bytes.Equal(got, tt.want) {
+				t.Fatalf("body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVectorIngestHandler_Gzip(t *testing.T) {
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = t.TempDir()+"/out.ndjson", "", "", nil
+
+	body := compressBody(t, "gzip", []byte(formatTestAccessLine(4242)+"\n"))
+	req := httptest.NewRequest(http.MethodPost, "/vector/ingest", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	vectorIngestHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	data, err := os.ReadFile(OUTPUT_FILE)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !strings.Contains(string(data), `"email":"4242"`) {
+		t.Fatalf("unexpected output %s", data)
+	}
+}
+
+func TestBodySpool_SpillsToDisk(t *testing.T) {
+	spool := newBodySpool(8)
+	defer spool.Close()
+
+	spool.Write([]byte("12345"))
+	if spool.file != nil {
+		t.Fatal("spool spilled before reaching its memory limit")
+	}
+	spool.Write([]byte("67890"))
+	if spool.file == nil {
+		t.Fatal("spool did not spill past its memory limit")
+	}
+	name := spool.file.Name()
+
+	r, err := spool.Reader()
+	if err != nil {
+		t.Fatalf("Reader() error = %v", err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "1234567890" {
+		t.Fatalf("spooled body = %q", got)
+	}
+
+	spool.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("temp file %s not removed: %v", name, err)
+	}
+}
+
+func TestVectorIngestHandler_StreamsChunks(t *testing.T) {
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	prevChunk, prevSpool := INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+		INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY = prevChunk, prevSpool
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = t.TempDir()+"/out.ndjson", "", "", nil
+	INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY = 3, 256
+
+	var body strings.Builder
+	for i := 0; i < 10; i++ {
+		body.WriteString(formatTestAccessLine(7000+i) + "\n\n")
+	}
+
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/vector/ingest", strings.NewReader(body.String()))
+		rec := httptest.NewRecorder()
+		vectorIngestHandler(rec, req)
+		return rec.Code
+	}
+
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(7000, 7009)) {
+		t.Fatalf("emitted %v", got)
+	}
+
+	// The same body again is recognised by its hash and not re-emitted.
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("retry status = %d", code)
+	}
+	if got := emittedEmails(t); len(got) != 10 {
+		t.Fatalf("retry re-emitted events: %d lines", len(got))
+	}
+}
+
+func TestVectorIngestHandler_RetryResumesAfterFailedChunk(t *testing.T) {
+	var mu sync.Mutex
+	var posts int
+	var received strings.Builder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		if posts == 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.Copy(&received, r.Body)
+	}))
+	defer server.Close()
+
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	prevChunk, prevSpool, prevDedup := INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY, forwardedBatches
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+		INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY, forwardedBatches = prevChunk, prevSpool, prevDedup
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = "", server.URL, "", nil
+	INGEST_CHUNK_LINES, INGEST_SPOOL_MEMORY = 3, 256
+	forwardedBatches = newMemoryDedupStore(100, time.Hour)
+
+	var body strings.Builder
+	for i := 0; i < 10; i++ {
+		body.WriteString(formatTestAccessLine(7100+i) + "\n")
+	}
+	post := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/vector/ingest", strings.NewReader(body.String()))
+		rec := httptest.NewRecorder()
+		vectorIngestHandler(rec, req)
+		return rec.Code
+	}
+
+	// The second chunk fails, so the shipper retries the whole batch.
+	if code := post(); code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want %d", code, http.StatusBadGateway)
+	}
+	if code := post(); code != http.StatusOK {
+		t.Fatalf("retry status = %d", code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 7100; i < 7110; i++ {
+		if n := strings.Count(received.String(), fmt.Sprintf(`"email":"%d"`, i)); n != 1 {
+			t.Errorf("email %d delivered %d times", i, n)
+		}
+	}
+	if posts != 5 {
+		t.Errorf("sink received %d posts, want 5 (one chunk failed, the first not re-sent)", posts)
+	}
+}
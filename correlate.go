@@ -0,0 +1,402 @@
+package main
+
+import (
+	"container/list"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var CORRELATE_SESSIONS = getEnvBool("CORRELATE_SESSIONS", false)
+var CORRELATE_MAX_PENDING = getEnvInt("CORRELATE_MAX_PENDING", 100000)
+var CORRELATE_TTL = getEnvDuration("CORRELATE_TTL", 24*time.Hour)
+
+const (
+	logTypeConnection = "connection"
+
+	// correlateMatchWindow is how far apart (in log time) an access line and
+	// the dispatcher line of the same connection may be.
+	correlateMatchWindow = 2 * time.Second
+	// correlateUnmatchedTimeout drops access lines and sessions that found no
+	// counterpart, e.g. because only one of the two logs is shipped.
+	correlateUnmatchedTimeout = time.Minute
+	correlateSweepInterval    = 10 * time.Second
+	correlateBatchMax         = 500
+	correlateBatchInterval    = time.Second
+)
+
+/* app/dispatcher: "taking detour [DIRECT] for [tcp:example.com:443]" or "default route for tcp:example.com:443" */
+var dispatchMessageFormat = regexp.MustCompile(`^(?:taking detour \[[^\]]*\] for \[(\S+)\]|default route for (\S+))$`)
+
+// sessionCorrelator joins access lines with the error-log lines of the same
+// connection; nil unless CORRELATE_SESSIONS is set.
+var sessionCorrelator *correlator
+
+// ConnectionEntry is emitted when a correlated connection ends: the access
+// line of the connection plus its session ID and duration.
+type ConnectionEntry struct {
+	LogType   string `json:"log_type"`
+	SessionID uint32 `json:"session_id"`
+	LogEntry
+	EndDatetime string `json:"end_datetime"`
+	DurationMS  int64  `json:"duration_ms"`
+}
+
+// eventDatetime is the end of the connection, so long tunnels are not pushed
+// with a timestamp hours in the past.
+func (c *ConnectionEntry) eventDatetime() string { return c.EndDatetime }
+
+func (c *ConnectionEntry) labelValue(field string) (string, bool) {
+	if field == "log_type" {
+		return c.LogType, true
+	}
+	return c.LogEntry.labelValue(field)
+}
+
+func startSessionCorrelation() {
+	if !CORRELATE_SESSIONS {
+		return
+	}
+	batcher := newEmitBatcher("correlate", correlateBatchMax, correlateBatchInterval)
+	go batcher.run()
+
+	sessionCorrelator = newCorrelator(CORRELATE_MAX_PENDING, CORRELATE_TTL, func(conn *ConnectionEntry) {
+		batcher.add(conn)
+	})
+	go func() {
+		for range time.Tick(correlateSweepInterval) {
+			sessionCorrelator.sweep()
+		}
+	}()
+	logInfo("Correlating sessions (max %d pending, ttl %s)", CORRELATE_MAX_PENDING, CORRELATE_TTL)
+}
+
+// observeSessions feeds emitted events to the correlator. It runs after a
+// successful emit so that a failed batch, which the shipper will resend, is
+// not counted twice.
+func observeSessions(events []logEvent) {
+	if sessionCorrelator == nil {
+		return
+	}
+	for _, event := range events {
+		sessionCorrelator.observe(event)
+	}
+}
+
+// sessionKey identifies a session: Xray session IDs are only unique per
+// instance, so they are qualified by the origin's key.
+type sessionKey struct {
+	origin string
+	id     uint32
+}
+
+// pendingSession is a connection whose dispatcher line was seen. It is joined
+// with its access line by destination and time, and finished by its
+// "connection ends" line; the two may arrive in either order.
+type pendingSession struct {
+	key   sessionKey
+	dest  string
+	start time.Time
+	added time.Time
+	entry *LogEntry
+
+	ended       bool
+	endDatetime string
+	end         time.Time
+}
+
+// waitingAccess is an access line whose dispatcher line was not seen yet.
+type waitingAccess struct {
+	dest  string
+	at    time.Time
+	added time.Time
+	entry *LogEntry
+}
+
+// correlator holds at most maxPending sessions and as many waiting access
+// lines. Sessions that never end are dropped ttl after they started. Lines
+// are only joined with lines from the same origin: destinations are keyed
+// with the origin too.
+type correlator struct {
+	maxPending int
+	ttl        time.Duration
+	now        func() time.Time
+	emit       func(*ConnectionEntry)
+
+	mu           sync.Mutex
+	sessions     map[sessionKey]*list.Element // -> *pendingSession
+	sessionOrder *list.List                   // front = newest
+	unmatched    map[string][]*pendingSession
+	waiting      *list.List // *waitingAccess, front = newest
+	waitingDest  map[string][]*list.Element
+}
+
+func newCorrelator(maxPending int, ttl time.Duration, emit func(*ConnectionEntry)) *correlator {
+	return &correlator{
+		maxPending:   maxPending,
+		ttl:          ttl,
+		now:          time.Now,
+		emit:         emit,
+		sessions:     make(map[sessionKey]*list.Element),
+		sessionOrder: list.New(),
+		unmatched:    make(map[string][]*pendingSession),
+		waiting:      list.New(),
+		waitingDest:  make(map[string][]*list.Element),
+	}
+}
+
+func (c *correlator) observe(event logEvent) {
+	origin := event.origin().key()
+	var done *ConnectionEntry
+	switch e := event.(type) {
+	case *LogEntry:
+		if e.Status == "accepted" {
+			done = c.observeAccess(origin, e)
+		}
+	case *ErrorLogEntry:
+		if e.SessionID == 0 {
+			return
+		}
+		key := sessionKey{origin: origin, id: e.SessionID}
+		if dest, ok := dispatchDestination(e); ok {
+			done = c.observeStart(key, origin+"|"+dest, entryTime(e))
+		} else if strings.HasPrefix(e.Message, "connection ends") {
+			done = c.observeEnd(key, e.Datetime, entryTime(e))
+		}
+	}
+	if done != nil {
+		c.emit(done)
+	}
+}
+
+func (c *correlator) observeAccess(origin string, entry *LogEntry) *ConnectionEntry {
+	dest := origin + "|" + destinationKey(entry.DestProto, entry.DestHost, entry.DestPort)
+	at := entryTime(entry)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if s := c.takeUnmatched(dest, at); s != nil {
+		s.entry = entry
+		if s.ended {
+			return c.finish(s)
+		}
+		return nil
+	}
+
+	el := c.waiting.PushFront(&waitingAccess{dest: dest, at: at, added: c.now(), entry: entry})
+	c.waitingDest[dest] = append(c.waitingDest[dest], el)
+	for c.waiting.Len() > c.maxPending {
+		c.removeWaiting(c.waiting.Back())
+	}
+	return nil
+}
+
+func (c *correlator) observeStart(key sessionKey, dest string, start time.Time) *ConnectionEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sessions[key]; ok {
+		return nil
+	}
+	s := &pendingSession{key: key, dest: dest, start: start, added: c.now()}
+	c.sessions[key] = c.sessionOrder.PushFront(s)
+	if w := c.takeWaiting(dest, start); w != nil {
+		s.entry = w.entry
+	} else {
+		c.unmatched[dest] = append(c.unmatched[dest], s)
+	}
+	for c.sessionOrder.Len() > c.maxPending {
+		c.removeSession(c.sessionOrder.Back())
+	}
+	return nil
+}
+
+func (c *correlator) observeEnd(key sessionKey, datetime string, end time.Time) *ConnectionEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.sessions[key]
+	if !ok {
+		return nil
+	}
+	s := el.Value.(*pendingSession)
+	if s.ended {
+		// Inbound and outbound both log the end; the first one counts.
+		return nil
+	}
+	s.ended, s.endDatetime, s.end = true, datetime, end
+	if s.entry == nil {
+		return nil
+	}
+	return c.finish(s)
+}
+
+// finish builds the ConnectionEntry for a session that has both its access
+// line and its end, and forgets the session.
+func (c *correlator) finish(s *pendingSession) *ConnectionEntry {
+	c.removeSession(c.sessions[s.key])
+
+	duration := s.end.Sub(entryTime(s.entry))
+	if duration < 0 {
+		duration = 0
+	}
+	return &ConnectionEntry{
+		LogType:     logTypeConnection,
+		SessionID:   s.key.id,
+		LogEntry:    *s.entry,
+		EndDatetime: s.endDatetime,
+		DurationMS:  duration.Milliseconds(),
+	}
+}
+
+// takeUnmatched removes and returns the session for dest whose start is
+// closest to at, within correlateMatchWindow.
+func (c *correlator) takeUnmatched(dest string, at time.Time) *pendingSession {
+	candidates := c.unmatched[dest]
+	best := -1
+	for i, s := range candidates {
+		if d := absDuration(s.start.Sub(at)); d <= correlateMatchWindow &&
+			(best < 0 || d < absDuration(candidates[best].start.Sub(at))) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	s := candidates[best]
+	c.dropUnmatched(s)
+	return s
+}
+
+// takeWaiting removes and returns the waiting access line for dest whose
+// time is closest to at, within correlateMatchWindow.
+func (c *correlator) takeWaiting(dest string, at time.Time) *waitingAccess {
+	var best *list.Element
+	for _, el := range c.waitingDest[dest] {
+		w := el.Value.(*waitingAccess)
+		if d := absDuration(w.at.Sub(at)); d <= correlateMatchWindow &&
+			(best == nil || d < absDuration(best.Value.(*waitingAccess).at.Sub(at))) {
+			best = el
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	w := best.Value.(*waitingAccess)
+	c.removeWaiting(best)
+	return w
+}
+
+// sweep drops access lines and sessions that waited too long for their
+// counterpart, and sessions that outlived ttl without ending.
+func (c *correlator) sweep() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for el := c.waiting.Back(); el != nil; {
+		prev := el.Prev()
+		if now.Sub(el.Value.(*waitingAccess).added) >= correlateUnmatchedTimeout {
+			c.removeWaiting(el)
+		}
+		el = prev
+	}
+
+	expired := 0
+	for el := c.sessionOrder.Back(); el != nil; {
+		prev := el.Prev()
+		s := el.Value.(*pendingSession)
+		age := now.Sub(s.added)
+		unmatched := s.entry == nil && age >= correlateUnmatchedTimeout
+		if unmatched || age >= c.ttl {
+			if s.entry != nil {
+				expired++
+			}
+			c.removeSession(el)
+		}
+		el = prev
+	}
+	if expired > 0 {
+		logDebug("correlate: dropped %d sessions that did not end within %s", expired, c.ttl)
+	}
+}
+
+func (c *correlator) removeSession(el *list.Element) {
+	s := el.Value.(*pendingSession)
+	delete(c.sessions, s.key)
+	c.sessionOrder.Remove(el)
+	if s.entry == nil {
+		c.dropUnmatched(s)
+	}
+}
+
+func (c *correlator) dropUnmatched(s *pendingSession) {
+	candidates := c.unmatched[s.dest]
+	for i, candidate := range candidates {
+		if candidate == s {
+			candidates = append(candidates[:i], candidates[i+1:]...)
+			break
+		}
+	}
+	if len(candidates) == 0 {
+		delete(c.unmatched, s.dest)
+	} else {
+		c.unmatched[s.dest] = candidates
+	}
+}
+
+func (c *correlator) removeWaiting(el *list.Element) {
+	dest := el.Value.(*waitingAccess).dest
+	elements := c.waitingDest[dest]
+	for i, candidate := range elements {
+		if candidate == el {
+			elements = append(elements[:i], elements[i+1:]...)
+			break
+		}
+	}
+	if len(elements) == 0 {
+		delete(c.waitingDest, dest)
+	} else {
+		c.waitingDest[dest] = elements
+	}
+	c.waiting.Remove(el)
+}
+
+// Len returns the number of pending sessions and waiting access lines.
+func (c *correlator) Len() (sessions, waiting int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionOrder.Len(), c.waiting.Len()
+}
+
+// dispatchDestination extracts the destination of an app/dispatcher routing
+// line as a destinationKey.
+func dispatchDestination(e *ErrorLogEntry) (string, bool) {
+	if e.Component != "app/dispatcher" {
+		return "", false
+	}
+	match := dispatchMessageFormat.FindStringSubmatch(e.Message)
+	if match == nil {
+		return "", false
+	}
+	to := match[1] + match[2]
+	proto, host, port, err := parseToEndpoint(to)
+	if err != nil {
+		return "", false
+	}
+	return destinationKey(proto, host, port), true
+}
+
+func destinationKey(proto, host string, port uint16) string {
+	return proto + "|" + host + "|" + strconv.FormatUint(uint64(port), 10)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
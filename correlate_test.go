@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCorrelator(t *testing.T, maxPending int, ttl time.Duration) (*correlator, *fakeClock, *[]*ConnectionEntry) {
+	t.Helper()
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	var emitted []*ConnectionEntry
+	c := newCorrelator(maxPending, ttl, func(conn *ConnectionEntry) {
+		emitted = append(emitted, conn)
+	})
+	c.now = clock.now
+	return c, clock, &emitted
+}
+
+func mustParseErrorLog(t *testing.T, line string) *ErrorLogEntry {
+	t.Helper()
+	entry, err := parseErrorLog(line)
+	if err != nil {
+		t.Fatalf("parseErrorLog(%q) error = %v", line, err)
+	}
+	return entry
+}
+
+func mustParseLog(t *testing.T, line string) *LogEntry {
+	t.Helper()
+	entry, err := parseLog(line)
+	if err != nil {
+		t.Fatalf("parseLog(%q) error = %v", line, err)
+	}
+	return entry
+}
+
+const (
+	testDispatchLine = `2026/03/11 14:22:07.918410 [Info] [3912207401] app/dispatcher: taking detour [DIRECT] for [tcp:198.51.100.88:443]`
+	testAccessLine   = `2026/03/11 14:22:07.918500 from 203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`
+	testEndLine      = `2026/03/11 14:24:10.418500 [Info] [3912207401] proxy/vless/inbound: connection ends > io: read/write on closed pipe`
+)
+
+func TestCorrelator_Orders(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []string
+	}{
+		{name: "dispatch, access, end", order: []string{testDispatchLine, testAccessLine, testEndLine}},
+		{name: "access, dispatch, end", order: []string{testAccessLine, testDispatchLine, testEndLine}},
+		{name: "dispatch, end, access", order: []string{testDispatchLine, testEndLine, testAccessLine}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, emitted := newTestCorrelator(t, 100, time.Hour)
+			for _, line := range tt.order {
+				if line == testAccessLine {
+					c.observe(mustParseLog(t, line))
+				} else {
+					c.observe(mustParseErrorLog(t, line))
+				}
+			}
+
+			if len(*emitted) != 1 {
+				t.Fatalf("emitted %d connections, want 1", len(*emitted))
+			}
+			conn := (*emitted)[0]
+			if conn.SessionID != 3912207401 || conn.Email != "1204" || conn.DurationMS != 122500 {
+				t.Fatalf("unexpected connection %+v", conn)
+			}
+			if conn.EndDatetime != "2026-03-11 14:24:10.418500" || conn.eventDatetime() != conn.EndDatetime {
+				t.Fatalf("end datetime = %q", conn.EndDatetime)
+			}
+			if sessions, waiting := c.Len(); sessions != 0 || waiting != 0 {
+				t.Fatalf("pending after finish: sessions=%d waiting=%d", sessions, waiting)
+			}
+		})
+	}
+}
+
+func TestCorrelator_NoMatchOutsideWindow(t *testing.T) {
+	c, clock, emitted := newTestCorrelator(t, 100, time.Hour)
+
+	late := `2026/03/11 14:22:17.000000 from 203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`
+	c.observe(mustParseErrorLog(t, testDispatchLine))
+	c.observe(mustParseLog(t, late))
+	c.observe(mustParseErrorLog(t, testEndLine))
+	if len(*emitted) != 0 {
+		t.Fatalf("emitted %d connections for lines 10s apart", len(*emitted))
+	}
+
+	clock.advance(correlateUnmatchedTimeout)
+	c.sweep()
+	if sessions, waiting := c.Len(); sessions != 0 || waiting != 0 {
+		t.Fatalf("unmatched not swept: sessions=%d waiting=%d", sessions, waiting)
+	}
+}
+
+func TestCorrelator_ExpiresSessionsThatNeverEnd(t *testing.T) {
+	c, clock, emitted := newTestCorrelator(t, 100, time.Hour)
+
+	c.observe(mustParseErrorLog(t, testDispatchLine))
+	c.observe(mustParseLog(t, testAccessLine))
+
+	clock.advance(59 * time.Minute)
+	c.sweep()
+	if sessions, _ := c.Len(); sessions != 1 {
+		t.Fatalf("matched session dropped before ttl")
+	}
+
+	clock.advance(time.Minute)
+	c.sweep()
+	if sessions, _ := c.Len(); sessions != 0 {
+		t.Fatalf("session kept past ttl")
+	}
+
+	c.observe(mustParseErrorLog(t, testEndLine))
+	if len(*emitted) != 0 {
+		t.Fatalf("emitted %d connections for an expired session", len(*emitted))
+	}
+}
+
+func TestCorrelator_KeysByOrigin(t *testing.T) {
+	c, _, emitted := newTestCorrelator(t, 100, time.Hour)
+
+	// Two nodes log the same session ID for the same destination.
+	observe := func(node string, access bool, line string) {
+		t.Helper()
+		var event logEvent
+		if access {
+			event = mustParseLog(t, line)
+		} else {
+			event = mustParseErrorLog(t, line)
+		}
+		event.origin().Node = node
+		c.observe(event)
+	}
+	observe("edge-1", false, testDispatchLine)
+	observe("edge-2", false, testDispatchLine)
+	observe("edge-2", true, strings.Replace(testAccessLine, "email: 1204", "email: 2048", 1))
+	observe("edge-1", true, testAccessLine)
+	if sessions, _ := c.Len(); sessions != 2 {
+		t.Fatalf("pending sessions = %d, want 2", sessions)
+	}
+
+	observe("edge-2", false, testEndLine)
+	observe("edge-1", false, testEndLine)
+	if len(*emitted) != 2 {
+		t.Fatalf("emitted %d connections, want 2", len(*emitted))
+	}
+	for _, conn := range *emitted {
+		if want := map[string]string{"edge-1": "1204", "edge-2": "2048"}[conn.Node]; conn.Email != want {
+			t.Fatalf("node %q emitted email %q, want %q", conn.Node, conn.Email, want)
+		}
+	}
+}
+
+func TestCorrelator_Bounded(t *testing.T) {
+	c, _, _ := newTestCorrelator(t, 3, time.Hour)
+
+	for i := 0; i < 10; i++ {
+		c.observe(&ErrorLogEntry{
+			Datetime:  "2026-03-11 14:22:07.918410",
+			SessionID: uint32(i + 1),
+			Component: "app/dispatcher",
+			Message:   "default route for udp:192.0.2.1:53",
+		})
+		c.observe(mustParseLog(t, formatTestAccessLine(i)))
+	}
+	if sessions, waiting := c.Len(); sessions != 3 || waiting != 3 {
+		t.Fatalf("pending = sessions %d, waiting %d; want 3 and 3", sessions, waiting)
+	}
+}
+
+func TestConnectionEntry_JSON(t *testing.T) {
+	conn := &ConnectionEntry{
+		LogType:   logTypeConnection,
+		SessionID: 7,
+		LogEntry: LogEntry{
+			Datetime:    "2026-03-11 14:22:07.918500",
+			Email:       "1204",
+			Status:      "accepted",
+			Route:       "IN - DIRECT",
+			InboundTag:  "IN",
+			OutboundTag: "DIRECT",
+			ToAddr:      []string{},
+		},
+		EndDatetime: "2026-03-11 14:22:08.918500",
+		DurationMS:  1000,
+	}
+	got, err := json.Marshal(conn)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	want := `{"log_type":"connection","session_id":7,"datetime":"2026-03-11 14:22:07.918500","email":"1204","from_proto":"","from_ip":"","from_port":0,"dest_proto":"","dest_host":"","dest_port":0,"status":"accepted","route":"IN - DIRECT","inbound_tag":"IN","outbound_tag":"DIRECT","to_addr":[],"end_datetime":"2026-03-11 14:22:08.918500","duration_ms":1000}`
+	if string(got) != want {
+		t.Fatalf("JSON mismatch\n got: %s\nwant: %s", got, want)
+	}
+	if v, ok := conn.labelValue("email"); !ok || v != "1204" {
+		t.Fatalf("labelValue(email) = %q, %v", v, ok)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var DEAD_LETTER_FILE = getEnv("DEAD_LETTER_FILE", "")
+var DEAD_LETTER_ENDPOINT = getEnv("DEAD_LETTER_ENDPOINT", "")
+
+const (
+	deadLetterBatchMax      = 500
+	deadLetterBatchInterval = 5 * time.Second
+	// deadLetterMaxPending bounds the dead letters waiting for a slow or
+	// failing sink; beyond it new ones are dropped and counted.
+	deadLetterMaxPending = deadLetterBatchMax * emitBatcherMaxPendingFactor
+)
+
+// DeadLetter is a line the parser rejected, with what is needed to run it
+// through the parser again.
+type DeadLetter struct {
+	// Time is when the line was rejected, in RFC 3339.
+	Time string `json:"time"`
+	// Reason is the failure kind: no_match, bad_timestamp, bad_from, bad_to
+	// or invalid.
+	Reason string `json:"reason"`
+	Error  string `json:"error"`
+	// Format and TZ are the ingest options the line was parsed with.
+	Format string `json:"format"`
+	TZ     string `json:"tz"`
+	Node   string `json:"node,omitempty"`
+	Line   string `json:"line"`
+}
+
+// deadLetterBatcher sends dead letters from its run goroutine only, so a
+// slow sink holds up nothing but the queue, which is bounded.
+type deadLetterBatcher struct {
+	path     string
+	endpoint string
+	client   *http.Client
+	full     chan struct{}
+
+	mu    sync.Mutex
+	queue []DeadLetter
+
+	dropped atomic.Uint64
+}
+
+func newDeadLetterBatcher(path, endpoint string) *deadLetterBatcher {
+	return &deadLetterBatcher{
+		path:     path,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		full:     make(chan struct{}, 1),
+		queue:    make([]DeadLetter, 0, deadLetterBatchMax),
+	}
+}
+
+var deadLetters *deadLetterBatcher
+
+func validateDeadLetterConfig() error {
+	switch {
+	case DEAD_LETTER_FILE != "" && DEAD_LETTER_ENDPOINT != "":
+		return fmt.Errorf("set DEAD_LETTER_FILE or DEAD_LETTER_ENDPOINT, not both")
+	case DEAD_LETTER_ENDPOINT != "":
+		if _, err := url.ParseRequestURI(DEAD_LETTER_ENDPOINT); err != nil {
+			return fmt.Errorf("invalid DEAD_LETTER_ENDPOINT: %v", err)
+		}
+	}
+	return nil
+}
+
+func startDeadLetters() {
+	if DEAD_LETTER_FILE == "" && DEAD_LETTER_ENDPOINT == "" {
+		return
+	}
+
+	deadLetters = newDeadLetterBatcher(DEAD_LETTER_FILE, DEAD_LETTER_ENDPOINT)
+	go deadLetters.run()
+}
+
+// deadLetter records an unparsable line. Without a dead-letter sink it is
+// only logged.
+func deadLetter(line string, opts ingestOptions, node string, err error) {
+	reason := parseErrorReason(err)
+	logWarn("Skipping unparsable log (%s): %s", reason, line)
+	if deadLetters == nil {
+		return
+	}
+	deadLetters.enqueue(DeadLetter{
+		Time:   time.Now().UTC().Format(time.RFC3339Nano),
+		Reason: reason,
+		Error:  err.Error(),
+		Format: opts.format,
+		TZ:     opts.loc.String(),
+		Node:   node,
+		Line:   line,
+	})
+}
+
+// rejectedLine is a line of a batch that failed to parse.
+type rejectedLine struct {
+	line string
+	err  error
+}
+
+// deadLetterRejected dead-letters the rejected lines of a batch. Callers run
+// it once the batch's events were emitted: a batch whose emit failed comes
+// back with the same lines, which would otherwise be recorded twice.
+func deadLetterRejected(rejected []rejectedLine, opts ingestOptions) {
+	for _, r := range rejected {
+		deadLetter(r.line, opts, opts.origin.Node, r.err)
+	}
+}
+
+func (b *deadLetterBatcher) run() {
+	ticker := time.NewTicker(deadLetterBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+func (b *deadLetterBatcher) enqueue(letter DeadLetter) {
+	b.mu.Lock()
+	if len(b.queue) >= deadLetterMaxPending {
+		b.mu.Unlock()
+		b.dropped.Add(1)
+		return
+	}
+	b.queue = append(b.queue, letter)
+	full := len(b.queue) >= deadLetterBatchMax
+	b.mu.Unlock()
+
+	if full {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush sends everything queued so far in batches of deadLetterBatchMax.
+func (b *deadLetterBatcher) flush() {
+	b.mu.Lock()
+	queue := b.queue
+	b.queue = make([]DeadLetter, 0, deadLetterBatchMax)
+	b.mu.Unlock()
+
+	for len(queue) > 0 {
+		n := min(len(queue), deadLetterBatchMax)
+		b.send(queue[:n])
+		queue = queue[n:]
+	}
+}
+
+// send writes a batch as NDJSON. Dead letters are best effort: a failed
+// batch is logged and dropped.
+func (b *deadLetterBatcher) send(batch []DeadLetter) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, letter := range batch {
+		if err := encoder.Encode(letter); err != nil {
+			logError("Error encoding dead letter: %v", err)
+			return
+		}
+	}
+
+	if err := b.write(buf.Bytes()); err != nil {
+		logError("Dropping %d dead letters: %v", len(batch), err)
+		return
+	}
+	logDebug("Dead-lettered %d lines", len(batch))
+}
+
+func (b *deadLetterBatcher) write(payload []byte) error {
+	if b.path != "" {
+		f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", b.path, err)
+		}
+		defer f.Close()
+		if _, err := f.Write(payload); err != nil {
+			return fmt.Errorf("write %s: %w", b.path, err)
+		}
+		return nil
+	}
+
+	resp, err := b.client.Post(b.endpoint, vectorContentType, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("dead-letter endpoint returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// replayDeadLetters runs dead-lettered lines from r through the parser again
+// and emits the ones that now parse to the configured sink. Lines that still
+// fail are written to w as dead letters with their new reason.
+func replayDeadLetters(r io.Reader, w io.Writer) (replayed, failed int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*vectorScannerMaxLine)
+	encoder := json.NewEncoder(w)
+	batch := make([]logEvent, 0, INGEST_CHUNK_LINES)
+
+	flush := func() error {
+		if err := emitBatch(batch); err != nil {
+			return fmt.Errorf("emit: %w", err)
+		}
+		replayed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return replayed, failed, fmt.Errorf("decode dead letter: %w", err)
+		}
+
+		opts, err := deadLetterOptions(letter)
+		if err != nil {
+			return replayed, failed, err
+		}
+		entry, err := processEvent(letter.Line, opts)
+		if err != nil {
+			letter.Reason, letter.Error = parseErrorReason(err), err.Error()
+			if err := encoder.Encode(letter); err != nil {
+				return replayed, failed, fmt.Errorf("write dead letter: %w", err)
+			}
+			failed++
+			continue
+		}
+		if entry == nil {
+			continue
+		}
+		if batch = append(batch, entry); len(batch) >= INGEST_CHUNK_LINES {
+			if err := flush(); err != nil {
+				return replayed, failed, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return replayed, failed, fmt.Errorf("read: %w", err)
+	}
+	return replayed, failed, flush()
+}
+
+// deadLetterOptions restores the ingest options a line was first parsed with.
+func deadLetterOptions(letter DeadLetter) (ingestOptions, error) {
+	opts := defaultIngestOptions()
+	opts.origin.Node = letter.Node
+	if letter.Format != "" {
+		if err := validateIngestFormat(letter.Format); err != nil {
+			return ingestOptions{}, err
+		}
+		opts.format = letter.Format
+	}
+	if letter.TZ != "" {
+		loc, err := loadLocation(letter.TZ)
+		if err != nil {
+			return ingestOptions{}, err
+		}
+		opts.loc = loc
+	}
+	return opts, nil
+}
+
+// runReplay implements "xray-loki-proxy replay FILE...": it replays the
+// given dead-letter files and prints the lines that still fail to stdout.
+func runReplay(paths []string) error {
+	if len(paths) == 0 {
+		return fmt.Errorf("usage: xray-loki-proxy replay FILE...")
+	}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		replayed, failed, err := replayDeadLetters(f, os.Stdout)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		logInfo("Replayed %s: emitted=%d still_failing=%d", path, replayed, failed)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseLog_ErrorKinds(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want error
+	}{
+		{name: "garbage", line: `not an xray access log line`, want: errNoMatch},
+		{name: "bad timestamp", line: `02.05.2026 09:11:34 from 203.0.113.1:1 accepted tcp:alpha.example:443`, want: errBadTimestamp},
+		{name: "bad from", line: `2026/05/02 09:11:34.100001 from not-an-ip:4433 accepted tcp:alpha.example:443`, want: errBadFrom},
+		{name: "bad to", line: `2026/05/02 09:11:34.100001 from 203.0.113.1:1 accepted tcp:alpha.example`, want: errBadTo},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLog(tt.line)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("parseLog() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if got := parseErrorReason(errBadTimestamp); got != "bad_timestamp" {
+		t.Fatalf("parseErrorReason() = %q", got)
+	}
+	if _, err := parseErrorLog(`garbage`); !errors.Is(err, errNoMatch) {
+		t.Fatalf("parseErrorLog() error = %v, want %v", err, errNoMatch)
+	}
+}
+
+func withDeadLetterFile(t *testing.T) string {
+	t.Helper()
+	prev := deadLetters
+	t.Cleanup(func() { deadLetters = prev })
+
+	path := filepath.Join(t.TempDir(), "dead.ndjson")
+	deadLetters = newDeadLetterBatcher(path, "")
+	return path
+}
+
+func TestDeadLetter_RecordsAndReplays(t *testing.T) {
+	path := withDeadLetterFile(t)
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = filepath.Join(t.TempDir(), "out.ndjson"), "", "", nil
+
+	forkLine := `2026/03/11 14:22:07.918304 conn 203.0.113.47:4821 -> tcp:alpha.example:443`
+	lines := []string{formatTestAccessLine(1), forkLine, `garbage`}
+	tokyo, _ := loadLocation("Asia/Tokyo")
+	opts := ingestOptions{format: ingestFormatAccess, loc: tokyo}
+	events, rejected := processEventsParallel(lines, opts)
+	if len(events) != 1 || len(rejected) != 2 {
+		t.Fatalf("processEventsParallel() = %d events, %d rejected; want 1 and 2", len(events), len(rejected))
+	}
+	deadLetterRejected(rejected, opts)
+	deadLetters.flush()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var letters []DeadLetter
+	for _, raw := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var letter DeadLetter
+		if err := json.Unmarshal([]byte(raw), &letter); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", raw, err)
+		}
+		letters = append(letters, letter)
+	}
+	if len(letters) != 2 {
+		t.Fatalf("dead letters = %+v, want 2", letters)
+	}
+	for _, letter := range letters {
+		if letter.Reason != "no_match" || letter.Format != ingestFormatAccess || letter.TZ != "Asia/Tokyo" || letter.Error == "" {
+			t.Fatalf("dead letter = %+v", letter)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, letter.Time); err != nil {
+			t.Fatalf("dead letter time %q: %v", letter.Time, err)
+		}
+	}
+
+	// Once a format for the fork exists, its line replays; garbage stays.
+	withLogFormats(t, []LogFormatConfig{
+		{Name: "fork", Regex: `(?P<datetime>\S+ \S+) conn (?P<from>\S+) -> (?P<to>\S+)`},
+	})
+	var stillFailing bytes.Buffer
+	replayed, failed, err := replayDeadLetters(bytes.NewReader(data), &stillFailing)
+	if err != nil {
+		t.Fatalf("replayDeadLetters() error = %v", err)
+	}
+	if replayed != 1 || failed != 1 {
+		t.Fatalf("replayDeadLetters() = %d replayed, %d failed, want 1, 1", replayed, failed)
+	}
+	if !strings.Contains(stillFailing.String(), `"line":"garbage"`) {
+		t.Fatalf("still failing = %s", stillFailing.String())
+	}
+
+	out, err := os.ReadFile(OUTPUT_FILE)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	var entry LogEntry
+	if err := json.Unmarshal(out, &entry); err != nil {
+		t.Fatalf("Unmarshal(%s) error = %v", out, err)
+	}
+	if entry.Format != "fork" || entry.Datetime != "2026-03-11 05:22:07.918304" {
+		t.Fatalf("replayed entry = %+v, want the fork line parsed in Asia/Tokyo", entry)
+	}
+}
+
+func TestDeadLetterBatcher_SlowSinkIsBounded(t *testing.T) {
+	release := make(chan struct{})
+	var inflight, maxInflight atomic.Int32
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		if n > maxInflight.Load() {
+			maxInflight.Store(n)
+		}
+		<-release
+		data, _ := io.ReadAll(r.Body)
+		received.Add(int64(bytes.Count(data, []byte("\n"))))
+	}))
+	defer server.Close()
+
+	b := newDeadLetterBatcher("", server.URL)
+	go b.run()
+
+	// The sender takes at most deadLetterMaxPending and blocks on them; of
+	// the rest, only deadLetterMaxPending can wait in the queue.
+	total := 2*deadLetterMaxPending + deadLetterBatchMax
+	for i := 0; i < total; i++ {
+		b.enqueue(DeadLetter{Reason: "no_match", Line: "garbage"})
+	}
+	for inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if dropped := b.dropped.Load(); dropped == 0 {
+		t.Fatal("nothing dropped while the sink was stuck")
+	}
+
+	close(release)
+	for received.Load()+int64(b.dropped.Load()) < int64(total) {
+		time.Sleep(time.Millisecond)
+	}
+	if maxInflight.Load() != 1 {
+		t.Fatalf("%d sends ran at once, want 1", maxInflight.Load())
+	}
+}
+
+func TestDeadLetter_RetriedBatchIsRecordedOnce(t *testing.T) {
+	path := withDeadLetterFile(t)
+	prevFile, prevVector, prevLoki, prevRules, prevDedup := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, forwardedBatches
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, forwardedBatches = prevFile, prevVector, prevLoki, prevRules, prevDedup
+	})
+	out := filepath.Join(t.TempDir(), "out.ndjson")
+	VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = "", "", nil
+	forwardedBatches = newMemoryDedupStore(100, time.Hour)
+
+	body := formatTestAccessLine(1) + "\ngarbage\n"
+	ingest := func() int {
+		rec := httptest.NewRecorder()
+		vectorIngestHandler(rec, httptest.NewRequest(http.MethodPost, "/vector/ingest", strings.NewReader(body)))
+		return rec.Code
+	}
+
+	// The sink fails, so the shipper sends the batch again.
+	OUTPUT_FILE = filepath.Join(t.TempDir(), "missing", "out.ndjson")
+	if code := ingest(); code == http.StatusOK {
+		t.Fatal("ingest succeeded with a failing sink")
+	}
+	OUTPUT_FILE = out
+	if code := ingest(); code != http.StatusOK {
+		t.Fatalf("retry status = %d", code)
+	}
+	deadLetters.flush()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if n := strings.Count(string(data), `"line":"garbage"`); n != 1 {
+		t.Fatalf("garbage dead-lettered %d times, want 1:\n%s", n, data)
+	}
+}
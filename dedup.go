@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DEDUP_MAX_ENTRIES = getEnvInt("DEDUP_MAX_ENTRIES", 100000)
+var DEDUP_TTL = getEnvDuration("DEDUP_TTL", 24*time.Hour)
+var DEDUP_FILE = getEnv("DEDUP_FILE", "")
+
+// batchDedupStore remembers ingest batches (by content hash) that were
+// already emitted, so a shipper retrying a delivered batch does not produce
+// duplicates. Implementations must be safe for concurrent use; a shared
+// backend would let several replicas dedup against each other.
+type batchDedupStore interface {
+	Seen(batchID string) bool
+	Mark(batchID string) error
+}
+
+// forwardedBatches is the process-wide dedup store used by the ingest
+// handlers. main swaps in a persistent store when DEDUP_FILE is set.
+var forwardedBatches batchDedupStore = newMemoryDedupStore(DEDUP_MAX_ENTRIES, DEDUP_TTL)
+
+func initDedupStore() error {
+	if DEDUP_FILE == "" {
+		return nil
+	}
+	store, err := openFileDedupStore(DEDUP_FILE, DEDUP_MAX_ENTRIES, DEDUP_TTL)
+	if err != nil {
+		return err
+	}
+	forwardedBatches = store
+	logInfo("Loaded batch dedup store from %s (%d entries)", DEDUP_FILE, store.mem.Len())
+	return nil
+}
+
+// markForwarded records an emitted batch. A failing store only costs dedup
+// for that batch, so the error is logged rather than failing the request.
+func markForwarded(batchID string) {
+	if err := forwardedBatches.Mark(batchID); err != nil {
+		logError("Failed to record batch %s in dedup store: %v", batchID, err)
+	}
+}
+
+type dedupItem struct {
+	id       string
+	markedAt time.Time
+}
+
+// memoryDedupStore is an LRU bounded by maxEntries whose entries also expire
+// ttl after they were marked.
+type memoryDedupStore struct {
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	order *list.List // front = most recently marked
+	items map[string]*list.Element
+}
+
+func newMemoryDedupStore(maxEntries int, ttl time.Duration) *memoryDedupStore {
+	return &memoryDedupStore{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		now:        time.Now,
+		order:      list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryDedupStore) Seen(batchID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.items[batchID]
+	if !ok {
+		return false
+	}
+	if s.expired(el.Value.(dedupItem)) {
+		s.remove(el)
+		return false
+	}
+	return true
+}
+
+func (s *memoryDedupStore) Mark(batchID string) error {
+	s.markAt(batchID, s.now())
+	return nil
+}
+
+func (s *memoryDedupStore) markAt(batchID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[batchID]; ok {
+		el.Value = dedupItem{id: batchID, markedAt: at}
+		s.order.MoveToFront(el)
+	} else {
+		s.items[batchID] = s.order.PushFront(dedupItem{id: batchID, markedAt: at})
+	}
+	s.evict()
+}
+
+// evict drops expired entries from the old end, then the oldest ones beyond
+// maxEntries. Marks are roughly time-ordered, so stopping at the first live
+// entry is enough.
+func (s *memoryDedupStore) evict() {
+	for el := s.order.Back(); el != nil; el = s.order.Back() {
+		if !s.expired(el.Value.(dedupItem)) && s.order.Len() <= s.maxEntries {
+			return
+		}
+		s.remove(el)
+	}
+}
+
+func (s *memoryDedupStore) expired(item dedupItem) bool {
+	return s.now().Sub(item.markedAt) >= s.ttl
+}
+
+func (s *memoryDedupStore) remove(el *list.Element) {
+	delete(s.items, el.Value.(dedupItem).id)
+	s.order.Remove(el)
+}
+
+// Len returns the number of entries currently held, expired or not.
+func (s *memoryDedupStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
+
+// snapshot returns live entries from oldest to newest.
+func (s *memoryDedupStore) snapshot() []dedupItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]dedupItem, 0, s.order.Len())
+	for el := s.order.Back(); el != nil; el = el.Prev() {
+		if item := el.Value.(dedupItem); !s.expired(item) {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// fileDedupStore keeps a memoryDedupStore and journals every mark to an
+// append-only file ("<batch id> <unix nanos>" per line), so the dedup state
+// survives restarts. The journal is compacted once it holds twice as many
+// lines as the store may keep.
+type fileDedupStore struct {
+	mem  *memoryDedupStore
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	written int
+}
+
+func openFileDedupStore(path string, maxEntries int, ttl time.Duration) (*fileDedupStore, error) {
+	s := &fileDedupStore{mem: newMemoryDedupStore(maxEntries, ttl), path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileDedupStore) Seen(batchID string) bool {
+	return s.mem.Seen(batchID)
+}
+
+func (s *fileDedupStore) Mark(batchID string) error {
+	now := s.mem.now()
+	s.mem.markAt(batchID, now)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := fmt.Fprintf(s.file, "%s %d\n", batchID, now.UnixNano()); err != nil {
+		return fmt.Errorf("dedup journal: %w", err)
+	}
+	s.written++
+	if s.written > 2*s.mem.maxEntries {
+		return s.compactLocked()
+	}
+	return nil
+}
+
+func (s *fileDedupStore) load() error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open dedup file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, nanos, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		ts, err := strconv.ParseInt(nanos, 10, 64)
+		if err != nil {
+			continue
+		}
+		if item := (dedupItem{id: id, markedAt: time.Unix(0, ts)}); !s.mem.expired(item) {
+			s.mem.markAt(id, item.markedAt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read dedup file: %w", err)
+	}
+	return nil
+}
+
+func (s *fileDedupStore) compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked rewrites the journal with only the live entries and reopens
+// it for appending.
+func (s *fileDedupStore) compactLocked() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	items := s.mem.snapshot()
+	for _, item := range items {
+		fmt.Fprintf(w, "%s %d\n", item.id, item.markedAt.UnixNano())
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("compact dedup file: %w", err)
+	}
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("open dedup file: %w", err)
+	}
+	s.written = len(items)
+	return nil
+}
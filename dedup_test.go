@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestMemoryDedupStore_TTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	s := newMemoryDedupStore(10, time.Minute)
+	s.now = clock.now
+
+	s.Mark("a")
+	if !s.Seen("a") {
+		t.Fatal("fresh mark not seen")
+	}
+	clock.advance(59 * time.Second)
+	if !s.Seen("a") {
+		t.Fatal("mark expired before ttl")
+	}
+	clock.advance(time.Second)
+	if s.Seen("a") {
+		t.Fatal("mark still seen after ttl")
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expired entry not removed, len=%d", s.Len())
+	}
+}
+
+func TestMemoryDedupStore_MaxEntries(t *testing.T) {
+	s := newMemoryDedupStore(3, time.Hour)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Mark(id)
+	}
+	if s.Seen("a") {
+		t.Fatal("oldest entry not evicted")
+	}
+	for _, id := range []string{"b", "c", "d"} {
+		if !s.Seen(id) {
+			t.Fatalf("entry %s evicted too early", id)
+		}
+	}
+
+	// Re-marking refreshes recency, so "b" survives the next insert.
+	s.Mark("b")
+	s.Mark("e")
+	if !s.Seen("b") || s.Seen("c") {
+		t.Fatal("re-marked entry must outlive older ones")
+	}
+}
+
+func TestFileDedupStore_PersistsAcrossRestart(t *testing.T) {
+	path := t.TempDir() + "/dedup.log"
+
+	s, err := openFileDedupStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := s.Mark("batch-1"); err != nil {
+		t.Fatalf("Mark: %v", err)
+	}
+	if err := s.Mark("batch-2"); err != nil {
+		t.Fatalf("Mark: %v", err)
+	}
+
+	reopened, err := openFileDedupStore(path, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !reopened.Seen("batch-1") || !reopened.Seen("batch-2") {
+		t.Fatal("marks lost across restart")
+	}
+	if reopened.Seen("batch-3") {
+		t.Fatal("unknown batch reported as seen")
+	}
+
+	expired, err := openFileDedupStore(path, 100, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("reopen with short ttl: %v", err)
+	}
+	if expired.Seen("batch-1") {
+		t.Fatal("expired mark loaded")
+	}
+}
+
+func TestFileDedupStore_Compacts(t *testing.T) {
+	path := t.TempDir() + "/dedup.log"
+	s, err := openFileDedupStore(path, 5, time.Hour)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := s.Mark(fmt.Sprintf("batch-%d", i)); err != nil {
+			t.Fatalf("Mark: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if n := strings.Count(string(data), "\n"); n > 2*5+1 {
+		t.Fatalf("journal not compacted: %d lines", n)
+	}
+
+	reopened, err := openFileDedupStore(path, 5, time.Hour)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if !reopened.Seen("batch-49") || reopened.Seen("batch-0") {
+		t.Fatal("compacted journal lost recent marks or kept old ones")
+	}
+}
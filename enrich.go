@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var PTR_ASYNC = getEnvBool("PTR_ASYNC", false)
+var PTR_ASYNC_QUEUE = getEnvInt("PTR_ASYNC_QUEUE", 10000)
+
+const (
+	// ptrAsyncLookups bounds reverse lookups run by the delay queue at once,
+	// matching the parse concurrency of the synchronous path.
+	ptrAsyncLookups       = vectorParseConcurrency
+	ptrAsyncBatchMax      = 500
+	ptrAsyncBatchInterval = 250 * time.Millisecond
+)
+
+// ptrDelayed holds access entries whose destination was not in the PTR cache
+// at parse time. It is nil unless PTR_ASYNC is set.
+var ptrDelayed *ptrDelayQueue
+
+// ptrDelayQueue holds entries back until their PTR lookup finishes (at most
+// ptrLookupTimeout) and then emits them, so ingest requests never wait on
+// DNS. Skip rules run once to_addr is known. At most capacity entries wait at
+// a time; the rest are emitted right away without to_addr.
+type ptrDelayQueue struct {
+	capacity int64
+	lookups  chan struct{}
+	out      *emitBatcher
+
+	pending   atomic.Int64
+	delayed   atomic.Uint64
+	overflows atomic.Uint64
+}
+
+func newPTRDelayQueue(capacity int) *ptrDelayQueue {
+	return &ptrDelayQueue{
+		capacity: int64(capacity),
+		lookups:  make(chan struct{}, ptrAsyncLookups),
+		out:      newEmitBatcher("ptr", ptrAsyncBatchMax, ptrAsyncBatchInterval),
+	}
+}
+
+func startPTRAsync() {
+	if !PTR_ASYNC || PTR_RESOLVER == ptrResolverOff {
+		return
+	}
+	ptrDelayed = newPTRDelayQueue(PTR_ASYNC_QUEUE)
+	go ptrDelayed.out.run()
+	logInfo("PTR enrichment is asynchronous (queue=%d)", PTR_ASYNC_QUEUE)
+}
+
+// cachedToAddr returns the PTR names of host from the hosts file or the
+// cache, and whether the entry can go out now: host is not an IP, lookups are
+// synchronous, or the answer is known.
+func cachedToAddr(host string) ([]string, bool) {
+	if ptrDelayed == nil {
+		return lookupToAddrTimed(host), true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, true
+	}
+	if names := ptrHosts.Load().lookup(ip); names != nil {
+		return names, true
+	}
+	return ptrLookups.cached(ip)
+}
+
+// holdPTRPending splits entries into those that can be emitted now and those
+// still waiting for their PTR names that the delay queue has room for.
+// Entries the full queue cannot take are admitted without to_addr. Once the
+// ready entries are emitted the caller hands held to the queue with start;
+// if that fails it gives the room back with release and keeps entries for
+// retry, so a retried batch neither loses held entries nor sends them twice.
+func holdPTRPending(entries []logEvent) (ready []logEvent, held []*LogEntry) {
+	if ptrDelayed == nil {
+		return entries, nil
+	}
+	ready = entries[:0:0]
+	for _, event := range entries {
+		entry, ok := event.(*LogEntry)
+		if !ok || !entry.ptrPending {
+			ready = append(ready, event)
+			continue
+		}
+		if ptrDelayed.reserve() {
+			held = append(held, entry)
+			continue
+		}
+		entry.ptrPending = false
+		if !isSkipped(entry, skipRules) {
+			ready = append(ready, entry)
+		}
+	}
+	return ready, held
+}
+
+// reserve takes room for one entry, or reports false when the queue is full.
+func (q *ptrDelayQueue) reserve() bool {
+	if q.pending.Add(1) > q.capacity {
+		q.pending.Add(-1)
+		q.overflows.Add(1)
+		return false
+	}
+	return true
+}
+
+// start queues held entries for enrichment in the room reserved for them.
+func (q *ptrDelayQueue) start(held []*LogEntry) {
+	for _, entry := range held {
+		entry.ptrPending = false
+		q.delayed.Add(1)
+		go q.enrich(entry)
+	}
+}
+
+// release gives back the room reserved for held entries that were not
+// started.
+func (q *ptrDelayQueue) release(held []*LogEntry) {
+	if len(held) > 0 {
+		q.pending.Add(-int64(len(held)))
+	}
+}
+
+func (q *ptrDelayQueue) enrich(entry *LogEntry) {
+	defer q.pending.Add(-1)
+
+	q.lookups <- struct{}{}
+	names := lookupToAddrTimed(entry.DestHost)
+	<-q.lookups
+
+	if names != nil {
+		entry.ToAddr = names
+	}
+	if isSkipped(entry, skipRules) {
+		return
+	}
+	q.out.add(entry)
+}
+
+// Len returns the number of entries waiting for a lookup.
+func (q *ptrDelayQueue) Len() int {
+	return int(q.pending.Load())
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withPTRDelayQueue turns on asynchronous PTR enrichment with a file sink and
+// a fresh dedup store. The queue's batcher is not running; tests flush it
+// themselves.
+func withPTRDelayQueue(t *testing.T, capacity int, rules []SkipRule) *ptrDelayQueue {
+	t.Helper()
+	prevFile, prevVector, prevLoki, prevRules, prevQueue := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, ptrDelayed
+	prevDedup := forwardedBatches
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, ptrDelayed = prevFile, prevVector, prevLoki, prevRules, prevQueue
+		forwardedBatches = prevDedup
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = t.TempDir()+"/out.ndjson", "", "", rules
+	forwardedBatches = newMemoryDedupStore(100, time.Hour)
+	ptrDelayed = newPTRDelayQueue(capacity)
+	return ptrDelayed
+}
+
+func ingestLines(t *testing.T, lines ...string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/vector/ingest", strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	rec := httptest.NewRecorder()
+	vectorIngestHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func readOutput(t *testing.T) string {
+	t.Helper()
+	data, err := os.ReadFile(OUTPUT_FILE)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	return string(data)
+}
+
+func TestPTRDelayQueue_IngestDoesNotWaitForDNS(t *testing.T) {
+	release := make(chan struct{})
+	withPTRResolver(t, func(_ context.Context, ip net.IP) ([]string, time.Duration, error) {
+		<-release
+		switch ip.String() {
+		case "198.51.100.10":
+			return []string{"edge.example.net."}, time.Minute, nil
+		case "198.51.100.20":
+			return []string{"tracker.example.org."}, time.Minute, nil
+		}
+		return nil, 0, nil
+	})
+	q := withPTRDelayQueue(t, 10, []SkipRule{{Domain: []string{"tracker.example.org"}}})
+
+	// Both lookups block, yet the request completes and nothing is emitted.
+	ingestLines(t, formatTestAccessLine(1), strings.Replace(formatTestAccessLine(2), "198.51.100.10", "198.51.100.20", 1))
+	if out := readOutput(t); out != "" {
+		t.Fatalf("emitted before the PTR lookups finished: %s", out)
+	}
+	if q.Len() != 2 || q.delayed.Load() != 2 {
+		t.Fatalf("Len() = %d, delayed = %d, want 2, 2", q.Len(), q.delayed.Load())
+	}
+
+	close(release)
+	for q.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.out.flush()
+
+	// The skip rule matched line 2 through its PTR name.
+	out := readOutput(t)
+	if !strings.Contains(out, `"to_addr":["edge.example.net"]`) || strings.Contains(out, `"email":"2"`) {
+		t.Fatalf("unexpected output %s", out)
+	}
+
+	// Cached destinations go out with the request.
+	ingestLines(t, formatTestAccessLine(3))
+	if out := readOutput(t); !strings.Contains(out, `"email":"3"`) {
+		t.Fatalf("cached entry not emitted synchronously: %s", out)
+	}
+}
+
+func TestPTRDelayQueue_Overflow(t *testing.T) {
+	withPTRResolver(t, (&fakePTRResolver{answers: map[string][]string{"198.51.100.10": {"edge.example.net."}}}).resolve)
+	q := withPTRDelayQueue(t, 0, nil)
+
+	ingestLines(t, formatTestAccessLine(4))
+	if out := readOutput(t); !strings.Contains(out, `"email":"4"`) || !strings.Contains(out, `"to_addr":[]`) {
+		t.Fatalf("overflowing entry not emitted without to_addr: %s", out)
+	}
+	if q.overflows.Load() != 1 || q.Len() != 0 {
+		t.Fatalf("overflows = %d, Len() = %d, want 1, 0", q.overflows.Load(), q.Len())
+	}
+}
+
+func TestPTRDelayQueue_RetriedBatchIsNotDelayedTwice(t *testing.T) {
+	withPTRResolver(t, (&fakePTRResolver{answers: map[string][]string{"198.51.100.10": {"edge.example.net."}}}).resolve)
+	q := withPTRDelayQueue(t, 10, nil)
+	out := OUTPUT_FILE
+
+	delayed, err := parseLog(formatTestAccessLine(1))
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	direct, err := parseLog(strings.Replace(formatTestAccessLine(2), "tcp:198.51.100.10:443", "tcp:example.com:443", 1))
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	if !delayed.ptrPending || direct.ptrPending {
+		t.Fatalf("ptrPending = %v, %v, want true, false", delayed.ptrPending, direct.ptrPending)
+	}
+
+	// The first flush fails before the entry is delayed; the retry delays it
+	// once.
+	b := newEmitBatcher("test", 10, time.Hour)
+	b.add(delayed, direct)
+	OUTPUT_FILE = t.TempDir() + "/missing/out.ndjson"
+	b.flush()
+	OUTPUT_FILE = out
+	b.flush()
+
+	for q.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.out.flush()
+
+	got := readOutput(t)
+	if strings.Count(got, `"email":"1"`) != 1 || strings.Count(got, `"email":"2"`) != 1 {
+		t.Fatalf("each entry should be emitted once: %s", got)
+	}
+	if !strings.Contains(got, `"to_addr":["edge.example.net"]`) {
+		t.Fatalf("delayed entry emitted without its PTR name: %s", got)
+	}
+}
+
+func TestPTRDelayQueue_FailedChunkIsNotDelayed(t *testing.T) {
+	withPTRResolver(t, (&fakePTRResolver{answers: map[string][]string{"198.51.100.10": {"edge.example.net."}}}).resolve)
+	q := withPTRDelayQueue(t, 10, nil)
+	out := OUTPUT_FILE
+	lines := []string{
+		formatTestAccessLine(1),
+		strings.Replace(formatTestAccessLine(2), "tcp:198.51.100.10:443", "tcp:example.com:443", 1),
+	}
+
+	// The sink rejects the cached entry, so the chunk fails and nothing may
+	// wait in the queue: the shipper's retry carries the line again.
+	OUTPUT_FILE = t.TempDir() + "/missing/out.ndjson"
+	req := httptest.NewRequest(http.MethodPost, "/vector/ingest", strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	rec := httptest.NewRecorder()
+	vectorIngestHandler(rec, req)
+	if rec.Code == http.StatusOK {
+		t.Fatal("ingest succeeded with a failing sink")
+	}
+	if q.delayed.Load() != 0 || q.Len() != 0 {
+		t.Fatalf("delayed = %d, Len() = %d after a failed chunk, want 0, 0", q.delayed.Load(), q.Len())
+	}
+
+	OUTPUT_FILE = out
+	ingestLines(t, lines...)
+	for q.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.out.flush()
+
+	got := readOutput(t)
+	if strings.Count(got, `"email":"1"`) != 1 || strings.Count(got, `"email":"2"`) != 1 {
+		t.Fatalf("each entry should be emitted once: %s", got)
+	}
+}
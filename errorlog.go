@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* https://github.com/XTLS/Xray-core/blob/main/common/log/log.go: "<time> [Level] [session] component: message" */
+var xrayErrorLogFormat = regexp.MustCompile(`^(?P<datetime>\S+\s+\S+)\s+\[(?P<level>Debug|Info|Warning|Error)\]\s+(?:\[(?P<session>\d+)\]\s+)?(?P<message>.*)$`)
+
+// ErrorLogEntry is one line of Xray's error log.
+type ErrorLogEntry struct {
+	LogType   string `json:"log_type"`
+	Datetime  string `json:"datetime"`
+	Level     string `json:"level"`
+	SessionID uint32 `json:"session_id,omitempty"`
+	Component string `json:"component"`
+	Message   string `json:"message"`
+	eventOrigin
+}
+
+func (e *ErrorLogEntry) eventDatetime() string { return e.Datetime }
+
+func (e *ErrorLogEntry) labelValue(field string) (string, bool) {
+	switch field {
+	case "log_type":
+		return e.LogType, true
+	case "level":
+		return e.Level, true
+	case "component":
+		return e.Component, true
+	default:
+		return "", false
+	}
+}
+
+// isErrorLogLine tells error-log lines from access lines for auto detection.
+func isErrorLogLine(line string) bool {
+	return xrayErrorLogFormat.MatchString(line)
+}
+
+func parseErrorLog(logLine string) (*ErrorLogEntry, error) {
+	return parseErrorLogInZone(logLine, sourceLocation)
+}
+
+// parseErrorLogInZone parses an error-log line whose timestamp is local time
+// in loc.
+func parseErrorLogInZone(logLine string, loc *time.Location) (*ErrorLogEntry, error) {
+	match := xrayErrorLogFormat.FindStringSubmatch(logLine)
+	if match == nil {
+		return nil, errNoMatch
+	}
+	groups := make(map[string]string, len(match))
+	for i, name := range xrayErrorLogFormat.SubexpNames() {
+		if i > 0 && name != "" {
+			groups[name] = match[i]
+		}
+	}
+
+	datetime, err := formatXrayDatetime(groups["datetime"], loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadTimestamp, err)
+	}
+
+	var session uint64
+	if groups["session"] != "" {
+		if session, err = strconv.ParseUint(groups["session"], 10, 32); err != nil {
+			return nil, fmt.Errorf("session_id: %w", err)
+		}
+	}
+
+	component, message := splitErrorComponent(groups["message"])
+	return &ErrorLogEntry{
+		LogType:   ingestFormatError,
+		Datetime:  datetime,
+		Level:     strings.ToLower(groups["level"]),
+		SessionID: uint32(session),
+		Component: component,
+		Message:   message,
+	}, nil
+}
+
+// splitErrorComponent splits "app/dispatcher: taking detour ..." into the
+// emitting package and the message. Messages without a package prefix keep
+// an empty component.
+func splitErrorComponent(s string) (string, string) {
+	component, message, ok := strings.Cut(s, ": ")
+	if !ok || component == "" || strings.ContainsAny(component, " []") {
+		return "", s
+	}
+	return component, message
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseErrorLog(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want ErrorLogEntry
+	}{
+		{
+			name: "sniffed domain with session",
+			line: `2026/03/11 14:22:07.918304 [Info] [3912207401] app/dispatcher: sniffed domain: probe.example-cdn.net`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2026-03-11 14:22:07.918304",
+				Level:     "info",
+				SessionID: 3912207401,
+				Component: "app/dispatcher",
+				Message:   "sniffed domain: probe.example-cdn.net",
+			},
+		},
+		{
+			name: "routing decision",
+			line: `2026/03/11 14:22:07.918410 [Info] [3912207401] app/dispatcher: taking detour [DIRECT] for [tcp:probe.example-cdn.net:443]`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2026-03-11 14:22:07.918410",
+				Level:     "info",
+				SessionID: 3912207401,
+				Component: "app/dispatcher",
+				Message:   "taking detour [DIRECT] for [tcp:probe.example-cdn.net:443]",
+			},
+		},
+		{
+			name: "connection end at debug",
+			line: `2026/03/11 14:22:09.000001 [Debug] [3912207401] proxy/freedom: connection ends > proxy/freedom: failed to process response > io: read/write on closed pipe`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2026-03-11 14:22:09.000001",
+				Level:     "debug",
+				SessionID: 3912207401,
+				Component: "proxy/freedom",
+				Message:   "connection ends > proxy/freedom: failed to process response > io: read/write on closed pipe",
+			},
+		},
+		{
+			name: "warning without session",
+			line: `2026/03/11 14:22:10.500000 [Warning] core: Xray 25.3.6 started`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2026-03-11 14:22:10.500000",
+				Level:     "warning",
+				Component: "core",
+				Message:   "Xray 25.3.6 started",
+			},
+		},
+		{
+			name: "older build with second precision",
+			line: `2025/02/01 22:33:25 [Info] [1730529] proxy/vless/inbound: received request for tcp:alpha.example:443`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2025-02-01 22:33:25.000000",
+				Level:     "info",
+				SessionID: 1730529,
+				Component: "proxy/vless/inbound",
+				Message:   "received request for tcp:alpha.example:443",
+			},
+		},
+		{
+			name: "message without component",
+			line: `2026/03/11 14:22:11.000000 [Error] [17] failed to handler mux client connection`,
+			want: ErrorLogEntry{
+				LogType:   "error",
+				Datetime:  "2026-03-11 14:22:11.000000",
+				Level:     "error",
+				SessionID: 17,
+				Message:   "failed to handler mux client connection",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseErrorLog(tt.line)
+			if err != nil {
+				t.Fatalf("parseErrorLog() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Fatalf("parseErrorLog() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrorLog_Invalid(t *testing.T) {
+	for _, line := range []string{
+		formatTestAccessLine(1204),
+		`2026/03/11 14:22:07.918304 [Trace] app/dispatcher: nope`,
+		`2026/13/11 14:22:07.918304 [Info] app/dispatcher: bad month`,
+		`2026/03/11 14:22:07.918304 [Info] [99999999999] app/dispatcher: session overflows uint32`,
+	} {
+		if _, err := parseErrorLog(line); err == nil {
+			t.Errorf("parseErrorLog(%q) error = nil, want error", line)
+		}
+	}
+}
+
+func TestErrorLogEntry_JSONContract(t *testing.T) {
+	entry := &ErrorLogEntry{
+		LogType:   "error",
+		Datetime:  "2026-03-11 14:22:07.918304",
+		Level:     "info",
+		SessionID: 3912207401,
+		Component: "app/dispatcher",
+		Message:   "sniffed domain: probe.example-cdn.net",
+	}
+	entry.Node = "edge-1"
+
+	got, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	want := `{"log_type":"error","datetime":"2026-03-11 14:22:07.918304","level":"info","session_id":3912207401,"component":"app/dispatcher","message":"sniffed domain: probe.example-cdn.net","node":"edge-1"}`
+	if string(got) != want {
+		t.Fatalf("JSON mismatch\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestProcessEvent_Formats(t *testing.T) {
+	prevRules := skipRules
+	t.Cleanup(func() { skipRules = prevRules })
+	skipRules = nil
+
+	accessLine := formatTestAccessLine(1204)
+	errorLine := `2026/03/11 14:22:07.918304 [Info] [42] app/dispatcher: sniffed domain: example.com`
+
+	tests := []struct {
+		name     string
+		line     string
+		format   string
+		wantType string
+		wantErr  bool
+	}{
+		{name: "access as access", line: accessLine, format: ingestFormatAccess, wantType: "*main.LogEntry"},
+		{name: "error as error", line: errorLine, format: ingestFormatError, wantType: "*main.ErrorLogEntry"},
+		{name: "auto access", line: accessLine, format: ingestFormatAuto, wantType: "*main.LogEntry"},
+		{name: "auto error", line: errorLine, format: ingestFormatAuto, wantType: "*main.ErrorLogEntry"},
+		{name: "error as access", line: errorLine, format: ingestFormatAccess, wantErr: true},
+		{name: "access as error", line: accessLine, format: ingestFormatError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := processEvent(tt.line, ingestOptions{format: tt.format, loc: time.UTC})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("processEvent() = %T, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("processEvent() error = %v", err)
+			}
+			if typ := reflect.TypeOf(got).String(); typ != tt.wantType {
+				t.Fatalf("processEvent() type = %s, want %s", typ, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestVectorIngestHandler_Format(t *testing.T) {
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+	})
+	path := t.TempDir() + "/out.ndjson"
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = path, "", "", nil
+
+	body := formatTestAccessLine(1204) + "\n" +
+		`2026/03/11 14:22:07.918304 [Info] [42] app/dispatcher: taking detour [DIRECT] for [tcp:example.com:443]` + "\n"
+
+	req := httptest.NewRequest(http.MethodPost, "/vector/ingest?format=bogus", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	vectorIngestHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("format=bogus status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/vector/ingest?format=auto", strings.NewReader(body))
+	rec = httptest.NewRecorder()
+	vectorIngestHandler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("format=auto status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	var logTypes []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line struct {
+			LogType string `json:"log_type"`
+			Email   string `json:"email"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Unmarshal: %v", err)
+		}
+		logTypes = append(logTypes, line.LogType+"/"+line.Email)
+	}
+	if want := []string{"/1204", "error/"}; !reflect.DeepEqual(logTypes, want) {
+		t.Fatalf("emitted %v, want %v", logTypes, want)
+	}
+}
+
+func TestGroupLokiStreams_ErrorLogLabels(t *testing.T) {
+	withLokiConfig(t, "http://loki", lokiEncodingProtobuf, "status,level", "job=xray")
+	if err := validateLokiConfig(); err != nil {
+		t.Fatalf("validateLokiConfig() error = %v", err)
+	}
+
+	events := []logEvent{
+		&LogEntry{Datetime: "2026-07-23 10:11:12.100000", Email: "1", Status: "accepted", ToAddr: []string{}},
+		&ErrorLogEntry{LogType: "error", Datetime: "2026-07-23 10:11:12.200000", Level: "info", Message: "m"},
+	}
+	streams, err := groupLokiStreams(events)
+	if err != nil {
+		t.Fatalf("groupLokiStreams() error = %v", err)
+	}
+	var got []string
+	for _, s := range streams {
+		got = append(got, s.labels)
+	}
+	want := []string{`{job="xray", status="accepted"}`, `{job="xray", level="info"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("stream labels = %v, want %v", got, want)
+	}
+}
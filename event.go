@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var INGEST_FORMAT = getEnv("INGEST_FORMAT", ingestFormatAccess)
+
+// Log formats an ingest source can carry. "auto" detects the format per line.
+const (
+	ingestFormatAccess  = "access"
+	ingestFormatError   = "error"
+	ingestFormatSingbox = "singbox"
+	ingestFormatAuto    = "auto"
+)
+
+// logEvent is a structured record the sinks can emit: an access LogEntry, an
+// ErrorLogEntry or a correlated ConnectionEntry.
+type logEvent interface {
+	// eventDatetime returns the formatted event time.
+	eventDatetime() string
+	// labelValue returns a field addressed by its JSON name, for Loki labels.
+	labelValue(field string) (string, bool)
+	origin() *eventOrigin
+}
+
+// eventOrigin records where an event was received from. It is embedded in
+// every event type so the JSON stays flat.
+type eventOrigin struct {
+	// Node is the sending host for lines received over syslog.
+	Node string `json:"node,omitempty"`
+	// Labels carries the stream labels of lines received via Loki push.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (o *eventOrigin) origin() *eventOrigin { return o }
+
+// key identifies the origin as a string, for state kept per sending host or
+// stream: the node followed by the labels in sorted order.
+func (o *eventOrigin) key() string {
+	if len(o.Labels) == 0 {
+		return o.Node
+	}
+	names := make([]string, 0, len(o.Labels))
+	for name := range o.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(o.Node)
+	for _, name := range names {
+		fmt.Fprintf(&b, "\x00%s=%s", name, o.Labels[name])
+	}
+	return b.String()
+}
+
+func validateIngestFormat(format string) error {
+	switch format {
+	case ingestFormatAccess, ingestFormatError, ingestFormatSingbox, ingestFormatAuto:
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %q, want %q, %q, %q or %q",
+			format, ingestFormatAccess, ingestFormatError, ingestFormatSingbox, ingestFormatAuto)
+	}
+}
+
+// ingestOptions describes the lines of one ingest source: their log format,
+// the timezone their timestamps are written in and where they came from.
+type ingestOptions struct {
+	format string
+	loc    *time.Location
+	origin eventOrigin
+}
+
+// defaultIngestOptions applies INGEST_FORMAT and SOURCE_TIMEZONE.
+func defaultIngestOptions() ingestOptions {
+	return ingestOptions{format: INGEST_FORMAT, loc: sourceLocation}
+}
+
+// requestIngestOptions picks the options for an ingest request: the "format"
+// and "tz" query parameters when present, the defaults otherwise.
+func requestIngestOptions(r *http.Request) (ingestOptions, error) {
+	opts := defaultIngestOptions()
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" {
+		opts.format = format
+	}
+	if err := validateIngestFormat(opts.format); err != nil {
+		return ingestOptions{}, err
+	}
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := loadLocation(tz)
+		if err != nil {
+			return ingestOptions{}, err
+		}
+		opts.loc = loc
+	}
+	return opts, nil
+}
+
+// processEvent parses one raw line according to opts. Like processLine it
+// returns nil for lines that are filtered out. The event carries opts.origin.
+func processEvent(line string, opts ingestOptions) (logEvent, error) {
+	format := opts.format
+	if format == ingestFormatError || (format == ingestFormatAuto && isErrorLogLine(line)) {
+		entry, err := parseErrorLogInZone(line, opts.loc)
+		if err != nil {
+			return nil, err
+		}
+		entry.eventOrigin = opts.origin
+		return entry, nil
+	}
+
+	var entry *LogEntry
+	var err error
+	if format == ingestFormatSingbox || (format == ingestFormatAuto && isSingboxLine(line)) {
+		entry, err = processSingboxLine(line, opts.loc, opts.origin)
+	} else {
+		entry, err = processLine(line, opts.loc)
+	}
+	if err != nil || entry == nil {
+		// Avoid wrapping a nil *LogEntry into a non-nil interface.
+		return nil, err
+	}
+	entry.eventOrigin = opts.origin
+	return entry, nil
+}
+
+// knownLabelField reports whether any event type exposes field as a label.
+func knownLabelField(field string) bool {
+	for _, event := range []logEvent{&LogEntry{}, &ErrorLogEntry{}, &ConnectionEntry{}} {
+		if _, ok := event.labelValue(field); ok {
+			return true
+		}
+	}
+	return false
+}
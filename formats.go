@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var LOG_FORMATS_PATH = getEnv("LOG_FORMATS_PATH", "/etc/xray-loki-proxy/log-formats.json")
+
+// LogFormatConfig is one user-defined access line format. Exactly one of
+// Regex and Grok is set; either is matched against the whole line and its
+// named groups map onto LogEntry fields (see formatGroupNames).
+type LogFormatConfig struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex,omitempty"`
+	Grok  string `json:"grok,omitempty"`
+	// TimeLayout is a Go time layout for the datetime group; empty means
+	// the Xray layouts.
+	TimeLayout string `json:"time_layout,omitempty"`
+}
+
+type lineFormat struct {
+	name       string
+	re         *regexp.Regexp
+	timeLayout string
+}
+
+// customFormats are tried in order before the built-in Xray formats.
+var customFormats []lineFormat
+
+// formatGroupNames are the group names a format may capture. from and to
+// take Xray's "[proto:]host:port" notation; the split variants are joined
+// into it, and inbound_tag/outbound_tag into a route.
+var formatGroupNames = map[string]bool{
+	"datetime": true, "status": true, "email": true, "reason": true,
+	"from": true, "from_ip": true, "from_port": true,
+	"to": true, "dest_proto": true, "dest_host": true, "dest_port": true,
+	"route": true, "inbound_tag": true, "outbound_tag": true,
+}
+
+// grokPatterns are the %{NAME} patterns available in grok formats.
+var grokPatterns = map[string]string{
+	"WORD":              `\w+`,
+	"NOTSPACE":          `\S+`,
+	"SPACE":             `\s*`,
+	"DATA":              `.*?`,
+	"GREEDYDATA":        `.*`,
+	"INT":               `[+-]?\d+`,
+	"POSINT":            `\d+`,
+	"IP":                `[0-9A-Fa-f:.]+`,
+	"HOSTNAME":          `[0-9A-Za-z][0-9A-Za-z._-]*`,
+	"HOSTPORT":          `\S+:\d+`,
+	"XRAYTIME":          `\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?`,
+	"TIMESTAMP_ISO8601": `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?`,
+}
+
+var grokReference = regexp.MustCompile(`%\{(\w+)(?::(\w+))?\}`)
+
+func loadLogFormats() error {
+	data, err := os.ReadFile(LOG_FORMATS_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logDebug("Log formats file not found at %s, using built-in formats only", LOG_FORMATS_PATH)
+			return nil
+		}
+		return fmt.Errorf("error reading log formats file: %v", err)
+	}
+
+	var configs []LogFormatConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("error parsing log formats: %v", err)
+	}
+	formats, err := compileLogFormats(configs)
+	if err != nil {
+		return err
+	}
+	customFormats = formats
+
+	logInfo("Loaded %d log formats from %s", len(formats), LOG_FORMATS_PATH)
+	return nil
+}
+
+func compileLogFormats(configs []LogFormatConfig) ([]lineFormat, error) {
+	formats := make([]lineFormat, 0, len(configs))
+	seen := make(map[string]bool, len(configs))
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("log format #%d: missing name", i+1)
+		}
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("log format %s: duplicate name", cfg.Name)
+		}
+		seen[cfg.Name] = true
+
+		format, err := compileLogFormat(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("log format %s: %w", cfg.Name, err)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
+
+func compileLogFormat(cfg LogFormatConfig) (lineFormat, error) {
+	pattern := cfg.Regex
+	switch {
+	case cfg.Regex != "" && cfg.Grok != "":
+		return lineFormat{}, fmt.Errorf("set regex or grok, not both")
+	case cfg.Grok != "":
+		var err error
+		if pattern, err = expandGrok(cfg.Grok); err != nil {
+			return lineFormat{}, err
+		}
+	case cfg.Regex == "":
+		return lineFormat{}, fmt.Errorf("missing regex or grok")
+	}
+
+	re, err := regexp.Compile(`^(?:` + pattern + `)$`)
+	if err != nil {
+		return lineFormat{}, err
+	}
+
+	groups := make(map[string]bool)
+	for _, name := range re.SubexpNames()[1:] {
+		if name == "" {
+			continue
+		}
+		if !formatGroupNames[name] {
+			return lineFormat{}, fmt.Errorf("unsupported group %q", name)
+		}
+		groups[name] = true
+	}
+	switch {
+	case !groups["datetime"]:
+		return lineFormat{}, fmt.Errorf("missing datetime group")
+	case !groups["from"] && !groups["from_ip"]:
+		return lineFormat{}, fmt.Errorf("missing from or from_ip group")
+	case !groups["to"] && !groups["dest_host"] && !groups["reason"]:
+		return lineFormat{}, fmt.Errorf("missing to, dest_host or reason group")
+	}
+
+	return lineFormat{name: cfg.Name, re: re, timeLayout: cfg.TimeLayout}, nil
+}
+
+// expandGrok turns %{PATTERN:name} into a named group and %{PATTERN} into a
+// plain one; everything else is regex syntax.
+func expandGrok(grok string) (string, error) {
+	var unknown string
+	expanded := grokReference.ReplaceAllStringFunc(grok, func(ref string) string {
+		m := grokReference.FindStringSubmatch(ref)
+		pattern, ok := grokPatterns[m[1]]
+		if !ok {
+			if unknown == "" {
+				unknown = m[1]
+			}
+			return ref
+		}
+		if m[2] == "" {
+			return `(?:` + pattern + `)`
+		}
+		return `(?P<` + m[2] + `>` + pattern + `)`
+	})
+	if unknown != "" {
+		return "", fmt.Errorf("unknown grok pattern %q", unknown)
+	}
+	return expanded, nil
+}
+
+// matchCustomFormat returns the fields of the first user-defined format that
+// matches the line, or a nil format.
+func matchCustomFormat(logLine string) (lineFields, *lineFormat) {
+	for i := range customFormats {
+		format := &customFormats[i]
+		match := format.re.FindStringSubmatch(logLine)
+		if match == nil {
+			continue
+		}
+
+		groups := make(map[string]string, len(match))
+		for i, name := range format.re.SubexpNames() {
+			if i > 0 && name != "" && match[i] != "" {
+				groups[name] = match[i]
+			}
+		}
+		composeFormatGroups(groups)
+		return fieldsFromGroups(groups), format
+	}
+	return lineFields{}, nil
+}
+
+func fieldsFromGroups(groups map[string]string) lineFields {
+	return lineFields{
+		datetime: groups["datetime"],
+		from:     groups["from"],
+		status:   groups["status"],
+		to:       groups["to"],
+		route:    groups["route"],
+		email:    groups["email"],
+		reason:   groups["reason"],
+	}
+}
+
+// composeFormatGroups fills from, to and route from their split variants so
+// the rest of parsing sees Xray's notation.
+func composeFormatGroups(groups map[string]string) {
+	if groups["from"] == "" && groups["from_ip"] != "" {
+		port := groups["from_port"]
+		if port == "" {
+			port = "0"
+		}
+		groups["from"] = net.JoinHostPort(groups["from_ip"], port)
+	}
+	if groups["to"] == "" && groups["dest_host"] != "" {
+		port := groups["dest_port"]
+		if port == "" {
+			port = "0"
+		}
+		to := net.JoinHostPort(groups["dest_host"], port)
+		if proto := strings.ToLower(groups["dest_proto"]); proto != "" {
+			to = proto + ":" + to
+		}
+		groups["to"] = to
+	}
+	if groups["route"] == "" && groups["inbound_tag"] != "" {
+		groups["route"] = groups["inbound_tag"]
+		if groups["outbound_tag"] != "" {
+			groups["route"] += " >> " + groups["outbound_tag"]
+		}
+	}
+	if groups["status"] == "" {
+		groups["status"] = "accepted"
+		if groups["reason"] != "" {
+			groups["status"] = "rejected"
+		}
+	}
+}
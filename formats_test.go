@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withLogFormats(t *testing.T, configs []LogFormatConfig) {
+	t.Helper()
+	prev := customFormats
+	t.Cleanup(func() { customFormats = prev })
+
+	formats, err := compileLogFormats(configs)
+	if err != nil {
+		t.Fatalf("compileLogFormats() error = %v", err)
+	}
+	customFormats = formats
+}
+
+func TestCompileLogFormats_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []LogFormatConfig
+	}{
+		{name: "missing name", configs: []LogFormatConfig{{Regex: `(?P<datetime>\S+) (?P<from>\S+) (?P<to>\S+)`}}},
+		{name: "duplicate name", configs: []LogFormatConfig{
+			{Name: "a", Regex: `(?P<datetime>\S+) (?P<from>\S+) (?P<to>\S+)`},
+			{Name: "a", Regex: `(?P<datetime>\S+) (?P<from>\S+) (?P<to>\S+)`},
+		}},
+		{name: "regex and grok", configs: []LogFormatConfig{{Name: "a", Regex: `x`, Grok: `x`}}},
+		{name: "neither regex nor grok", configs: []LogFormatConfig{{Name: "a"}}},
+		{name: "bad regex", configs: []LogFormatConfig{{Name: "a", Regex: `(?P<datetime>`}}},
+		{name: "unknown group", configs: []LogFormatConfig{{Name: "a", Regex: `(?P<datetime>\S+) (?P<from>\S+) (?P<to>\S+) (?P<user>\S+)`}}},
+		{name: "missing datetime", configs: []LogFormatConfig{{Name: "a", Regex: `(?P<from>\S+) (?P<to>\S+)`}}},
+		{name: "missing source", configs: []LogFormatConfig{{Name: "a", Regex: `(?P<datetime>\S+) (?P<to>\S+)`}}},
+		{name: "missing destination", configs: []LogFormatConfig{{Name: "a", Regex: `(?P<datetime>\S+) (?P<from>\S+)`}}},
+		{name: "unknown grok pattern", configs: []LogFormatConfig{{Name: "a", Grok: `%{XRAYTIME:datetime} %{NOPE:from} %{HOSTPORT:to}`}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := compileLogFormats(tt.configs); err == nil {
+				t.Fatal("compileLogFormats() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestParseLog_CustomFormats(t *testing.T) {
+	withLogFormats(t, []LogFormatConfig{
+		{
+			// A fork that prints "user=" and "via" instead of Xray's layout.
+			Name: "fork-a",
+			Regex: `(?P<datetime>\S+ \S+) conn (?P<from>\S+) -> (?P<to>\S+) via (?P<outbound_tag>\S+) ` +
+				`from (?P<inbound_tag>\S+) user=(?P<email>\S+)`,
+		},
+		{
+			Name:       "fork-b",
+			Grok:       `%{TIMESTAMP_ISO8601:datetime} %{WORD:dest_proto} %{IP:from_ip}:%{POSINT:from_port} > %{HOSTNAME:dest_host}:%{POSINT:dest_port}`,
+			TimeLayout: "2006-01-02T15:04:05Z07:00",
+		},
+	})
+
+	tests := []struct {
+		name string
+		line string
+		want LogEntry
+	}{
+		{
+			name: "regex format with split route tags",
+			line: `2026/03/11 14:22:07.918304 conn 203.0.113.47:4821 -> tcp:alpha.example:443 via DIRECT from IN_A user=1204`,
+			want: LogEntry{
+				Datetime:    "2026-03-11 14:22:07.918304",
+				Email:       "1204",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "IN_A - DIRECT",
+				InboundTag:  "IN_A",
+				OutboundTag: "DIRECT",
+				Format:      "fork-a",
+			},
+		},
+		{
+			name: "grok format with split endpoints and own time layout",
+			line: `2026-03-11T16:22:07+02:00 UDP 203.0.113.47:4822 > alpha.example:53`,
+			want: LogEntry{
+				Datetime:  "2026-03-11 14:22:07.000000",
+				FromIP:    "203.0.113.47",
+				FromPort:  4822,
+				DestProto: "udp",
+				DestHost:  "alpha.example",
+				DestPort:  53,
+				Status:    "accepted",
+				Format:    "fork-b",
+			},
+		},
+		{
+			name: "built-in Xray format still applies after custom formats",
+			line: `2026/03/11 14:22:07.918304 from 203.0.113.47:4821 accepted tcp:alpha.example:443 [IN_A >> DIRECT] email: 1204`,
+			want: LogEntry{
+				Datetime:    "2026-03-11 14:22:07.918304",
+				Email:       "1204",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "IN_A - DIRECT",
+				InboundTag:  "IN_A",
+				OutboundTag: "DIRECT",
+				Format:      "xray",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertParseLog(t, tt.line, tt.want)
+		})
+	}
+}
+
+func TestParseLog_CustomFormatOrder(t *testing.T) {
+	withLogFormats(t, []LogFormatConfig{
+		{Name: "first", Regex: `(?P<datetime>\S+ \S+) (?P<from>\S+) (?P<to>\S+)`},
+		{Name: "second", Regex: `(?P<datetime>\S+ \S+) (?P<from>\S+) (?P<to>\S+)`},
+	})
+
+	got, err := parseLog(`2026/03/11 14:22:07.918304 203.0.113.47:4821 alpha.example:443`)
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	if got.Format != "first" {
+		t.Fatalf("Format = %q, want first", got.Format)
+	}
+
+	raw, _ := json.Marshal(got)
+	var fields map[string]any
+	json.Unmarshal(raw, &fields)
+	if fields["format"] != "first" {
+		t.Fatalf("JSON format = %v, want first", fields["format"])
+	}
+}
+
+func TestParseLog_CustomFormatFailureFallsThrough(t *testing.T) {
+	// The format matches Xray lines too, but expects ISO 8601 timestamps.
+	withLogFormats(t, []LogFormatConfig{
+		{Name: "iso", Regex: `(?P<datetime>\S+ \S+) from (?P<from>\S+) accepted (?P<to>\S+)`, TimeLayout: time.RFC3339},
+	})
+
+	got, err := parseLog(formatTestAccessLine(1))
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	if got.Format != "xray" || got.Email != "1" {
+		t.Fatalf("parseLog() = %+v, want the built-in parse", got)
+	}
+
+	// Without a built-in parse the format's error is kept.
+	_, err = parseLog(`2026/03/11 14:22:07 from 203.0.113.47:4821 accepted nowhere`)
+	if !errors.Is(err, errBadTimestamp) || !strings.Contains(err.Error(), "format iso") {
+		t.Fatalf("parseLog() error = %v, want the iso format's bad timestamp", err)
+	}
+}
+
+func TestLoadLogFormats(t *testing.T) {
+	prevPath, prevFormats := LOG_FORMATS_PATH, customFormats
+	t.Cleanup(func() { LOG_FORMATS_PATH, customFormats = prevPath, prevFormats })
+
+	dir := t.TempDir()
+	LOG_FORMATS_PATH = filepath.Join(dir, "missing.json")
+	if err := loadLogFormats(); err != nil {
+		t.Fatalf("missing file: loadLogFormats() error = %v", err)
+	}
+
+	LOG_FORMATS_PATH = filepath.Join(dir, "formats.json")
+	os.WriteFile(LOG_FORMATS_PATH, []byte(`[{"name": "v2fly", "grok": "%{XRAYTIME:datetime} %{HOSTPORT:from} %{WORD:status} %{NOTSPACE:to}"}]`), 0644)
+	if err := loadLogFormats(); err != nil {
+		t.Fatalf("loadLogFormats() error = %v", err)
+	}
+	if len(customFormats) != 1 || customFormats[0].name != "v2fly" {
+		t.Fatalf("customFormats = %+v", customFormats)
+	}
+
+	os.WriteFile(LOG_FORMATS_PATH, []byte(`[{"name": "broken"}]`), 0644)
+	if err := loadLogFormats(); err == nil {
+		t.Fatal("loadLogFormats() error = nil for an invalid format")
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var XRAY_GEOSITE_PATH = getEnv("XRAY_GEOSITE_PATH", "")
+var XRAY_GEOIP_PATH = getEnv("XRAY_GEOIP_PATH", "")
+var XRAY_GEO_CATEGORIES = getEnv("XRAY_GEO_CATEGORIES", "")
+
+// XRAY_LOCATION_ASSET is where skip rules find geosite.dat, geoip.dat and
+// ext: files unless XRAY_GEOSITE_PATH or XRAY_GEOIP_PATH say otherwise; the
+// name and default are Xray's own.
+var XRAY_LOCATION_ASSET = getEnv("XRAY_LOCATION_ASSET", "/usr/local/share/xray")
+
+const (
+	// xrayGeoPollInterval is how often the .dat files are checked for changes.
+	xrayGeoPollInterval = 30 * time.Second
+	// xrayGeoCacheSize bounds the per-host category cache, which is cleared
+	// when full.
+	xrayGeoCacheSize = 1 << 16
+)
+
+// Domain types of Xray's routercommon.Domain.
+const (
+	geositePlain  = 0 // keyword anywhere in the host
+	geositeRegex  = 1
+	geositeDomain = 2 // the domain and its subdomains
+	geositeFull   = 3
+)
+
+// xrayGeo holds the loaded geosite.dat and geoip.dat; nil when neither is
+// configured. It is swapped whole on reload.
+var xrayGeo atomic.Pointer[xrayGeoData]
+
+type xrayGeoData struct {
+	sites *geositeIndex
+	ips   *geoipIndex
+
+	mu    sync.Mutex
+	cache map[string][]string
+}
+
+// geositeIndex answers which geosite categories a host belongs to, with the
+// rules of each Xray domain type indexed for that.
+type geositeIndex struct {
+	names   []string // "geosite:google", indexed by geositeRef.category
+	full    map[string][]geositeRef
+	domain  map[string][]geositeRef
+	keyword []geositeKeyword
+	regex   []geositeRegexp
+}
+
+// geositeRef is one rule's category and the attributes (such as "cn" or
+// "ads") it carries.
+type geositeRef struct {
+	category int
+	attrs    []string
+}
+
+type geositeKeyword struct {
+	value string
+	ref   geositeRef
+}
+
+type geositeRegexp struct {
+	re  *regexp.Regexp
+	ref geositeRef
+}
+
+// geoipIndex holds the merged, sorted address ranges of each geoip category.
+type geoipIndex struct {
+	names   []string // "geoip:ru"
+	ranges  [][]addrRange
+	reverse []bool // reverse_match: the category is everything not listed
+}
+
+type addrRange struct {
+	first, last netip.Addr
+}
+
+// loadXrayGeo reads XRAY_GEOSITE_PATH and XRAY_GEOIP_PATH.
+func loadXrayGeo() error {
+	if XRAY_GEOSITE_PATH == "" && XRAY_GEOIP_PATH == "" {
+		return nil
+	}
+	filter, err := parseGeoCategoryFilter(XRAY_GEO_CATEGORIES)
+	if err != nil {
+		return fmt.Errorf("XRAY_GEO_CATEGORIES: %w", err)
+	}
+
+	data := &xrayGeoData{cache: make(map[string][]string)}
+	if XRAY_GEOSITE_PATH != "" {
+		raw, err := os.ReadFile(XRAY_GEOSITE_PATH)
+		if err != nil {
+			return fmt.Errorf("geosite: %w", err)
+		}
+		if data.sites, err = parseGeosite(raw, filter); err != nil {
+			return fmt.Errorf("geosite %s: %w", XRAY_GEOSITE_PATH, err)
+		}
+		logInfo("Loaded %d geosite categories from %s", len(data.sites.names), XRAY_GEOSITE_PATH)
+	}
+	if XRAY_GEOIP_PATH != "" {
+		raw, err := os.ReadFile(XRAY_GEOIP_PATH)
+		if err != nil {
+			return fmt.Errorf("geoip: %w", err)
+		}
+		if data.ips, err = parseGeoIPDat(raw, filter); err != nil {
+			return fmt.Errorf("geoip %s: %w", XRAY_GEOIP_PATH, err)
+		}
+		logInfo("Loaded %d geoip categories from %s", len(data.ips.names), XRAY_GEOIP_PATH)
+	}
+	xrayGeo.Store(data)
+	return nil
+}
+
+// parseGeoCategoryFilter parses a list such as "geosite:google,geoip:ru"
+// into a set; nil means every category.
+func parseGeoCategoryFilter(list string) (map[string]bool, error) {
+	names := splitList(list)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	filter := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "geosite:") && !strings.HasPrefix(name, "geoip:") {
+			return nil, fmt.Errorf("%q is not geosite:<name> or geoip:<name>", name)
+		}
+		filter[name] = true
+	}
+	return filter, nil
+}
+
+// watchXrayGeo reloads the .dat files whenever one of them changes: the
+// dest_categories data and, separately, the files used by skip rule
+// patterns. Files that fail to load keep the previous data.
+func watchXrayGeo() {
+	enrich := XRAY_GEOSITE_PATH != "" || XRAY_GEOIP_PATH != ""
+	last := [2]fileVersion{statFile(XRAY_GEOSITE_PATH), statFile(XRAY_GEOIP_PATH)}
+	skipSeen := skipPatterns.Load().loadedFiles()
+	for range time.Tick(xrayGeoPollInterval) {
+		current := [2]fileVersion{statFile(XRAY_GEOSITE_PATH), statFile(XRAY_GEOIP_PATH)}
+		if enrich && (current[0].changed(last[0]) || current[1].changed(last[1])) {
+			last = current
+			if err := loadXrayGeo(); err != nil {
+				logError("Keeping previous geosite/geoip data: %v", err)
+			}
+		}
+
+		var changed bool
+		if skipSeen, changed = skipPatterns.Load().changedFiles(skipSeen); changed {
+			reloadSkipPatterns()
+		}
+	}
+}
+
+func startXrayGeoWatcher() {
+	if XRAY_GEOSITE_PATH != "" || XRAY_GEOIP_PATH != "" || len(skipPatterns.Load().loadedFiles()) > 0 {
+		go watchXrayGeo()
+	}
+}
+
+// categories returns the sorted geosite categories of a domain host or the
+// geoip categories of an IP host.
+func (d *xrayGeoData) categories(host string) []string {
+	if d == nil || host == "" {
+		return nil
+	}
+	host = strings.ToLower(host)
+
+	d.mu.Lock()
+	cached, ok := d.cache[host]
+	d.mu.Unlock()
+	if ok {
+		return cached
+	}
+
+	var names []string
+	if addr, err := netip.ParseAddr(host); err == nil {
+		d.ips.match(addr.Unmap(), func(category int) {
+			names = append(names, d.ips.names[category])
+		})
+	} else {
+		d.sites.match(host, func(ref geositeRef) {
+			names = append(names, d.sites.names[ref.category])
+		})
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	d.mu.Lock()
+	if len(d.cache) >= xrayGeoCacheSize {
+		clear(d.cache)
+	}
+	d.cache[host] = names
+	d.mu.Unlock()
+	return names
+}
+
+// match calls fn for every rule that matches host, which must be lower case.
+func (ix *geositeIndex) match(host string, fn func(geositeRef)) {
+	if ix == nil {
+		return
+	}
+	for _, ref := range ix.full[host] {
+		fn(ref)
+	}
+	for suffix := host; ; {
+		for _, ref := range ix.domain[suffix] {
+			fn(ref)
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 {
+			break
+		}
+		suffix = suffix[dot+1:]
+	}
+	for _, k := range ix.keyword {
+		if strings.Contains(host, k.value) {
+			fn(k.ref)
+		}
+	}
+	for _, r := range ix.regex {
+		if r.re.MatchString(host) {
+			fn(r.ref)
+		}
+	}
+}
+
+// match calls fn for every category that contains addr.
+func (ix *geoipIndex) match(addr netip.Addr, fn func(category int)) {
+	if ix == nil {
+		return
+	}
+	for category := range ix.ranges {
+		if ix.contains(category, addr) {
+			fn(category)
+		}
+	}
+}
+
+// contains reports whether category covers addr.
+func (ix *geoipIndex) contains(category int, addr netip.Addr) bool {
+	ranges := ix.ranges[category]
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].first.Compare(addr) > 0 })
+	found := i > 0 && ranges[i-1].last.Compare(addr) >= 0
+	return found != ix.reverse[category]
+}
+
+// parseGeosite decodes Xray's geosite.dat (routercommon.GeoSiteList). Only
+// categories in filter are kept, unless filter is nil.
+func parseGeosite(raw []byte, filter map[string]bool) (*geositeIndex, error) {
+	ix := &geositeIndex{
+		full:   make(map[string][]geositeRef),
+		domain: make(map[string][]geositeRef),
+	}
+	err := walkProtoFields(raw, func(num protowire.Number, typ protowire.Type, site []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var name string
+		var domains [][]byte
+		err := walkProtoFields(site, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				name = "geosite:" + strings.ToLower(string(value))
+			case num == 2 && typ == protowire.BytesType:
+				domains = append(domains, value)
+			}
+			return nil
+		})
+		if err != nil || (filter != nil && !filter[name]) {
+			return err
+		}
+
+		category := len(ix.names)
+		ix.names = append(ix.names, name)
+		for _, domain := range domains {
+			if err := ix.addDomain(domain, category); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		return nil
+	})
+	return ix, err
+}
+
+// addDomain adds one routercommon.Domain rule.
+func (ix *geositeIndex) addDomain(raw []byte, category int) error {
+	var kind uint64
+	var value string
+	ref := geositeRef{category: category}
+	err := walkProtoFields(raw, func(num protowire.Number, typ protowire.Type, field []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			kind, _ = protowire.ConsumeVarint(field)
+		case num == 2 && typ == protowire.BytesType:
+			value = string(field)
+		case num == 3 && typ == protowire.BytesType:
+			// Attribute: the key is all Xray's @attr selector looks at.
+			return walkProtoFields(field, func(num protowire.Number, typ protowire.Type, key []byte) error {
+				if num == 1 && typ == protowire.BytesType {
+					ref.attrs = append(ref.attrs, strings.ToLower(string(key)))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Hosts are matched in lower case. A regexp keeps its source, since
+	// lowercasing would turn escapes such as \D or \W into their opposites,
+	// and ignores case instead.
+	if kind != geositeRegex {
+		value = strings.ToLower(value)
+	}
+	switch kind {
+	case geositePlain:
+		ix.keyword = append(ix.keyword, geositeKeyword{value: value, ref: ref})
+	case geositeRegex:
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return err
+		}
+		ix.regex = append(ix.regex, geositeRegexp{re: re, ref: ref})
+	case geositeDomain:
+		ix.domain[value] = append(ix.domain[value], ref)
+	case geositeFull:
+		ix.full[value] = append(ix.full[value], ref)
+	default:
+		return fmt.Errorf("unknown domain type %d", kind)
+	}
+	return nil
+}
+
+// parseGeoIPDat decodes Xray's geoip.dat (routercommon.GeoIPList). Only
+// categories in filter are kept, unless filter is nil.
+func parseGeoIPDat(raw []byte, filter map[string]bool) (*geoipIndex, error) {
+	ix := &geoipIndex{}
+	err := walkProtoFields(raw, func(num protowire.Number, typ protowire.Type, entry []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var name string
+		var reverse bool
+		var ranges []addrRange
+		err := walkProtoFields(entry, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			switch {
+			case num == 1 && typ == protowire.BytesType:
+				name = "geoip:" + strings.ToLower(string(value))
+			case num == 2 && typ == protowire.BytesType:
+				r, err := parseGeoIPCIDR(value)
+				if err != nil {
+					return err
+				}
+				ranges = append(ranges, r)
+			case num == 3 && typ == protowire.VarintType:
+				v, _ := protowire.ConsumeVarint(value)
+				reverse = v != 0
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if filter != nil && !filter[name] {
+			return nil
+		}
+
+		ix.names = append(ix.names, name)
+		ix.ranges = append(ix.ranges, mergeAddrRanges(ranges))
+		ix.reverse = append(ix.reverse, reverse)
+		return nil
+	})
+	return ix, err
+}
+
+// parseGeoIPCIDR decodes a routercommon.CIDR into the range it covers.
+func parseGeoIPCIDR(raw []byte) (addrRange, error) {
+	var ip []byte
+	var bits uint64
+	err := walkProtoFields(raw, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			ip = value
+		case num == 2 && typ == protowire.VarintType:
+			bits, _ = protowire.ConsumeVarint(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return addrRange{}, err
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return addrRange{}, fmt.Errorf("bad CIDR address %x", ip)
+	}
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	prefix, err := addr.Prefix(int(min(bits, 129)))
+	if err != nil {
+		return addrRange{}, fmt.Errorf("bad CIDR %s/%d", addr, bits)
+	}
+	return addrRange{first: prefix.Addr(), last: prefixLast(prefix)}, nil
+}
+
+// prefixLast returns the last address of a masked prefix.
+func prefixLast(p netip.Prefix) netip.Addr {
+	b := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return last
+}
+
+// mergeAddrRanges sorts ranges and joins those that overlap or touch.
+func mergeAddrRanges(ranges []addrRange) []addrRange {
+	slices.SortFunc(ranges, func(a, b addrRange) int {
+		return cmp.Or(a.first.Compare(b.first), a.last.Compare(b.last))
+	})
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if r.first.Compare(prev.last) <= 0 || r.first == prev.last.Next() {
+				if r.last.Compare(prev.last) > 0 {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return slices.Clip(merged)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testGeoDomain struct {
+	kind  uint64
+	value string
+	attrs []string
+}
+
+// encodeGeosite builds a geosite.dat (routercommon.GeoSiteList).
+func encodeGeosite(sites map[string][]testGeoDomain) []byte {
+	var list []byte
+	for code, domains := range sites {
+		var site []byte
+		site = protowire.AppendTag(site, 1, protowire.BytesType)
+		site = protowire.AppendString(site, code)
+		for _, d := range domains {
+			var domain []byte
+			domain = protowire.AppendTag(domain, 1, protowire.VarintType)
+			domain = protowire.AppendVarint(domain, d.kind)
+			domain = protowire.AppendTag(domain, 2, protowire.BytesType)
+			domain = protowire.AppendString(domain, d.value)
+			for _, key := range d.attrs {
+				var attr []byte
+				attr = protowire.AppendTag(attr, 1, protowire.BytesType)
+				attr = protowire.AppendString(attr, key)
+				attr = protowire.AppendTag(attr, 2, protowire.VarintType)
+				attr = protowire.AppendVarint(attr, 1)
+				domain = protowire.AppendTag(domain, 3, protowire.BytesType)
+				domain = protowire.AppendBytes(domain, attr)
+			}
+			site = protowire.AppendTag(site, 2, protowire.BytesType)
+			site = protowire.AppendBytes(site, domain)
+		}
+		list = protowire.AppendTag(list, 1, protowire.BytesType)
+		list = protowire.AppendBytes(list, site)
+	}
+	return list
+}
+
+type testGeoIP struct {
+	cidrs   []string
+	reverse bool
+}
+
+// encodeGeoIPDat builds a geoip.dat (routercommon.GeoIPList). IPv4 CIDRs are
+// stored as 4-byte addresses, like Xray's own files.
+func encodeGeoIPDat(t *testing.T, entries map[string]testGeoIP) []byte {
+	t.Helper()
+	var list []byte
+	for code, e := range entries {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, code)
+		for _, cidr := range e.cidrs {
+			prefix := netip.MustParsePrefix(cidr)
+			var c []byte
+			c = protowire.AppendTag(c, 1, protowire.BytesType)
+			c = protowire.AppendBytes(c, prefix.Addr().AsSlice())
+			c = protowire.AppendTag(c, 2, protowire.VarintType)
+			c = protowire.AppendVarint(c, uint64(prefix.Bits()))
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, c)
+		}
+		if e.reverse {
+			entry = protowire.AppendTag(entry, 3, protowire.VarintType)
+			entry = protowire.AppendVarint(entry, 1)
+		}
+		list = protowire.AppendTag(list, 1, protowire.BytesType)
+		list = protowire.AppendBytes(list, entry)
+	}
+	return list
+}
+
+var testGeositeData = map[string][]testGeoDomain{
+	"GOOGLE": {
+		{kind: geositeDomain, value: "google.com"},
+		{kind: geositeFull, value: "www.gstatic.com"},
+		{kind: geositeDomain, value: "google.cn", attrs: []string{"cn"}},
+	},
+	"CATEGORY-ADS": {
+		{kind: geositePlain, value: "doubleclick"},
+		{kind: geositeRegex, value: `^ads?\d*\.`},
+	},
+	"CATEGORY-CDN": {
+		{kind: geositeRegex, value: `^CDN-\D+\.`},
+	},
+}
+
+var testGeoIPData = map[string]testGeoIP{
+	"RU":      {cidrs: []string{"203.0.113.0/25", "203.0.113.128/25", "2001:db8:1::/48"}},
+	"PRIVATE": {cidrs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+	"NOT-RU":  {cidrs: []string{"203.0.113.0/24"}, reverse: true},
+}
+
+// withXrayGeo writes test geosite.dat and geoip.dat files and loads them.
+func withXrayGeo(t *testing.T, categories string) (sitePath, ipPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	sitePath, ipPath = dir+"/geosite.dat", dir+"/geoip.dat"
+	os.WriteFile(sitePath, encodeGeosite(testGeositeData), 0o644)
+	os.WriteFile(ipPath, encodeGeoIPDat(t, testGeoIPData), 0o644)
+
+	prevSite, prevIP, prevCategories, prevData := XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH, XRAY_GEO_CATEGORIES, xrayGeo.Load()
+	t.Cleanup(func() {
+		XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH, XRAY_GEO_CATEGORIES = prevSite, prevIP, prevCategories
+		xrayGeo.Store(prevData)
+	})
+	XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH, XRAY_GEO_CATEGORIES = sitePath, ipPath, categories
+	if err := loadXrayGeo(); err != nil {
+		t.Fatalf("loadXrayGeo() error = %v", err)
+	}
+	return sitePath, ipPath
+}
+
+func TestXrayGeo_Categories(t *testing.T) {
+	withXrayGeo(t, "")
+
+	tests := []struct {
+		host string
+		want []string
+	}{
+		{host: "google.com", want: []string{"geosite:google"}},
+		{host: "mail.Google.com", want: []string{"geosite:google"}},
+		{host: "notgoogle.com", want: nil},
+		{host: "www.gstatic.com", want: []string{"geosite:google"}},
+		{host: "fonts.gstatic.com", want: nil},
+		{host: "maps.google.cn", want: []string{"geosite:google"}},
+		{host: "ad.doubleclick.net", want: []string{"geosite:category-ads"}},
+		{host: "ads3.example.com", want: []string{"geosite:category-ads"}},
+		{host: "cdn-eu.example.net", want: []string{"geosite:category-cdn"}},
+		{host: "cdn-42.example.net", want: nil},
+		{host: "203.0.113.10", want: []string{"geoip:ru"}},
+		{host: "203.0.113.200", want: []string{"geoip:ru"}},
+		{host: "2001:db8:1::5", want: []string{"geoip:not-ru", "geoip:ru"}},
+		{host: "10.1.2.3", want: []string{"geoip:not-ru", "geoip:private"}},
+		{host: "198.51.100.10", want: []string{"geoip:not-ru"}},
+	}
+	for _, tt := range tests {
+		if got := xrayGeo.Load().categories(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("categories(%s) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestXrayGeo_CategoryFilter(t *testing.T) {
+	withXrayGeo(t, "geosite:google,geoip:private")
+
+	if got := xrayGeo.Load().categories("ad.doubleclick.net"); got != nil {
+		t.Fatalf("categories() = %v for a category not loaded", got)
+	}
+	if got := xrayGeo.Load().categories("10.1.2.3"); !reflect.DeepEqual(got, []string{"geoip:private"}) {
+		t.Fatalf("categories() = %v", got)
+	}
+	if _, err := parseGeoCategoryFilter("google"); err == nil {
+		t.Fatal("parseGeoCategoryFilter() error = nil without a geosite:/geoip: prefix")
+	}
+}
+
+func TestXrayGeo_EntryField(t *testing.T) {
+	sitePath, _ := withXrayGeo(t, "")
+
+	line := strings.Replace(formatTestAccessLine(1), "tcp:198.51.100.10:443", "tcp:www.google.com:443", 1)
+	entry, err := parseLog(line)
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	if !reflect.DeepEqual(entry.DestCategories, []string{"geosite:google"}) {
+		t.Fatalf("DestCategories = %v", entry.DestCategories)
+	}
+
+	// A broken file fails the load and leaves the loaded data in place.
+	os.WriteFile(sitePath, []byte{0x0a, 0xff}, 0o644)
+	if err := loadXrayGeo(); err == nil {
+		t.Fatal("loadXrayGeo() error = nil for a truncated file")
+	}
+	if got := xrayGeo.Load().categories("google.com"); got == nil {
+		t.Fatal("categories lost after a failed reload")
+	}
+}
+
+func TestMergeAddrRanges(t *testing.T) {
+	r := func(first, last string) addrRange {
+		return addrRange{first: netip.MustParseAddr(first), last: netip.MustParseAddr(last)}
+	}
+	got := mergeAddrRanges([]addrRange{
+		r("10.0.1.0", "10.0.1.255"),
+		r("10.0.0.0", "10.0.0.255"),
+		r("10.0.0.128", "10.0.0.200"),
+		r("10.0.3.0", "10.0.3.255"),
+		r("2001:db8::", "2001:db8::ffff"),
+	})
+	want := []addrRange{
+		r("10.0.0.0", "10.0.1.255"),
+		r("10.0.3.0", "10.0.3.255"),
+		r("2001:db8::", "2001:db8::ffff"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeAddrRanges() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+var GEOIP_DATABASES = getEnv("GEOIP_DATABASES", "")
+
+// geoIPPollInterval is how often the GeoIP databases are checked for changes.
+const geoIPPollInterval = 30 * time.Second
+
+// GeoInfo is the location and network of one address, as far as the
+// configured databases know it.
+type GeoInfo struct {
+	// Country is the ISO 3166-1 alpha-2 code.
+	Country     string `json:"country,omitempty"`
+	CountryName string `json:"country_name,omitempty"`
+	City        string `json:"city,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+	ASOrg       string `json:"as_org,omitempty"`
+}
+
+// geoRecord covers the fields of the GeoLite2/GeoIP2 Country, City and ASN
+// databases used by GeoInfo.
+type geoRecord struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoIP enriches entries from GEOIP_DATABASES; nil when none are configured.
+var geoIP *geoIPDatabases
+
+// geoIPDatabases is the set of open .mmdb files. Every database is queried
+// and the first non-empty value of each field wins, so a City and an ASN
+// database complement each other.
+type geoIPDatabases struct {
+	// mu guards the readers: lookups hold it for reading, and a reload
+	// swaps a reader under the write lock before closing the old one.
+	mu  sync.RWMutex
+	dbs []*geoIPDatabase
+}
+
+type geoIPDatabase struct {
+	path    string
+	version fileVersion
+	reader  *maxminddb.Reader
+}
+
+// loadGeoIP opens GEOIP_DATABASES; called once from main.
+func loadGeoIP() error {
+	paths := splitList(GEOIP_DATABASES)
+	if len(paths) == 0 {
+		return nil
+	}
+	dbs, err := openGeoIPDatabases(paths)
+	if err != nil {
+		return err
+	}
+	geoIP = dbs
+	return nil
+}
+
+func openGeoIPDatabases(paths []string) (*geoIPDatabases, error) {
+	g := &geoIPDatabases{}
+	for _, path := range paths {
+		db := &geoIPDatabase{path: path}
+		if err := db.open(); err != nil {
+			g.Close()
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// open reads the database into memory rather than mapping it, so a file
+// rewritten in place cannot change under a reader in use.
+func (db *geoIPDatabase) open() error {
+	version := statFile(db.path)
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.OpenBytes(data)
+	if err != nil {
+		return fmt.Errorf("GeoIP database %s: %w", db.path, err)
+	}
+	db.reader, db.version = reader, version
+	logInfo("Loaded GeoIP database %s (%s, built %s)",
+		db.path, reader.Metadata.DatabaseType, reader.Metadata.BuildTime().Format(time.DateOnly))
+	return nil
+}
+
+// lookup returns what the databases know about host, or nil when host is
+// not an IP or is not in any database.
+func (g *geoIPDatabases) lookup(host string) *GeoInfo {
+	if g == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+
+	var info GeoInfo
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, db := range g.dbs {
+		var rec geoRecord
+		if err := db.reader.Lookup(addr).Decode(&rec); err != nil {
+			logDebug("GeoIP lookup %s in %s failed: %v", host, db.path, err)
+			continue
+		}
+		info.merge(rec)
+	}
+	if info == (GeoInfo{}) {
+		return nil
+	}
+	return &info
+}
+
+func (info *GeoInfo) merge(rec geoRecord) {
+	if info.Country == "" {
+		info.Country = rec.Country.ISOCode
+	}
+	if info.CountryName == "" {
+		info.CountryName = rec.Country.Names["en"]
+	}
+	if info.City == "" {
+		info.City = rec.City.Names["en"]
+	}
+	if info.ASN == 0 {
+		info.ASN = rec.ASN
+	}
+	if info.ASOrg == "" {
+		info.ASOrg = rec.ASOrg
+	}
+}
+
+// reload reopens the databases whose file changed since they were opened.
+// A file that fails to open keeps the previous version.
+func (g *geoIPDatabases) reload() {
+	for _, db := range g.dbs {
+		g.mu.RLock()
+		changed := statFile(db.path).changed(db.version)
+		g.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		next := &geoIPDatabase{path: db.path}
+		if err := next.open(); err != nil {
+			logError("Keeping previous GeoIP database: %v", err)
+			continue
+		}
+		g.mu.Lock()
+		prev := db.reader
+		db.reader, db.version = next.reader, next.version
+		g.mu.Unlock()
+		prev.Close()
+	}
+}
+
+// watch reloads changed databases every geoIPPollInterval.
+func (g *geoIPDatabases) watch() {
+	for range time.Tick(geoIPPollInterval) {
+		g.reload()
+	}
+}
+
+func (g *geoIPDatabases) Close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, db := range g.dbs {
+		db.reader.Close()
+	}
+}
+
+func startGeoIPWatcher() {
+	if geoIP != nil {
+		go geoIP.watch()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeTestMMDB writes a database of the given type mapping CIDRs to records.
+func writeTestMMDB(t *testing.T, path, dbType string, records map[string]mmdbtype.Map) {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: dbType, IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatalf("mmdbwriter.New: %v", err)
+	}
+	for cidr, record := range records {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%s): %v", cidr, err)
+		}
+		if err := tree.Insert(network, record); err != nil {
+			t.Fatalf("Insert(%s): %v", cidr, err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer f.Close()
+	if _, err := tree.WriteTo(f); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+}
+
+func cityRecord(code, country, city string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"country": mmdbtype.Map{"iso_code": mmdbtype.String(code), "names": mmdbtype.Map{"en": mmdbtype.String(country)}},
+		"city":    mmdbtype.Map{"names": mmdbtype.Map{"en": mmdbtype.String(city)}},
+	}
+}
+
+func asnRecord(asn uint32, org string) mmdbtype.Map {
+	return mmdbtype.Map{
+		"autonomous_system_number":       mmdbtype.Uint32(asn),
+		"autonomous_system_organization": mmdbtype.String(org),
+	}
+}
+
+// withGeoIP opens city and ASN test databases as the GeoIP enrichment.
+func withGeoIP(t *testing.T) (cityPath, asnPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	cityPath, asnPath = filepath.Join(dir, "city.mmdb"), filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, cityPath, "GeoLite2-City", map[string]mmdbtype.Map{
+		"203.0.113.0/24": cityRecord("DE", "Germany", "Berlin"),
+		"2001:db8::/32":  cityRecord("NL", "Netherlands", "Amsterdam"),
+	})
+	writeTestMMDB(t, asnPath, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"198.51.100.0/24": asnRecord(64500, "Example CDN"),
+		"203.0.113.0/24":  asnRecord(64501, "Example ISP"),
+	})
+
+	dbs, err := openGeoIPDatabases([]string{cityPath, asnPath})
+	if err != nil {
+		t.Fatalf("openGeoIPDatabases() error = %v", err)
+	}
+	prev := geoIP
+	t.Cleanup(func() {
+		geoIP = prev
+		dbs.Close()
+	})
+	geoIP = dbs
+	return cityPath, asnPath
+}
+
+func TestGeoIP_Lookup(t *testing.T) {
+	withGeoIP(t)
+
+	tests := []struct {
+		host string
+		want *GeoInfo
+	}{
+		{host: "203.0.113.50", want: &GeoInfo{Country: "DE", CountryName: "Germany", City: "Berlin", ASN: 64501, ASOrg: "Example ISP"}},
+		{host: "198.51.100.10", want: &GeoInfo{ASN: 64500, ASOrg: "Example CDN"}},
+		{host: "2001:db8::1", want: &GeoInfo{Country: "NL", CountryName: "Netherlands", City: "Amsterdam"}},
+		{host: "192.0.2.1", want: nil},
+		{host: "example.com", want: nil},
+	}
+	for _, tt := range tests {
+		if got := geoIP.lookup(tt.host); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%s) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGeoIP_EntryFields(t *testing.T) {
+	withGeoIP(t)
+
+	entry, err := parseLog(formatTestAccessLine(1))
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, want := range []string{
+		`"from_geo":{"country":"DE","country_name":"Germany","city":"Berlin","asn":64501,"as_org":"Example ISP"}`,
+		`"dest_geo":{"asn":64500,"as_org":"Example CDN"}`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Fatalf("entry %s missing %s", data, want)
+		}
+	}
+
+	// Without databases the fields are left out.
+	geoIP = nil
+	entry, _ = parseLog(formatTestAccessLine(1))
+	if data, _ := json.Marshal(entry); strings.Contains(string(data), "_geo") {
+		t.Fatalf("entry %s has GeoIP fields without databases", data)
+	}
+}
+
+func TestGeoIP_Reload(t *testing.T) {
+	_, asnPath := withGeoIP(t)
+
+	// A file that cannot be opened keeps the previous database.
+	os.WriteFile(asnPath, []byte("not a database"), 0o644)
+	geoIP.reload()
+	if got := geoIP.lookup("198.51.100.10"); got == nil || got.ASN != 64500 {
+		t.Fatalf("lookup() after a broken update = %+v", got)
+	}
+
+	writeTestMMDB(t, asnPath, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"198.51.100.0/24": asnRecord(64511, "Other CDN"),
+	})
+	geoIP.reload()
+	if got := geoIP.lookup("198.51.100.10"); got == nil || got.ASN != 64511 || got.ASOrg != "Other CDN" {
+		t.Fatalf("lookup() after reload = %+v", got)
+	}
+}
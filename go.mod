@@ -1,3 +1,21 @@
 module xray-loki-proxy
 
 go 1.25.0
+
+require (
+	github.com/golang/snappy v1.0.0
+	google.golang.org/protobuf v1.36.12
+)
+
+require github.com/klauspost/compress v1.20.1
+
+require (
+	github.com/maxmind/mmdbwriter v1.2.0
+	github.com/oschwald/maxminddb-golang/v2 v2.6.0
+	golang.org/x/net v0.58.0
+)
+
+require (
+	go4.org/netipx v0.0.0-20231129151722-fdeea329fbba // indirect
+	golang.org/x/sys v0.47.0 // indirect
+)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var PTR_HOSTS_PATH = getEnv("PTR_HOSTS_PATH", "/etc/xray-loki-proxy/ptr-hosts")
+
+// ptrHostsPollInterval is how often PTR_HOSTS_PATH is checked for changes.
+const ptrHostsPollInterval = 5 * time.Second
+
+// ptrHosts maps destination IPs and CIDRs to names that replace their PTR
+// names. The table in use is swapped atomically on reload.
+var ptrHosts atomic.Pointer[ptrHostsTable]
+
+// ptrHostsTable is one parsed hosts file. Exact addresses are looked up in
+// a map; prefixes are scanned longest first, so the most specific entry wins.
+type ptrHostsTable struct {
+	addrs    map[netip.Addr][]string
+	prefixes []ptrHostsPrefix
+}
+
+type ptrHostsPrefix struct {
+	prefix netip.Prefix
+	names  []string
+}
+
+// parsePTRHosts reads a hosts-style file: one IP or CIDR per line followed
+// by one or more names, with # starting a comment. Later lines for the same
+// address or prefix replace earlier ones.
+func parsePTRHosts(data []byte) (*ptrHostsTable, error) {
+	table := &ptrHostsTable{addrs: make(map[netip.Addr][]string)}
+	byPrefix := make(map[netip.Prefix][]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: %q has no names", n, fields[0])
+		}
+		names := normalizeToAddr(fields[1:])
+
+		if strings.Contains(fields[0], "/") {
+			prefix, err := netip.ParsePrefix(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			byPrefix[prefix.Masked()] = names
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		table.addrs[addr.Unmap()] = names
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for prefix, names := range byPrefix {
+		table.prefixes = append(table.prefixes, ptrHostsPrefix{prefix: prefix, names: names})
+	}
+	slices.SortFunc(table.prefixes, func(a, b ptrHostsPrefix) int {
+		return b.prefix.Bits() - a.prefix.Bits()
+	})
+	return table, nil
+}
+
+// lookup returns the names configured for ip, or nil.
+func (t *ptrHostsTable) lookup(ip net.IP) []string {
+	if t == nil {
+		return nil
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil
+	}
+	addr = addr.Unmap()
+	if names, ok := t.addrs[addr]; ok {
+		return names
+	}
+	for _, p := range t.prefixes {
+		if p.prefix.Contains(addr) {
+			return p.names
+		}
+	}
+	return nil
+}
+
+// Len returns the number of addresses and prefixes in the table.
+func (t *ptrHostsTable) Len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.addrs) + len(t.prefixes)
+}
+
+// loadPTRHosts reads PTR_HOSTS_PATH. A missing file means no overrides.
+func loadPTRHosts() error {
+	data, err := os.ReadFile(PTR_HOSTS_PATH)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logDebug("PTR hosts file not found at %s, using DNS only", PTR_HOSTS_PATH)
+			ptrHosts.Store(nil)
+			return nil
+		}
+		return fmt.Errorf("error reading PTR hosts file: %v", err)
+	}
+
+	table, err := parsePTRHosts(data)
+	if err != nil {
+		return fmt.Errorf("error parsing PTR hosts file %s: %v", PTR_HOSTS_PATH, err)
+	}
+	ptrHosts.Store(table)
+
+	logInfo("Loaded %d PTR host overrides from %s", table.Len(), PTR_HOSTS_PATH)
+	return nil
+}
+
+// watchPTRHosts reloads PTR_HOSTS_PATH whenever its modification time or
+// size changes. A file that fails to parse keeps the previous table.
+func watchPTRHosts() {
+	last := statFile(PTR_HOSTS_PATH)
+	for range time.Tick(ptrHostsPollInterval) {
+		current := statFile(PTR_HOSTS_PATH)
+		if !current.changed(last) {
+			continue
+		}
+		last = current
+		if err := loadPTRHosts(); err != nil {
+			logError("Keeping previous PTR host overrides: %v", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// withPTRHosts points PTR_HOSTS_PATH at a temp file holding content.
+func withPTRHosts(t *testing.T, content string) string {
+	t.Helper()
+	prevPath, prevTable := PTR_HOSTS_PATH, ptrHosts.Load()
+	t.Cleanup(func() {
+		PTR_HOSTS_PATH = prevPath
+		ptrHosts.Store(prevTable)
+	})
+	PTR_HOSTS_PATH = t.TempDir() + "/ptr-hosts"
+	if err := os.WriteFile(PTR_HOSTS_PATH, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := loadPTRHosts(); err != nil {
+		t.Fatalf("loadPTRHosts() error = %v", err)
+	}
+	return PTR_HOSTS_PATH
+}
+
+func TestParsePTRHosts(t *testing.T) {
+	table, err := parsePTRHosts([]byte(`
+# internal services
+10.0.0.0/8        corp.internal
+10.20.0.0/16      k8s.corp.internal   # more specific than 10/8
+10.20.0.5         registry.corp.internal. registry
+2001:db8:cd::/48  partner-cdn.example
+`))
+	if err != nil {
+		t.Fatalf("parsePTRHosts() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want []string
+	}{
+		{ip: "10.20.0.5", want: []string{"registry.corp.internal", "registry"}},
+		{ip: "10.20.9.9", want: []string{"k8s.corp.internal"}},
+		{ip: "10.1.2.3", want: []string{"corp.internal"}},
+		{ip: "2001:db8:cd::1", want: []string{"partner-cdn.example"}},
+		{ip: "198.51.100.10", want: nil},
+	}
+	for _, tt := range tests {
+		if got := table.lookup(net.ParseIP(tt.ip)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"10.0.0.1\n", "10.0.0.300 host\n", "10.0.0.0/33 host\n"} {
+		if _, err := parsePTRHosts([]byte(bad)); err == nil {
+			t.Errorf("parsePTRHosts(%q) error = nil, want error", bad)
+		}
+	}
+}
+
+func TestLookupToAddrTimed_HostsOverrideDNS(t *testing.T) {
+	resolver := &fakePTRResolver{answers: map[string][]string{
+		"198.51.100.10": {"ec2-198-51-100-10.compute.example."},
+		"198.51.100.11": {"other.example."},
+	}}
+	withPTRResolver(t, resolver.resolve)
+	path := withPTRHosts(t, "198.51.100.10 api.partner.example\n")
+
+	if got := lookupToAddrTimed("198.51.100.10"); !reflect.DeepEqual(got, []string{"api.partner.example"}) {
+		t.Fatalf("lookupToAddrTimed() = %v", got)
+	}
+	if n := resolver.count("198.51.100.10"); n != 0 {
+		t.Fatalf("queries = %d, want 0 for an overridden address", n)
+	}
+	if got := lookupToAddrTimed("198.51.100.11"); !reflect.DeepEqual(got, []string{"other.example"}) {
+		t.Fatalf("lookupToAddrTimed() = %v, want the DNS answer", got)
+	}
+
+	// Override names take part in domain skip rules.
+	entry, err := parseLog(formatTestAccessLine(1))
+	if err != nil {
+		t.Fatalf("parseLog() error = %v", err)
+	}
+	if !isSkipped(entry, []SkipRule{{Domain: []string{"partner.example"}}}) {
+		t.Fatalf("entry with to_addr %v not skipped", entry.ToAddr)
+	}
+
+	// A reload that fails to parse keeps the previous table.
+	os.WriteFile(path, []byte("198.51.100.10\n"), 0o644)
+	if err := loadPTRHosts(); err == nil {
+		t.Fatal("loadPTRHosts() error = nil for a broken file")
+	}
+	if got := lookupToAddrTimed("198.51.100.10"); !reflect.DeepEqual(got, []string{"api.partner.example"}) {
+		t.Fatalf("lookupToAddrTimed() after a broken reload = %v", got)
+	}
+
+	os.WriteFile(path, []byte("198.51.100.0/24 edge.partner.example\n"), 0o644)
+	if err := loadPTRHosts(); err != nil {
+		t.Fatalf("loadPTRHosts() error = %v", err)
+	}
+	if got := lookupToAddrTimed("198.51.100.11"); !reflect.DeepEqual(got, []string{"edge.partner.example"}) {
+		t.Fatalf("lookupToAddrTimed() after reload = %v", got)
+	}
+}
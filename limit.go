@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var PTR_RATE_LIMIT = getEnvInt("PTR_RATE_LIMIT", 100)
+var PTR_RATE_BURST = getEnvInt("PTR_RATE_BURST", 200)
+var PTR_MAX_INFLIGHT = getEnvInt("PTR_MAX_INFLIGHT", vectorParseConcurrency)
+
+// tokenBucket allows rate events per second on average and up to burst at
+// once.
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token if one is available at now.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// ptrLimiter is the process-wide budget for reverse lookups: a query rate
+// shared by every ingest path and a cap on queries in flight. It never
+// blocks; a lookup over budget is skipped.
+type ptrLimiter struct {
+	rate  *tokenBucket
+	slots chan struct{}
+}
+
+func newPTRLimiter(rate, burst, inflight int) *ptrLimiter {
+	return &ptrLimiter{
+		rate:  newTokenBucket(rate, burst),
+		slots: make(chan struct{}, inflight),
+	}
+}
+
+// ptrLimitReason says which budget a skipped lookup ran out of.
+type ptrLimitReason int
+
+const (
+	ptrWithinLimits ptrLimitReason = iota
+	ptrRateLimited
+	ptrConcurrencyLimited
+)
+
+// acquire reserves a query slot and a token. Callers that get
+// ptrWithinLimits must call release once the query is done.
+func (l *ptrLimiter) acquire(now time.Time) ptrLimitReason {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		return ptrConcurrencyLimited
+	}
+	if !l.rate.allow(now) {
+		<-l.slots
+		return ptrRateLimited
+	}
+	return ptrWithinLimits
+}
+
+func (l *ptrLimiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	b := newTokenBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(clock.now()) {
+			t.Fatalf("allow() #%d = false within the burst", i+1)
+		}
+	}
+	if b.allow(clock.now()) {
+		t.Fatal("allow() = true after the burst")
+	}
+	clock.advance(500 * time.Millisecond)
+	if !b.allow(clock.now()) || b.allow(clock.now()) {
+		t.Fatal("want exactly one token after 500ms at 2/s")
+	}
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		b.allow(clock.now())
+	}
+	if b.allow(clock.now()) {
+		t.Fatal("refill exceeded the burst")
+	}
+}
+
+func TestPTRCache_RateLimit(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	resolver := &fakePTRResolver{answers: map[string][]string{"198.51.100.10": {"edge.example.net."}}, ttl: time.Minute}
+	c := newPTRCache(10, resolver.resolve)
+	c.now = clock.now
+	c.limit = newPTRLimiter(1, 1, 10)
+
+	c.lookup(net.ParseIP("198.51.100.1"))
+	if got := c.lookup(net.ParseIP("198.51.100.10")); got != nil {
+		t.Fatalf("lookup() = %v, want nil over budget", got)
+	}
+	if c.rateLimited.Load() != 1 || c.misses.Load() != 1 {
+		t.Fatalf("rateLimited = %d, misses = %d, want 1, 1", c.rateLimited.Load(), c.misses.Load())
+	}
+
+	// Skipped lookups are not cached; the next one after a refill succeeds.
+	clock.advance(time.Second)
+	if got := c.lookup(net.ParseIP("198.51.100.10")); !reflect.DeepEqual(got, []string{"edge.example.net"}) {
+		t.Fatalf("lookup() after refill = %v", got)
+	}
+}
+
+func TestPTRCache_ConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	c := newPTRCache(10, func(context.Context, net.IP) ([]string, time.Duration, error) {
+		<-release
+		return []string{"slow.example."}, time.Minute, nil
+	})
+	c.limit = newPTRLimiter(100, 100, 1)
+
+	done := make(chan []string)
+	go func() { done <- c.lookup(net.ParseIP("198.51.100.1")) }()
+	for c.misses.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The only slot is taken by another address: skip without waiting.
+	if got := c.lookup(net.ParseIP("198.51.100.2")); got != nil {
+		t.Fatalf("lookup() = %v, want nil while the slot is taken", got)
+	}
+	if n := c.concurrencyLimited.Load(); n != 1 {
+		t.Fatalf("concurrencyLimited = %d, want 1", n)
+	}
+
+	close(release)
+	if got := <-done; !reflect.DeepEqual(got, []string{"slow.example"}) {
+		t.Fatalf("lookup() = %v", got)
+	}
+	if got := c.lookup(net.ParseIP("198.51.100.2")); !reflect.DeepEqual(got, []string{"slow.example"}) {
+		t.Fatalf("lookup() after release = %v", got)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var LOKI_ENDPOINT = getEnv("LOKI_ENDPOINT", "")
+var LOKI_ENCODING = getEnv("LOKI_ENCODING", lokiEncodingProtobuf)
+var LOKI_LABELS = getEnv("LOKI_LABELS", "status")
+var LOKI_STATIC_LABELS = getEnv("LOKI_STATIC_LABELS", "job=xray")
+var LOKI_TENANT_ID = getEnv("LOKI_TENANT_ID", "")
+
+const (
+	lokiEncodingProtobuf = "protobuf"
+	lokiEncodingJSON     = "json"
+
+	lokiProtobufContentType = "application/x-protobuf"
+	lokiJSONContentType     = "application/json"
+)
+
+var lokiHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// lokiStream is one label set and its entries, already ordered by time.
+type lokiStream struct {
+	labels  string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+// validateLokiConfig checks the Loki-specific settings; only called when
+// LOKI_ENDPOINT is the selected sink.
+func validateLokiConfig() error {
+	switch LOKI_ENCODING {
+	case lokiEncodingProtobuf, lokiEncodingJSON:
+	default:
+		return fmt.Errorf("LOKI_ENCODING must be %q or %q, got %q", lokiEncodingProtobuf, lokiEncodingJSON, LOKI_ENCODING)
+	}
+	for _, field := range splitList(LOKI_LABELS) {
+		if !knownLabelField(field) {
+			return fmt.Errorf("LOKI_LABELS: unsupported field %q", field)
+		}
+	}
+	if _, err := parseStaticLabels(LOKI_STATIC_LABELS); err != nil {
+		return fmt.Errorf("LOKI_STATIC_LABELS: %w", err)
+	}
+	return nil
+}
+
+// parseStaticLabels parses "k1=v1,k2=v2".
+func parseStaticLabels(raw string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range splitList(raw) {
+		k, v, ok := strings.Cut(pair, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q, want key=value", pair)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// formatLokiLabels renders a label set in Loki's selector syntax with keys
+// sorted, so equal sets always produce the same stream key.
+func formatLokiLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// entryTime recovers the event time from the formatted datetime, falling back
+// to now so a malformed value never blocks a push.
+func entryTime(event logEvent) time.Time {
+	t, err := parseEventTime(event.eventDatetime())
+	if err != nil {
+		return time.Now()
+	}
+	return t
+}
+
+// groupLokiStreams splits entries into streams by their label set: static
+// labels, then labels carried over from a Loki push ingest, then the
+// configured entry fields. Fields an event type does not have are left out.
+// Streams are returned in first-seen order with entries sorted by time.
+func groupLokiStreams(entries []logEvent) ([]lokiStream, error) {
+	static, err := parseStaticLabels(LOKI_STATIC_LABELS)
+	if err != nil {
+		return nil, err
+	}
+	fields := splitList(LOKI_LABELS)
+
+	index := make(map[string]int)
+	var streams []lokiStream
+	for _, entry := range entries {
+		labels := make(map[string]string, len(static)+len(fields))
+		for k, v := range static {
+			labels[k] = v
+		}
+		for k, v := range entry.origin().Labels {
+			labels[k] = v
+		}
+		for _, field := range fields {
+			if v, ok := entry.labelValue(field); ok && v != "" {
+				labels[field] = v
+			}
+		}
+		key := formatLokiLabels(labels)
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("marshal: %w", err)
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(streams)
+			index[key] = i
+			streams = append(streams, lokiStream{labels: key})
+		}
+		streams[i].entries = append(streams[i].entries, lokiEntry{ts: entryTime(entry), line: string(line)})
+	}
+
+	for i := range streams {
+		sort.SliceStable(streams[i].entries, func(a, b int) bool {
+			return streams[i].entries[a].ts.Before(streams[i].entries[b].ts)
+		})
+	}
+	return streams, nil
+}
+
+// encodeLokiProtobuf builds a snappy-compressed logproto.PushRequest.
+func encodeLokiProtobuf(streams []lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		var stream []byte
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, s.labels)
+		for _, e := range s.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Nanosecond()))
+
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, ts)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, e.line)
+
+			stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+			stream = protowire.AppendBytes(stream, entry)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, stream)
+	}
+	return snappy.Encode(nil, req)
+}
+
+type lokiJSONPush struct {
+	Streams []lokiJSONStream `json:"streams"`
+}
+
+type lokiJSONStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// encodeLokiJSON builds the JSON push body. Labels are re-parsed from the
+// selector string so both encodings share one grouping pass.
+func encodeLokiJSON(streams []lokiStream) ([]byte, error) {
+	push := lokiJSONPush{Streams: make([]lokiJSONStream, 0, len(streams))}
+	for _, s := range streams {
+		labels, err := parseLokiLabels(s.labels)
+		if err != nil {
+			return nil, err
+		}
+		values := make([][2]string, 0, len(s.entries))
+		for _, e := range s.entries {
+			values = append(values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		push.Streams = append(push.Streams, lokiJSONStream{Stream: labels, Values: values})
+	}
+	return json.Marshal(push)
+}
+
+// parseLokiLabels parses a selector such as {job="xray", status="accepted"}.
+func parseLokiLabels(raw string) (map[string]string, error) {
+	s := strings.TrimSpace(raw)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("labels %q: missing braces", raw)
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+
+	labels := make(map[string]string)
+	for s != "" {
+		name, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			return nil, fmt.Errorf("labels %q: missing '='", raw)
+		}
+		name = strings.TrimSpace(name)
+		rest = strings.TrimSpace(rest)
+
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, fmt.Errorf("labels %q: %w", raw, err)
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, fmt.Errorf("labels %q: %w", raw, err)
+		}
+		labels[name] = value
+
+		s = strings.TrimSpace(rest[len(quoted):])
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+	return labels, nil
+}
+
+func pushToLoki(entries []logEvent) error {
+	streams, err := groupLokiStreams(entries)
+	if err != nil {
+		return fmt.Errorf("group streams: %w", err)
+	}
+
+	var payload []byte
+	contentType := lokiProtobufContentType
+	if LOKI_ENCODING == lokiEncodingJSON {
+		contentType = lokiJSONContentType
+		if payload, err = encodeLokiJSON(streams); err != nil {
+			return fmt.Errorf("encode: %w", err)
+		}
+	} else {
+		payload = encodeLokiProtobuf(streams)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, LOKI_ENDPOINT, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if LOKI_TENANT_ID != "" {
+		req.Header.Set("X-Scope-OrgID", LOKI_TENANT_ID)
+	}
+
+	resp, err := lokiHTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("post to loki: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("loki returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiPushStream is one stream of a received Loki push: its labels and the
+// raw Xray lines carried in its values.
+type lokiPushStream struct {
+	labels map[string]string
+	lines  []string
+}
+
+// decodeLokiPush decodes a push body the way Loki does: JSON when the
+// content type says so, snappy-compressed protobuf otherwise.
+func decodeLokiPush(contentType string, body []byte) ([]lokiPushStream, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == lokiJSONContentType {
+		return decodeLokiPushJSON(body)
+	}
+	return decodeLokiPushProtobuf(body)
+}
+
+func decodeLokiPushJSON(body []byte) ([]lokiPushStream, error) {
+	var push lokiJSONPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+
+	streams := make([]lokiPushStream, 0, len(push.Streams))
+	for _, s := range push.Streams {
+		lines := make([]string, 0, len(s.Values))
+		for _, v := range s.Values {
+			lines = append(lines, v[1])
+		}
+		streams = append(streams, lokiPushStream{labels: s.Stream, lines: lines})
+	}
+	return streams, nil
+}
+
+// decodeLokiPushProtobuf walks a snappy-compressed logproto.PushRequest,
+// keeping only stream labels and entry lines.
+func decodeLokiPushProtobuf(body []byte) ([]lokiPushStream, error) {
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+
+	var streams []lokiPushStream
+	err = walkProtoFields(raw, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		stream, err := decodeLokiProtoStream(value)
+		if err != nil {
+			return err
+		}
+		streams = append(streams, stream)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("protobuf: %w", err)
+	}
+	return streams, nil
+}
+
+func decodeLokiProtoStream(b []byte) (lokiPushStream, error) {
+	var stream lokiPushStream
+	err := walkProtoFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			labels, err := parseLokiLabels(string(value))
+			if err != nil {
+				return err
+			}
+			stream.labels = labels
+		case 2:
+			return walkProtoFields(value, func(num protowire.Number, typ protowire.Type, value []byte) error {
+				if num == 2 && typ == protowire.BytesType {
+					stream.lines = append(stream.lines, string(value))
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return stream, err
+}
+
+// walkProtoFields calls fn for every top-level field of a protobuf message.
+// value holds the payload for length-delimited fields and the encoded value
+// (such as the varint bytes) otherwise.
+func walkProtoFields(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var value []byte
+		if typ == protowire.BytesType {
+			value, n = protowire.ConsumeBytes(b)
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n >= 0 {
+				value = b[:n]
+			}
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(num, typ, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lokiPushHandler accepts the Loki push API so Promtail or Grafana Agent can
+// ship raw Xray lines here. Every line is processed like /vector/ingest and
+// keeps the labels of the stream it arrived in.
+func lokiPushHandler(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	opts, err := requestIngestOptions(r)
+	if err != nil {
+		logError("loki_push batch=- status=%d total=%s err=options: %v", http.StatusBadRequest, time.Since(start), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, status, err := readIngestBody(w, r)
+	if err != nil {
+		logError("loki_push batch=- status=%d total=%s err=body: %v", status, time.Since(start), err)
+		http.Error(w, "Error reading request body", status)
+		return
+	}
+
+	batchID := hashBatch(body)
+	if forwardedBatches.Seen(batchID) {
+		w.WriteHeader(http.StatusNoContent)
+		logDebug("loki_push batch=%s status=%d dedup=1 total=%s",
+			batchID, http.StatusNoContent, time.Since(start))
+		return
+	}
+
+	streams, err := decodeLokiPush(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		logError("loki_push batch=%s status=%d total=%s err=decode: %v",
+			batchID, http.StatusBadRequest, time.Since(start), err)
+		http.Error(w, "Error decoding push request", http.StatusBadRequest)
+		return
+	}
+
+	parseStart := time.Now()
+	lines := 0
+	var parsed []logEvent
+	var rejected []rejectedLine
+	for _, stream := range streams {
+		rawLines := make([]string, 0, len(stream.lines))
+		for _, line := range stream.lines {
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				rawLines = append(rawLines, line)
+			}
+		}
+		lines += len(rawLines)
+		streamOpts := opts
+		if len(stream.labels) > 0 {
+			streamOpts.origin.Labels = stream.labels
+		}
+		events, streamRejected := processEventsParallel(rawLines, streamOpts)
+		parsed = append(parsed, events...)
+		rejected = append(rejected, streamRejected...)
+	}
+	parseDur := time.Since(parseStart)
+	forwarded := len(parsed)
+	skipped := lines - forwarded
+
+	status, emitDur, err := emitIngested(batchID, parsed)
+	if err != nil {
+		logError("loki_push batch=%s status=%d streams=%d lines=%d skipped=%d forwarded=%d parse=%s emit=%s total=%s err=emit: %v",
+			batchID, status, len(streams), lines, skipped, forwarded, parseDur, emitDur, time.Since(start), err)
+		http.Error(w, "Error emitting events", status)
+		return
+	}
+	deadLetterRejected(rejected, opts)
+
+	w.WriteHeader(http.StatusNoContent)
+	logDebug("loki_push batch=%s status=%d streams=%d lines=%d skipped=%d forwarded=%d parse=%s emit=%s total=%s",
+		batchID, http.StatusNoContent, len(streams), lines, skipped, forwarded, parseDur, emitDur, time.Since(start))
+}
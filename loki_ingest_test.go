@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeLokiPushProtobuf_RoundTrip(t *testing.T) {
+	in := []lokiStream{
+		{labels: `{host="edge-1", job="xray"}`, entries: []lokiEntry{
+			{ts: time.Unix(1, 0), line: "line one"},
+			{ts: time.Unix(2, 0), line: "line two"},
+		}},
+		{labels: `{host="edge-2"}`, entries: []lokiEntry{{ts: time.Unix(3, 0), line: "line three"}}},
+	}
+
+	got, err := decodeLokiPushProtobuf(encodeLokiProtobuf(in))
+	if err != nil {
+		t.Fatalf("decodeLokiPushProtobuf() error = %v", err)
+	}
+	want := []lokiPushStream{
+		{labels: map[string]string{"host": "edge-1", "job": "xray"}, lines: []string{"line one", "line two"}},
+		{labels: map[string]string{"host": "edge-2"}, lines: []string{"line three"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("decodeLokiPushProtobuf()\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestDecodeLokiPush_Rejects(t *testing.T) {
+	if _, err := decodeLokiPush(lokiJSONContentType, []byte(`{"streams":`)); err == nil {
+		t.Fatal("truncated JSON: error = nil")
+	}
+	if _, err := decodeLokiPush(lokiProtobufContentType, []byte("not snappy")); err == nil {
+		t.Fatal("garbage protobuf: error = nil")
+	}
+}
+
+func TestLokiPushHandler_File(t *testing.T) {
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+	})
+	skipRules = nil
+	VECTOR_ENDPOINT, LOKI_ENDPOINT = "", ""
+
+	lineA := `2026/07/23 10:11:12.100000 from 203.0.113.47:4821 accepted tcp:probe.example-cdn.net:443 [IN_A >> DIRECT] email: 1204`
+	lineB := `2026/07/23 10:11:12.200000 from 198.51.100.14:29104 accepted tcp:alpha.example:443 [IN_B >> DIRECT] email: 8831`
+
+	jsonBody, _ := json.Marshal(lokiJSONPush{Streams: []lokiJSONStream{
+		{Stream: map[string]string{"host": "edge-1"}, Values: [][2]string{{"1", lineA}, {"2", "garbage"}}},
+	}})
+	protoBody := encodeLokiProtobuf([]lokiStream{
+		{labels: `{host="edge-2"}`, entries: []lokiEntry{{ts: time.Unix(1, 0), line: lineB + "\n"}}},
+	})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantEmail   string
+		wantHost    string
+	}{
+		{name: "json", contentType: "application/json; charset=utf-8", body: jsonBody, wantEmail: "1204", wantHost: "edge-1"},
+		{name: "protobuf", contentType: lokiProtobufContentType, body: protoBody, wantEmail: "8831", wantHost: "edge-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			OUTPUT_FILE = t.TempDir() + "/out.ndjson"
+
+			req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			lokiPushHandler(rec, req)
+			if rec.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusNoContent, rec.Body.String())
+			}
+
+			data, err := os.ReadFile(OUTPUT_FILE)
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %d lines, want 1: %q", len(lines), data)
+			}
+			var got LogEntry
+			if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if got.Email != tt.wantEmail || got.Labels["host"] != tt.wantHost {
+				t.Fatalf("unexpected entry: %+v", got)
+			}
+		})
+	}
+}
+
+func TestLokiPushHandler_BadBody(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader("nope"))
+	req.Header.Set("Content-Type", lokiJSONContentType)
+	rec := httptest.NewRecorder()
+	lokiPushHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
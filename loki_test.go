@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func withLokiConfig(t *testing.T, endpoint, encoding, labels, static string) {
+	t.Helper()
+	prev := [...]string{OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, LOKI_ENCODING, LOKI_LABELS, LOKI_STATIC_LABELS}
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT = prev[0], prev[1], prev[2]
+		LOKI_ENCODING, LOKI_LABELS, LOKI_STATIC_LABELS = prev[3], prev[4], prev[5]
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT = "", "", endpoint
+	LOKI_ENCODING, LOKI_LABELS, LOKI_STATIC_LABELS = encoding, labels, static
+}
+
+func lokiTestEntries() []logEvent {
+	return []logEvent{
+		&LogEntry{Datetime: "2026-07-23 10:11:12.300000", Email: "1", Status: "accepted", Route: "IN - DIRECT", ToAddr: []string{}},
+		&LogEntry{Datetime: "2026-07-23 10:11:12.100000", Email: "2", Status: "accepted", Route: "IN - DIRECT", ToAddr: []string{}},
+		&LogEntry{Datetime: "2026-07-23 10:11:12.200000", Email: "3", Status: "rejected", Route: "IN - BLOCK", ToAddr: []string{}},
+	}
+}
+
+func TestLokiLabels_RoundTrip(t *testing.T) {
+	labels := map[string]string{"status": "accepted", "job": "xray", "route": `IN "quoted" - DIRECT`}
+	raw := formatLokiLabels(labels)
+
+	want := `{job="xray", route="IN \"quoted\" - DIRECT", status="accepted"}`
+	if raw != want {
+		t.Fatalf("formatLokiLabels() = %s, want %s", raw, want)
+	}
+
+	got, err := parseLokiLabels(raw)
+	if err != nil {
+		t.Fatalf("parseLokiLabels() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, labels) {
+		t.Fatalf("parseLokiLabels() = %v, want %v", got, labels)
+	}
+}
+
+func TestGroupLokiStreams(t *testing.T) {
+	withLokiConfig(t, "http://loki", lokiEncodingJSON, "status,route", "job=xray")
+
+	streams, err := groupLokiStreams(lokiTestEntries())
+	if err != nil {
+		t.Fatalf("groupLokiStreams() error = %v", err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(streams))
+	}
+	if streams[0].labels != `{job="xray", route="IN - DIRECT", status="accepted"}` {
+		t.Fatalf("unexpected first stream labels %s", streams[0].labels)
+	}
+	if len(streams[0].entries) != 2 || !streams[0].entries[0].ts.Before(streams[0].entries[1].ts) {
+		t.Fatalf("first stream entries must be time-ordered: %+v", streams[0].entries)
+	}
+}
+
+func TestValidateLokiConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string
+		labels   string
+		static   string
+		wantOK   bool
+	}{
+		{name: "defaults", encoding: lokiEncodingProtobuf, labels: "status", static: "job=xray", wantOK: true},
+		{name: "json with email", encoding: lokiEncodingJSON, labels: "status,email", static: "job=xray", wantOK: true},
+		{name: "unknown encoding", encoding: "msgpack", labels: "status", static: "job=xray", wantOK: false},
+		{name: "unknown field", encoding: lokiEncodingProtobuf, labels: "nope", static: "job=xray", wantOK: false},
+		{name: "bad static label", encoding: lokiEncodingProtobuf, labels: "status", static: "job", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withLokiConfig(t, "http://loki", tt.encoding, tt.labels, tt.static)
+			err := validateLokiConfig()
+			if tt.wantOK && err != nil {
+				t.Fatalf("validateLokiConfig() error = %v, want nil", err)
+			}
+			if !tt.wantOK && err == nil {
+				t.Fatal("validateLokiConfig() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestEmitBatch_LokiJSON(t *testing.T) {
+	var got lokiJSONPush
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != lokiJSONContentType {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	withLokiConfig(t, srv.URL, lokiEncodingJSON, "status", "job=xray")
+
+	if err := emitBatch(lokiTestEntries()); err != nil {
+		t.Fatalf("emitBatch() error = %v", err)
+	}
+
+	if len(got.Streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(got.Streams))
+	}
+	if !reflect.DeepEqual(got.Streams[0].Stream, map[string]string{"job": "xray", "status": "accepted"}) {
+		t.Fatalf("unexpected labels %v", got.Streams[0].Stream)
+	}
+	if got.Streams[0].Values[0][0] != "1784801472100000000" {
+		t.Fatalf("unexpected timestamp %s", got.Streams[0].Values[0][0])
+	}
+	var line LogEntry
+	if err := json.Unmarshal([]byte(got.Streams[0].Values[0][1]), &line); err != nil {
+		t.Fatalf("line is not a LogEntry: %v", err)
+	}
+	if line.Email != "2" {
+		t.Fatalf("first line email = %q, want 2", line.Email)
+	}
+}
+
+func TestEmitBatch_LokiProtobuf(t *testing.T) {
+	var labels []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != lokiProtobufContentType {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		body, _ := io.ReadAll(r.Body)
+		streams, err := decodeLokiPushProtobuf(body)
+		if err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		for _, s := range streams {
+			labels = append(labels, formatLokiLabels(s.labels))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	withLokiConfig(t, srv.URL, lokiEncodingProtobuf, "status", "job=xray")
+
+	if err := emitBatch(lokiTestEntries()); err != nil {
+		t.Fatalf("emitBatch() error = %v", err)
+	}
+
+	want := []string{`{job="xray", status="accepted"}`, `{job="xray", status="rejected"}`}
+	if !reflect.DeepEqual(labels, want) {
+		t.Fatalf("stream labels = %v, want %v", labels, want)
+	}
+}
+
+func TestEmitBatch_LokiErrorStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "entry out of order", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	withLokiConfig(t, srv.URL, lokiEncodingProtobuf, "status", "job=xray")
+
+	if err := emitBatch(lokiTestEntries()); err == nil {
+		t.Fatal("emitBatch() error = nil, want error on 400")
+	}
+}
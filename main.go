@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"regexp"
 	"time"
 )
 
@@ -16,9 +15,6 @@ var VECTOR_ENDPOINT = getEnv("VECTOR_ENDPOINT", "")
 
 const SKIP_RULES_PATH = "/etc/xray-loki-proxy/skip-rules.json"
 
-/* https://github.com/XTLS/Xray-core/blob/main/common/log/access.go */
-var xrayLogFormat = regexp.MustCompile(`^(?P<datetime>\S+\s+\S+)\s*?(from\s)?(?P<from>\S+)\s+(?P<status>\S+)\s+(?P<to>\S+)(?:\s+\[(?P<route>.*?)\])?(?:\s+email:\s+(?P<email>\S+))?$`)
-
 var skipRules []SkipRule
 
 func loadSkipRules() error {
@@ -35,18 +31,30 @@ func loadSkipRules() error {
 		return fmt.Errorf("error parsing skip rules: %v", err)
 	}
 
+	patterns, err := loadSkipPatterns(skipRules)
+	if err != nil {
+		return err
+	}
+	skipPatterns.Store(patterns)
+
 	logInfo("Loaded skip rules from %s", SKIP_RULES_PATH)
 	return nil
 }
 
 func validateSinkConfig() error {
-	hasFile := OUTPUT_FILE != ""
-	hasVector := VECTOR_ENDPOINT != ""
+	configured := 0
+	for _, sink := range []string{OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT} {
+		if sink != "" {
+			configured++
+		}
+	}
 	switch {
-	case hasFile && hasVector:
-		return fmt.Errorf("set exactly one of OUTPUT_FILE or VECTOR_ENDPOINT, not both")
-	case !hasFile && !hasVector:
-		return fmt.Errorf("set exactly one of OUTPUT_FILE or VECTOR_ENDPOINT")
+	case configured > 1:
+		return fmt.Errorf("set exactly one of OUTPUT_FILE, VECTOR_ENDPOINT or LOKI_ENDPOINT, not several")
+	case configured == 0:
+		return fmt.Errorf("set exactly one of OUTPUT_FILE, VECTOR_ENDPOINT or LOKI_ENDPOINT")
+	case LOKI_ENDPOINT != "":
+		return validateLokiConfig()
 	default:
 		return nil
 	}
@@ -76,16 +84,92 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := validateDeadLetterConfig(); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
+	if err := validateIngestFormat(INGEST_FORMAT); err != nil {
+		logError("INGEST_FORMAT: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadTimeConfig(); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
+	if err := loadPTRConfig(); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
+	if err := loadPTRHosts(); err != nil {
+		logError("Failed to load PTR hosts: %v", err)
+		os.Exit(1)
+	}
+
+	if err := loadGeoIP(); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
+	if err := loadXrayGeo(); err != nil {
+		logError("%v", err)
+		os.Exit(1)
+	}
+
 	if err := loadSkipRules(); err != nil {
 		logError("Failed to load skip rules: %v", err)
 		os.Exit(1)
 	}
 
+	if err := loadLogFormats(); err != nil {
+		logError("Failed to load log formats: %v", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			logError("Replay failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := initDedupStore(); err != nil {
+		logError("Failed to open dedup store: %v", err)
+		os.Exit(1)
+	}
+
 	startTorrentNotifier()
 
+	startDeadLetters()
+
+	startPTRAsync()
+
+	go watchPTRHosts()
+
+	startGeoIPWatcher()
+
+	startXrayGeoWatcher()
+
+	startSessionCorrelation()
+
+	startSingboxAssembler()
+
+	startFileTail()
+
+	if err := startSyslogServers(); err != nil {
+		logError("Failed to start syslog server: %v", err)
+		os.Exit(1)
+	}
+
 	addr := fmt.Sprintf("%s:%s", LISTEN_HOST, LISTEN_PORT)
 
 	http.HandleFunc("/vector/ingest", vectorIngestHandler)
+	http.HandleFunc("/loki/api/v1/push", lokiPushHandler)
+	http.HandleFunc("/metrics", metricsHandler)
 
 	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -103,9 +187,12 @@ func main() {
 		IdleTimeout:       120 * time.Second,
 	}
 
-	if OUTPUT_FILE != "" {
+	switch {
+	case OUTPUT_FILE != "":
 		logInfo("Server started on %s (sink=file path=%s)", addr, OUTPUT_FILE)
-	} else {
+	case LOKI_ENDPOINT != "":
+		logInfo("Server started on %s (sink=loki endpoint=%s encoding=%s)", addr, LOKI_ENDPOINT, LOKI_ENCODING)
+	default:
 		logInfo("Server started on %s (sink=vector endpoint=%s)", addr, VECTOR_ENDPOINT)
 	}
 
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// metric is one sample exposed on /metrics in the Prometheus text format.
+type metric struct {
+	name  string
+	help  string
+	kind  string // "counter" or "gauge"
+	value func() float64
+}
+
+// metrics lists what /metrics exposes, in output order.
+var metrics = []metric{
+	{
+		name:  "xray_loki_proxy_ptr_cache_hits_total",
+		help:  "PTR lookups answered from the cache.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.hits.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_cache_misses_total",
+		help:  "PTR lookups that sent a DNS query.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.misses.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_cache_merged_total",
+		help:  "PTR lookups that waited for a query already in flight for the same address.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.merged.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_lookup_failures_total",
+		help:  "PTR queries that timed out or failed.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.failures.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_lookups_rate_limited_total",
+		help:  "PTR lookups skipped because PTR_RATE_LIMIT was exceeded.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.rateLimited.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_lookups_concurrency_limited_total",
+		help:  "PTR lookups skipped because PTR_MAX_INFLIGHT queries were already in flight.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.concurrencyLimited.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_cache_evictions_total",
+		help:  "PTR cache entries evicted to stay within PTR_CACHE_SIZE.",
+		kind:  "counter",
+		value: func() float64 { return float64(ptrLookups.evictions.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_cache_entries",
+		help:  "Addresses currently in the PTR cache.",
+		kind:  "gauge",
+		value: func() float64 { return float64(ptrLookups.Len()) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_async_delayed_total",
+		help:  "Entries held back by the PTR delay queue until their lookup finished.",
+		kind:  "counter",
+		value: func() float64 { return ptrDelayedStat(func(q *ptrDelayQueue) uint64 { return q.delayed.Load() }) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_async_overflows_total",
+		help:  "Entries emitted without to_addr because the PTR delay queue was full.",
+		kind:  "counter",
+		value: func() float64 { return ptrDelayedStat(func(q *ptrDelayQueue) uint64 { return q.overflows.Load() }) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_async_dropped_total",
+		help:  "Enriched entries dropped because the sink kept failing. They were already acknowledged to the shipper.",
+		kind:  "counter",
+		value: func() float64 { return ptrDelayedStat(func(q *ptrDelayQueue) uint64 { return q.out.dropped.Load() }) },
+	},
+	{
+		name:  "xray_loki_proxy_ptr_async_pending",
+		help:  "Entries currently waiting in the PTR delay queue.",
+		kind:  "gauge",
+		value: func() float64 { return ptrDelayedStat(func(q *ptrDelayQueue) uint64 { return uint64(q.Len()) }) },
+	},
+	{
+		name:  "xray_loki_proxy_syslog_udp_dropped_total",
+		help:  "Syslog UDP datagrams dropped because the parse workers fell behind.",
+		kind:  "counter",
+		value: func() float64 { return float64(syslogUDPDropped.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_singbox_dropped_total",
+		help:  "sing-box lines dropped because too many connections were incomplete.",
+		kind:  "counter",
+		value: func() float64 { return float64(singboxConns.dropped.Load()) },
+	},
+	{
+		name:  "xray_loki_proxy_dead_letters_dropped_total",
+		help:  "Dead letters dropped because the dead-letter sink fell behind.",
+		kind:  "counter",
+		value: deadLettersDropped,
+	},
+}
+
+// ptrDelayedStat reads a delay queue statistic, 0 when PTR_ASYNC is off.
+func ptrDelayedStat(stat func(*ptrDelayQueue) uint64) float64 {
+	if ptrDelayed == nil {
+		return 0
+	}
+	return float64(stat(ptrDelayed))
+}
+
+// deadLettersDropped reads the dead-letter drop count, 0 without a sink.
+func deadLettersDropped() float64 {
+	if deadLetters == nil {
+		return 0
+	}
+	return float64(deadLetters.dropped.Load())
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %s\n",
+			m.name, m.help, m.name, m.kind, m.name, strconv.FormatFloat(m.value(), 'g', -1, 64))
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
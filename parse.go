@@ -1,32 +1,89 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
 	"net"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// TODO: `2025/02/01 22:33:25 from 92.62.56.223:0 rejected  proxy/vless/encoding: failed to read request version > websocket: close 1000 (normal)`
-
 type LogEntry struct {
-	Datetime  string   `json:"datetime"`
-	Email     string   `json:"email"`
-	FromProto string   `json:"from_proto"`
-	FromIP    string   `json:"from_ip"`
-	FromPort  uint16   `json:"from_port"`
+	Datetime  string `json:"datetime"`
+	Email     string `json:"email"`
+	FromProto string `json:"from_proto"`
+	FromIP    string `json:"from_ip"`
+	FromPort  uint16 `json:"from_port"`
+	// FromGeo and DestGeo are set from GEOIP_DATABASES when the address is
+	// found there.
+	FromGeo   *GeoInfo `json:"from_geo,omitempty"`
 	DestProto string   `json:"dest_proto"`
 	DestHost  string   `json:"dest_host"`
 	DestPort  uint16   `json:"dest_port"`
-	Status    string   `json:"status"`
-	Route     string   `json:"route"`
-	ToAddr    []string `json:"to_addr"`
+	DestGeo   *GeoInfo `json:"dest_geo,omitempty"`
+	// DestCategories lists the geosite: or geoip: categories of the
+	// destination from XRAY_GEOSITE_PATH and XRAY_GEOIP_PATH.
+	DestCategories []string `json:"dest_categories,omitempty"`
+	Status         string   `json:"status"`
+	Route          string   `json:"route"`
+	// InboundTag and OutboundTag are the first and last hop of Route.
+	InboundTag  string `json:"inbound_tag"`
+	OutboundTag string `json:"outbound_tag"`
+	// RouteChain lists every hop, only for detour/balancer chains longer
+	// than inbound -> outbound.
+	RouteChain []string `json:"route_chain,omitempty"`
+	ToAddr     []string `json:"to_addr"`
+	// Reason is set for rejected connections, which have no destination.
+	Reason string `json:"reason,omitempty"`
+	// Format names the line format that matched: a user-defined one,
+	// "xray" or "singbox".
+	Format string `json:"format,omitempty"`
+	eventOrigin
+
+	// ptrPending marks entries whose to_addr is still being looked up by the
+	// PTR delay queue (PTR_ASYNC); skip rules wait for it.
+	ptrPending bool
+}
+
+func (e *LogEntry) eventDatetime() string { return e.Datetime }
+
+// labelValue returns the value of a LogEntry field addressed by its JSON
+// name, for use as a Loki stream label.
+func (e *LogEntry) labelValue(field string) (string, bool) {
+	switch field {
+	case "email":
+		return e.Email, true
+	case "from_proto":
+		return e.FromProto, true
+	case "from_ip":
+		return e.FromIP, true
+	case "from_port":
+		return strconv.FormatUint(uint64(e.FromPort), 10), true
+	case "dest_proto":
+		return e.DestProto, true
+	case "dest_host":
+		return e.DestHost, true
+	case "dest_port":
+		return strconv.FormatUint(uint64(e.DestPort), 10), true
+	case "status":
+		return e.Status, true
+	case "route":
+		return e.Route, true
+	case "inbound_tag":
+		return e.InboundTag, true
+	case "outbound_tag":
+		return e.OutboundTag, true
+	case "format":
+		return e.Format, true
+	default:
+		return "", false
+	}
 }
 
 const (
+	// xrayFormatName is the Format of lines in the built-in Xray shapes.
+	xrayFormatName   = "xray"
 	xrayTimeLayout   = "2006/01/02 15:04:05.000000"
 	outputTimeLayout = "2006-01-02 15:04:05.000000"
 	// maxToAddrNames caps PTR results; CDN IPs often return dozens of names.
@@ -35,106 +92,150 @@ const (
 	ptrLookupTimeout = 500 * time.Millisecond
 )
 
-// ptrDNSServers used by the reverse-DNS path (Cloudflare, Google).
-var ptrDNSServers = []string{
-	"1.1.1.1:53",
-	"1.0.0.1:53",
-	"8.8.8.8:53",
-	"8.8.4.4:53",
-}
+// Parse failures, told apart with errors.Is. Dead-lettered lines record
+// them as their reason.
+var (
+	errNoMatch      = errors.New("no match")
+	errBadTimestamp = errors.New("bad timestamp")
+	errBadFrom      = errors.New("bad from endpoint")
+	errBadTo        = errors.New("bad to endpoint")
+)
 
-// ptrResolver performs PTR lookups via ptrDNSServers (not the system resolver).
-var ptrResolver = newPTRResolver(ptrDNSServers)
-
-var routeArrowRegex = regexp.MustCompile(`\s*(?:==>|->|>>)\s*`)
-
-func newPTRResolver(servers []string) *net.Resolver {
-	return &net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
-			d := net.Dialer{Timeout: ptrLookupTimeout}
-			var lastErr error
-			for _, server := range servers {
-				conn, err := d.DialContext(ctx, network, server)
-				if err == nil {
-					return conn, nil
-				}
-				lastErr = err
-			}
-			return nil, lastErr
-		},
+// parseErrorReason names the kind of a parse failure.
+func parseErrorReason(err error) string {
+	switch {
+	case errors.Is(err, errNoMatch):
+		return "no_match"
+	case errors.Is(err, errBadTimestamp):
+		return "bad_timestamp"
+	case errors.Is(err, errBadFrom):
+		return "bad_from"
+	case errors.Is(err, errBadTo):
+		return "bad_to"
+	default:
+		return "invalid"
 	}
 }
 
 func parseLog(logLine string) (*LogEntry, error) {
-	groups, err := matchXrayLog(logLine)
-	if err != nil {
-		return nil, err
-	}
+	return parseLogInZone(logLine, sourceLocation)
+}
 
-	datetime, err := formatDatetimeUTC(groups["datetime"])
-	if err != nil {
-		return nil, err
+// parseLogInZone parses an access line whose timestamp is local time in loc.
+// User-defined formats are tried before the built-in Xray shapes. A line a
+// user-defined format matches but cannot build an entry from still gets the
+// built-in shapes; if those fail too, the format's error is returned.
+func parseLogInZone(logLine string, loc *time.Location) (*LogEntry, error) {
+	var formatErr error
+	if fields, format := matchCustomFormat(logLine); format != nil {
+		entry, err := entryFromFields(fields, loc, format.timeLayout)
+		if err == nil {
+			entry.Format = format.name
+			return entry, nil
+		}
+		formatErr = fmt.Errorf("format %s: %w", format.name, err)
 	}
 
-	fromProto, fromIP, fromPort, err := parseFromEndpoint(groups["from"])
+	fields, ok := scanXrayLine(logLine)
+	if !ok {
+		if formatErr != nil {
+			return nil, formatErr
+		}
+		return nil, errNoMatch
+	}
+	entry, err := entryFromFields(fields, loc, "")
 	if err != nil {
+		if formatErr != nil {
+			return nil, formatErr
+		}
 		return nil, err
 	}
+	entry.Format = xrayFormatName
+	return entry, nil
+}
 
-	destProto, destHost, destPort, err := parseToEndpoint(groups["to"])
+// lineFields are the raw fields of one access line, in Xray's notation,
+// whichever format they came from.
+type lineFields struct {
+	datetime string
+	from     string
+	status   string
+	to       string
+	route    string
+	email    string
+	reason   string
+}
+
+// entryFromFields builds a LogEntry, adds its GeoIP data and Xray
+// categories, and resolves its destination's PTR names. With PTR_ASYNC only
+// cached names are used and uncached destinations are marked for the delay
+// queue. An empty timeLayout means the Xray layouts.
+func entryFromFields(fields lineFields, loc *time.Location, timeLayout string) (*LogEntry, error) {
+	entry, err := newLogEntry(fields, loc, timeLayout)
 	if err != nil {
 		return nil, err
 	}
-
-	toAddr := lookupToAddrTimed(destHost)
-	if toAddr == nil {
-		toAddr = []string{}
+	entry.FromGeo = geoIP.lookup(entry.FromIP)
+	entry.DestGeo = geoIP.lookup(entry.DestHost)
+	entry.DestCategories = xrayGeo.Load().categories(entry.DestHost)
+	var ready bool
+	entry.ToAddr, ready = cachedToAddr(entry.DestHost)
+	entry.ptrPending = !ready
+	if entry.ToAddr == nil {
+		entry.ToAddr = []string{}
 	}
-
-	return &LogEntry{
-		Datetime:  datetime,
-		Email:     groups["email"],
-		FromProto: fromProto,
-		FromIP:    fromIP,
-		FromPort:  fromPort,
-		DestProto: destProto,
-		DestHost:  destHost,
-		DestPort:  destPort,
-		Status:    groups["status"],
-		Route:     normalizeRoute(groups["route"]),
-		ToAddr:    toAddr,
-	}, nil
+	return entry, nil
 }
 
-func matchXrayLog(logLine string) (map[string]string, error) {
-	match := xrayLogFormat.FindStringSubmatch(logLine)
-	if match == nil {
-		return nil, fmt.Errorf("no match")
-	}
-
-	groups := make(map[string]string, len(xrayLogFormat.SubexpNames()))
-	for i, name := range xrayLogFormat.SubexpNames() {
-		if i > 0 && name != "" {
-			groups[name] = match[i]
+// newLogEntry builds a LogEntry without touching the network.
+func newLogEntry(fields lineFields, loc *time.Location, timeLayout string) (*LogEntry, error) {
+	var datetime string
+	var err error
+	if timeLayout == "" {
+		datetime, err = formatXrayDatetime(fields.datetime, loc)
+	} else {
+		var t time.Time
+		if t, err = time.ParseInLocation(timeLayout, fields.datetime, loc); err == nil {
+			datetime = formatEventTime(t)
 		}
 	}
-	return groups, nil
-}
-
-func normalizeRoute(route string) string {
-	if route == "" {
-		return ""
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadTimestamp, err)
 	}
-	return routeArrowRegex.ReplaceAllString(route, " - ")
-}
 
-func formatDatetimeUTC(raw string) (string, error) {
-	t, err := time.Parse(xrayTimeLayout, raw)
+	fromProto, fromIP, fromPort, err := parseFromEndpoint(fields.from)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("%w: %v", errBadFrom, err)
 	}
-	return t.UTC().Format(outputTimeLayout), nil
+
+	var destProto, destHost string
+	var destPort uint16
+	if fields.reason == "" {
+		destProto, destHost, destPort, err = parseToEndpoint(fields.to)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadTo, err)
+		}
+	}
+
+	route := normalizeRoute(fields.route)
+	inboundTag, outboundTag, routeChain := routeTags(fields.route)
+
+	return &LogEntry{
+		Datetime:    datetime,
+		Email:       fields.email,
+		FromProto:   fromProto,
+		FromIP:      fromIP,
+		FromPort:    fromPort,
+		DestProto:   destProto,
+		DestHost:    destHost,
+		DestPort:    destPort,
+		Status:      fields.status,
+		Route:       route,
+		InboundTag:  inboundTag,
+		OutboundTag: outboundTag,
+		RouteChain:  routeChain,
+		Reason:      fields.reason,
+	}, nil
 }
 
 // parseFromEndpoint parses [tcp:|udp:]?<ip>:<port>.
@@ -189,20 +290,17 @@ func parseToEndpoint(to string) (proto, host string, port uint16, err error) {
 }
 
 // lookupToAddrTimed is used by the ingest path so a slow resolver cannot
-// stall an HTTP ingest batch indefinitely.
+// stall an HTTP ingest batch indefinitely. Names from PTR_HOSTS_PATH win over
+// DNS; answers are cached (see ptr.go).
 func lookupToAddrTimed(host string) []string {
 	ip := net.ParseIP(host)
 	if ip == nil {
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
-	defer cancel()
-
-	names, err := ptrResolver.LookupAddr(ctx, ip.String())
-	if err != nil || len(names) == 0 {
-		return nil
+	if names := ptrHosts.Load().lookup(ip); names != nil {
+		return names
 	}
-	return normalizeToAddr(names)
+	return ptrLookups.lookup(ip)
 }
 
 func normalizeToAddr(names []string) []string {
@@ -1,35 +1,252 @@
 package main
 
 import (
-	"strings"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
 	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
-func TestLookupToAddrTimed_CloudflareGoogle(t *testing.T) {
-	cases := []struct {
-		ip   string
-		want string // substring expected in some PTR name
+// fakeDNS is an in-process DNS server answering PTR queries from a table
+// over UDP, TCP, DNS-over-TLS and DNS-over-HTTPS.
+type fakeDNS struct {
+	ptr map[string]string // IP -> PTR name
+	// truncateUDP answers every UDP query with an empty truncated response.
+	truncateUDP atomic.Bool
+	queries     atomic.Int32
+
+	addr    string // UDP and TCP
+	tlsAddr string
+	dohURL  string
+	client  *http.Client // trusts the TLS and HTTPS certificates
+}
+
+func startFakeDNS(t *testing.T, ptr map[string]string) *fakeDNS {
+	t.Helper()
+	s := &fakeDNS{ptr: ptr}
+
+	// UDP and TCP share a port, as the truncation fallback needs.
+	var pc net.PacketConn
+	var ln net.Listener
+	for {
+		var err error
+		if ln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("listen tcp: %v", err)
+		}
+		if pc, err = net.ListenPacket("udp", ln.Addr().String()); err == nil {
+			break
+		}
+		ln.Close()
+	}
+	s.addr = ln.Addr().String()
+	go s.servePacket(pc)
+	go s.serveStream(ln)
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dnsMessageContentType)
+		w.Write(s.answer(query, false))
+	}))
+	s.dohURL = doh.URL + "/dns-query"
+	s.client = doh.Client()
+
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatalf("listen tls: %v", err)
+	}
+	s.tlsAddr = tlsLn.Addr().String()
+	go s.serveStream(tlsLn)
+
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+		tlsLn.Close()
+		doh.Close()
+	})
+	return s
+}
+
+func (s *fakeDNS) servePacket(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(s.answer(buf[:n], s.truncateUDP.Load()), addr)
+	}
+}
+
+func (s *fakeDNS) serveStream(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := s.answer(query, false)
+			conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+		}()
+	}
+}
+
+func (s *fakeDNS) answer(raw []byte, truncate bool) []byte {
+	s.queries.Add(1)
+	var query dnsmessage.Message
+	if err := query.Unpack(raw); err != nil || len(query.Questions) != 1 {
+		return nil
+	}
+	q := query.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: query.ID, Response: true, Truncated: truncate},
+		Questions: query.Questions,
+	}
+	if truncate {
+		out, _ := resp.Pack()
+		return out
+	}
+
+	resp.RCode = dnsmessage.RCodeNameError
+	for ip, name := range s.ptr {
+		if reverseName(net.ParseIP(ip)) == q.Name.String() {
+			resp.RCode = dnsmessage.RCodeSuccess
+			resp.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 300},
+				Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(name)},
+			}}
+		}
+	}
+	out, _ := resp.Pack()
+	return out
+}
+
+// withPTRResolver points lookupToAddrTimed at resolve through a fresh cache.
+func withPTRResolver(t *testing.T, resolve ptrResolveFunc) {
+	t.Helper()
+	prev := ptrLookups
+	t.Cleanup(func() { ptrLookups = prev })
+	ptrLookups = newPTRCache(100, resolve)
+}
+
+func TestLookupToAddrTimed_FakeDNS(t *testing.T) {
+	dns := startFakeDNS(t, map[string]string{
+		"198.51.100.10": "edge.example.net.",
+		"2001:db8::1":   "v6.example.net.",
+	})
+
+	tests := []struct {
+		name        string
+		servers     string
+		truncateUDP bool
 	}{
-		{ip: "1.1.1.1", want: "one.one.one.one"},
-		{ip: "8.8.8.8", want: "dns.google"},
+		{name: "udp", servers: dns.addr},
+		{name: "udp scheme", servers: "udp://" + dns.addr},
+		{name: "tcp", servers: "tcp://" + dns.addr},
+		{name: "udp truncated falls back to tcp", servers: dns.addr, truncateUDP: true},
+		{name: "dns over tls", servers: "tls://" + dns.tlsAddr},
+		{name: "dns over https", servers: dns.dohURL},
+		{name: "unreachable server is skipped", servers: "tcp://127.0.0.1:1," + dns.addr},
 	}
 
-	for _, tt := range cases {
-		t.Run(tt.ip, func(t *testing.T) {
-			names := lookupToAddrTimed(tt.ip)
-			if len(names) == 0 {
-				t.Skipf("lookupToAddrTimed(%s) returned no names (DNS unreachable?)", tt.ip)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dns.truncateUDP.Store(tt.truncateUDP)
+			client, err := newDNSPTRClient(tt.servers)
+			if err != nil {
+				t.Fatalf("newDNSPTRClient() error = %v", err)
+			}
+			client.httpClient = dns.client
+			client.tlsConfig = dns.client.Transport.(*http.Transport).TLSClientConfig
+			withPTRResolver(t, client.lookupPTR)
+
+			if got := lookupToAddrTimed("198.51.100.10"); !reflect.DeepEqual(got, []string{"edge.example.net"}) {
+				t.Fatalf("lookupToAddrTimed(v4) = %v", got)
+			}
+			if got := lookupToAddrTimed("2001:db8::1"); !reflect.DeepEqual(got, []string{"v6.example.net"}) {
+				t.Fatalf("lookupToAddrTimed(v6) = %v", got)
 			}
-			found := false
-			for _, n := range names {
-				if strings.Contains(strings.ToLower(n), tt.want) {
-					found = true
-					break
+			if got := lookupToAddrTimed("198.51.100.99"); got != nil {
+				t.Fatalf("lookupToAddrTimed(NXDOMAIN) = %v, want nil", got)
+			}
+			if ptrLookups.failures.Load() != 0 {
+				t.Fatalf("failures = %d, want 0", ptrLookups.failures.Load())
+			}
+		})
+	}
+}
+
+func TestLookupToAddrTimed_Off(t *testing.T) {
+	dns := startFakeDNS(t, map[string]string{"198.51.100.10": "edge.example.net."})
+	resolve, err := newPTRResolveFunc(ptrResolverOff, dns.addr)
+	if err != nil {
+		t.Fatalf("newPTRResolveFunc() error = %v", err)
+	}
+	withPTRResolver(t, resolve)
+
+	if got := lookupToAddrTimed("198.51.100.10"); got != nil {
+		t.Fatalf("lookupToAddrTimed() = %v, want nil with lookups off", got)
+	}
+	if n := dns.queries.Load(); n != 0 {
+		t.Fatalf("queries = %d, want 0", n)
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    dnsServer
+		wantErr bool
+	}{
+		{raw: "1.1.1.1", want: dnsServer{network: "udp", addr: "1.1.1.1:53"}},
+		{raw: "10.0.0.2:5353", want: dnsServer{network: "udp", addr: "10.0.0.2:5353"}},
+		{raw: "tcp://10.0.0.2", want: dnsServer{network: "tcp", addr: "10.0.0.2:53"}},
+		{raw: "tls://dns.google", want: dnsServer{network: "tls", addr: "dns.google:853"}},
+		{raw: "udp://2001:db8::53", want: dnsServer{network: "udp", addr: "[2001:db8::53]:53"}},
+		{raw: "https://cloudflare-dns.com/dns-query", want: dnsServer{network: "https", addr: "https://cloudflare-dns.com/dns-query"}},
+		{raw: "quic://dns.example", wantErr: true},
+		{raw: "tcp://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseDNSServer(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseDNSServer() = %+v, want error", got)
 				}
+				return
 			}
-			if !found {
-				t.Fatalf("lookupToAddrTimed(%s)=%v, want a name containing %q", tt.ip, names, tt.want)
+			if err != nil || got != tt.want {
+				t.Fatalf("parseDNSServer() = %+v, %v, want %+v", got, err, tt.want)
 			}
 		})
 	}
 }
+
+func TestNewPTRResolveFunc_Invalid(t *testing.T) {
+	for _, tt := range []struct{ kind, servers string }{
+		{kind: "dnscrypt", servers: defaultPTRDNSServers},
+		{kind: ptrResolverDNS, servers: ""},
+		{kind: ptrResolverDNS, servers: "ftp://dns.example"},
+	} {
+		if _, err := newPTRResolveFunc(tt.kind, tt.servers); err == nil {
+			t.Errorf("newPTRResolveFunc(%q, %q) error = nil, want error", tt.kind, tt.servers)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The regexps scanXrayLine replaced, kept as the reference it must agree with.
+var (
+	xrayLogFormat      = regexp.MustCompile(`^(?P<datetime>\S+\s+\S+)\s*?(from\s)?(?P<from>\S+)\s+(?P<status>\S+)\s+(?P<to>\S+)(?:\s+\[(?P<route>.*?)\])?(?:\s+email:\s+(?P<email>\S+))?$`)
+	xrayRejectedFormat = regexp.MustCompile(`^(?P<datetime>\S+\s+\S+)\s*?(from\s)?(?P<from>\S+)\s+(?P<status>rejected)\s{2,}(?P<reason>.+?)(?:\s+email:\s+(?P<email>\S+))?$`)
+	routeArrowRegex    = regexp.MustCompile(`\s*(?:==>|->|>>)\s*`)
+)
+
+func matchXrayLogRegex(line string) (lineFields, bool) {
+	for _, format := range []*regexp.Regexp{xrayRejectedFormat, xrayLogFormat} {
+		match := format.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		groups := make(map[string]string, len(match))
+		for i, name := range format.SubexpNames() {
+			if i > 0 && name != "" {
+				groups[name] = match[i]
+			}
+		}
+		return fieldsFromGroups(groups), true
+	}
+	return lineFields{}, false
+}
+
+func parseWith(match func(string) (lineFields, bool), line string) (*LogEntry, error) {
+	fields, ok := match(line)
+	if !ok {
+		return nil, errors.New("no match")
+	}
+	return newLogEntry(fields, time.UTC, "")
+}
+
+var scanSeedLines = []string{
+	`2026/03/11 14:22:07.918304 from 203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`,
+	`2026/03/11 14:22:08.001122 from 198.51.100.14:29104 accepted tcp:probe.example-cdn.net:443 [PROXY_EDGE_42 -> DIRECT] email: 8831`,
+	`2026/03/11 14:22:08.044901 from tcp:[2001:db8::1]:61990 accepted udp:[2001:db8::53]:53 [IN ==> BALANCER -> OUT_B] email: a@b.c`,
+	`2026/03/11 14:22:09.100000 203.0.113.9:1 accepted tcp:alpha.example:443`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 [IN >> DIRECT]`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 email: 7`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected  proxy/vless/encoding: invalid request version email: 7`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected  common/drain: drained connection > unexpected EOF`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected   `,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected tcp:alpha.example:443 [IN >> BLOCK]`,
+	`2026/03/11 14:22:09 from 203.0.113.9:1 accepted tcp:alpha.example:443 [a [b] c] email: x]`,
+	"2026/03/11\t14:22:09.100000  from\t203.0.113.9:1   accepted\ttcp:alpha.example:443 [IN\n>> DIRECT]",
+	`2026/03/11 14:22:09.100000from 203.0.113.9:1 accepted tcp:alpha.example:443`,
+	`2026/03/11 14:22:09.100000 from  203.0.113.9:1 accepted tcp:alpha.example:443`,
+	`2026/03/11 14:22:09.100000 from rejected  reason`,
+	`2026/03/11 14:22:09.100000 accepted tcp:alpha.example:443`,
+	` 2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 [`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 [ 0`,
+	`2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 [a] b] email: c] email: d`,
+	"2026/03/11 14:22:09.100000 from 203.0.113.9:1 accepted tcp:alpha.example:443 [a]\temail:\nx",
+	"2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected  \n email: x",
+	"2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected   email:\nx",
+	"2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected  a\nb email: x",
+	"2026/03/11 14:22:09.100000 from 203.0.113.9:1 rejected  \t\n ",
+}
+
+func FuzzScanXrayLine(f *testing.F) {
+	for _, line := range scanSeedLines {
+		f.Add(line)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		want, wantErr := parseWith(matchXrayLogRegex, line)
+		got, gotErr := parseWith(scanXrayLine, line)
+		if (gotErr == nil) != (wantErr == nil) || !reflect.DeepEqual(got, want) {
+			t.Fatalf("line %q\n scanner: %+v, %v\n  regexp: %+v, %v", line, got, gotErr, want, wantErr)
+		}
+
+		if got, want := normalizeRoute(line), routeArrowRegex.ReplaceAllString(line, " - "); got != want {
+			t.Fatalf("normalizeRoute(%q) = %q, want %q", line, got, want)
+		}
+	})
+}
+
+func BenchmarkParseXrayLine(b *testing.B) {
+	line := `2026/03/11 14:22:08.001122 from 198.51.100.14:29104 accepted tcp:probe.example-cdn.net:443 [PROXY_EDGE_42 -> DIRECT] email: 8831`
+	for _, bm := range []struct {
+		name  string
+		match func(string) (lineFields, bool)
+	}{
+		{name: "regexp", match: matchXrayLogRegex},
+		{name: "scanner", match: scanXrayLine},
+	} {
+		b.Run(bm.name+"/match", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, ok := bm.match(line); !ok {
+					b.Fatal("no match")
+				}
+			}
+		})
+		b.Run(bm.name+"/entry", func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := parseWith(bm.match, line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParseXrayLine_ManyBrackets covers a route with many `]`, which
+// must not make the scanner quadratic.
+func BenchmarkParseXrayLine_ManyBrackets(b *testing.B) {
+	line := `2026/03/11 14:22:08.001122 from 198.51.100.14:29104 accepted tcp:probe.example-cdn.net:443 [` +
+		strings.Repeat("a] email: b ", 2000) + `DIRECT] email: 8831`
+	for _, bm := range []struct {
+		name  string
+		match func(string) (lineFields, bool)
+	}{
+		{name: "regexp", match: matchXrayLogRegex},
+		{name: "scanner", match: scanXrayLine},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, ok := bm.match(line); !ok {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkParseXrayLine_RejectedLongSpaces covers a rejected line whose
+// reason has a long run of spaces, which must not make the scanner
+// quadratic.
+func BenchmarkParseXrayLine_RejectedLongSpaces(b *testing.B) {
+	line := `2026/03/11 14:22:08.001122 from 198.51.100.14:29104 rejected  proxy/vless: invalid` +
+		strings.Repeat(" ", 20000) + `request email: 8831`
+	for _, bm := range []struct {
+		name  string
+		match func(string) (lineFields, bool)
+	}{
+		{name: "regexp", match: matchXrayLogRegex},
+		{name: "scanner", match: scanXrayLine},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, ok := bm.match(line); !ok {
+					b.Fatal("no match")
+				}
+			}
+		})
+	}
+}
@@ -16,209 +16,235 @@ func TestParseLog_AcceptedTrafficShapes(t *testing.T) {
 			name: "tcp ipv4 dest with >> route arrow",
 			line: `2026/03/11 14:22:07.918304 from 203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:07.918304",
-				FromProto: "",
-				FromIP:    "203.0.113.47",
-				FromPort:  4821,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.88",
-				DestPort:  443,
-				Route:     "IN_TCP_XTLS_A7 - DIRECT",
-				Email:     "1204",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:07.918304",
+				FromProto:   "",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.88",
+				DestPort:    443,
+				Route:       "IN_TCP_XTLS_A7 - DIRECT",
+				InboundTag:  "IN_TCP_XTLS_A7",
+				OutboundTag: "DIRECT",
+				Email:       "1204",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp domain dest with -> route arrow",
 			line: `2026/03/11 14:22:08.001122 from 198.51.100.14:29104 accepted tcp:probe.example-cdn.net:443 [PROXY_EDGE_42 -> DIRECT] email: 8831`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.001122",
-				FromIP:    "198.51.100.14",
-				FromPort:  29104,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "probe.example-cdn.net",
-				DestPort:  443,
-				Route:     "PROXY_EDGE_42 - DIRECT",
-				Email:     "8831",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.001122",
+				FromIP:      "198.51.100.14",
+				FromPort:    29104,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "probe.example-cdn.net",
+				DestPort:    443,
+				Route:       "PROXY_EDGE_42 - DIRECT",
+				InboundTag:  "PROXY_EDGE_42",
+				OutboundTag: "DIRECT",
+				Email:       "8831",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp nested domain dest with >> route arrow",
 			line: `2026/03/11 14:22:08.044901 from 203.0.113.201:61990 accepted tcp:edge.cdn.widgets.test:443 [GW_REALITY_NOFLOW >> DIRECT] email: 4410`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.044901",
-				FromIP:    "203.0.113.201",
-				FromPort:  61990,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "edge.cdn.widgets.test",
-				DestPort:  443,
-				Route:     "GW_REALITY_NOFLOW - DIRECT",
-				Email:     "4410",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.044901",
+				FromIP:      "203.0.113.201",
+				FromPort:    61990,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "edge.cdn.widgets.test",
+				DestPort:    443,
+				Route:       "GW_REALITY_NOFLOW - DIRECT",
+				InboundTag:  "GW_REALITY_NOFLOW",
+				OutboundTag: "DIRECT",
+				Email:       "4410",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp short domain with from_port 0",
 			line: `2026/03/11 14:22:08.102557 from 192.0.2.77:0 accepted tcp:alpha.example:443 [HU_PLAIN_IN >> DIRECT] email: 902`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.102557",
-				FromIP:    "192.0.2.77",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "alpha.example",
-				DestPort:  443,
-				Route:     "HU_PLAIN_IN - DIRECT",
-				Email:     "902",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.102557",
+				FromIP:      "192.0.2.77",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Route:       "HU_PLAIN_IN - DIRECT",
+				InboundTag:  "HU_PLAIN_IN",
+				OutboundTag: "DIRECT",
+				Email:       "902",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp long domain with from_port 0",
 			line: `2026/03/11 14:22:08.118430 from 192.0.2.77:0 accepted tcp:ads.tracker.media-lab.example:443 [HU_PLAIN_IN >> DIRECT] email: 902`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.118430",
-				FromIP:    "192.0.2.77",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "ads.tracker.media-lab.example",
-				DestPort:  443,
-				Route:     "HU_PLAIN_IN - DIRECT",
-				Email:     "902",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.118430",
+				FromIP:      "192.0.2.77",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "ads.tracker.media-lab.example",
+				DestPort:    443,
+				Route:       "HU_PLAIN_IN - DIRECT",
+				InboundTag:  "HU_PLAIN_IN",
+				OutboundTag: "DIRECT",
+				Email:       "902",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "udp dns ipv4 dest with from_port 0",
 			line: `2026/03/11 14:22:08.155812 from 203.0.113.9:0 accepted udp:9.9.9.9:53 [IN_UDP_FAST_9 >> DIRECT] email: 7712`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.155812",
-				FromIP:    "203.0.113.9",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "9.9.9.9",
-				DestPort:  53,
-				Route:     "IN_UDP_FAST_9 - DIRECT",
-				Email:     "7712",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.155812",
+				FromIP:      "203.0.113.9",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "9.9.9.9",
+				DestPort:    53,
+				Route:       "IN_UDP_FAST_9 - DIRECT",
+				InboundTag:  "IN_UDP_FAST_9",
+				OutboundTag: "DIRECT",
+				Email:       "7712",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp ipv4 dest high source port",
 			line: `2026/03/11 14:22:08.188001 from 198.51.100.221:50441 accepted tcp:203.0.113.66:443 [NODE_B3_TLS >> DIRECT] email: 5560`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.188001",
-				FromIP:    "198.51.100.221",
-				FromPort:  50441,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "203.0.113.66",
-				DestPort:  443,
-				Route:     "NODE_B3_TLS - DIRECT",
-				Email:     "5560",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.188001",
+				FromIP:      "198.51.100.221",
+				FromPort:    50441,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "203.0.113.66",
+				DestPort:    443,
+				Route:       "NODE_B3_TLS - DIRECT",
+				InboundTag:  "NODE_B3_TLS",
+				OutboundTag: "DIRECT",
+				Email:       "5560",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp subdomain with hyphenated labels",
 			line: `2026/03/11 14:22:08.201774 from 192.0.2.19:13440 accepted tcp:metrics-stage.app-lab.io:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 3398`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.201774",
-				FromIP:    "192.0.2.19",
-				FromPort:  13440,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "metrics-stage.app-lab.io",
-				DestPort:  443,
-				Route:     "IN_TCP_XTLS_A7 - DIRECT",
-				Email:     "3398",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.201774",
+				FromIP:      "192.0.2.19",
+				FromPort:    13440,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "metrics-stage.app-lab.io",
+				DestPort:    443,
+				Route:       "IN_TCP_XTLS_A7 - DIRECT",
+				InboundTag:  "IN_TCP_XTLS_A7",
+				OutboundTag: "DIRECT",
+				Email:       "3398",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "udp domain dest",
 			line: `2026/03/11 14:22:08.250001 from 203.0.113.40:53122 accepted udp:dns.resolver.example:53 [IN_UDP_A >> DIRECT] email: 1001`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.250001",
-				FromIP:    "203.0.113.40",
-				FromPort:  53122,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "dns.resolver.example",
-				DestPort:  53,
-				Route:     "IN_UDP_A - DIRECT",
-				Email:     "1001",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.250001",
+				FromIP:      "203.0.113.40",
+				FromPort:    53122,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "dns.resolver.example",
+				DestPort:    53,
+				Route:       "IN_UDP_A - DIRECT",
+				InboundTag:  "IN_UDP_A",
+				OutboundTag: "DIRECT",
+				Email:       "1001",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "dest_port 0 is valid and kept",
 			line: `2026/03/11 14:22:08.300112 from 192.0.2.11:9000 accepted tcp:alpha.example:0 [HU_PLAIN_IN >> DIRECT] email: 55`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.300112",
-				FromIP:    "192.0.2.11",
-				FromPort:  9000,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "alpha.example",
-				DestPort:  0,
-				Route:     "HU_PLAIN_IN - DIRECT",
-				Email:     "55",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.300112",
+				FromIP:      "192.0.2.11",
+				FromPort:    9000,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    0,
+				Route:       "HU_PLAIN_IN - DIRECT",
+				InboundTag:  "HU_PLAIN_IN",
+				OutboundTag: "DIRECT",
+				Email:       "55",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp ipv4 dest on port 80",
 			line: `2026/03/11 14:22:08.400001 from 198.51.100.205:49996 accepted tcp:203.0.113.32:80 [IN_REALITY_NOFLOW >> DIRECT] email: 50`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.400001",
-				FromIP:    "198.51.100.205",
-				FromPort:  49996,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "203.0.113.32",
-				DestPort:  80,
-				Route:     "IN_REALITY_NOFLOW - DIRECT",
-				Email:     "50",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.400001",
+				FromIP:      "198.51.100.205",
+				FromPort:    49996,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "203.0.113.32",
+				DestPort:    80,
+				Route:       "IN_REALITY_NOFLOW - DIRECT",
+				InboundTag:  "IN_REALITY_NOFLOW",
+				OutboundTag: "DIRECT",
+				Email:       "50",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp dest on push-style port 5223",
 			line: `2026/03/11 14:22:08.400002 from 192.0.2.145:45042 accepted tcp:198.51.100.160:5223 [IN_REALITY_NOFLOW >> DIRECT] email: 1201`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.400002",
-				FromIP:    "192.0.2.145",
-				FromPort:  45042,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.160",
-				DestPort:  5223,
-				Route:     "IN_REALITY_NOFLOW - DIRECT",
-				Email:     "1201",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.400002",
+				FromIP:      "192.0.2.145",
+				FromPort:    45042,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.160",
+				DestPort:    5223,
+				Route:       "IN_REALITY_NOFLOW - DIRECT",
+				InboundTag:  "IN_REALITY_NOFLOW",
+				OutboundTag: "DIRECT",
+				Email:       "1201",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp domain dest on port 5228",
 			line: `2026/03/11 14:22:08.400003 from 198.51.100.188:42621 accepted tcp:mtalk.example-cdn.net:5228 [IN_REALITY_NOFLOW >> DIRECT] email: 3952`,
 			want: LogEntry{
-				Datetime:  "2026-03-11 14:22:08.400003",
-				FromIP:    "198.51.100.188",
-				FromPort:  42621,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "mtalk.example-cdn.net",
-				DestPort:  5228,
-				Route:     "IN_REALITY_NOFLOW - DIRECT",
-				Email:     "3952",
-				ToAddr:    []string{},
+				Datetime:    "2026-03-11 14:22:08.400003",
+				FromIP:      "198.51.100.188",
+				FromPort:    42621,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "mtalk.example-cdn.net",
+				DestPort:    5228,
+				Route:       "IN_REALITY_NOFLOW - DIRECT",
+				InboundTag:  "IN_REALITY_NOFLOW",
+				OutboundTag: "DIRECT",
+				Email:       "3952",
+				ToAddr:      []string{},
 			},
 		},
 	}
@@ -281,80 +307,90 @@ func TestParseLog_RouteArrowNormalization(t *testing.T) {
 			name: ">> arrow to dash",
 			line: `2026/05/02 09:11:33.100001 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.100001",
-				FromIP:    "203.0.113.1",
-				FromPort:  1000,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "alpha.example",
-				DestPort:  443,
-				Route:     "IN_A - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.100001",
+				FromIP:      "203.0.113.1",
+				FromPort:    1000,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Route:       "IN_A - DIRECT",
+				InboundTag:  "IN_A",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "-> arrow to dash",
 			line: `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A -> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.100002",
-				FromIP:    "203.0.113.1",
-				FromPort:  1000,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "alpha.example",
-				DestPort:  443,
-				Route:     "IN_A - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.100002",
+				FromIP:      "203.0.113.1",
+				FromPort:    1000,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Route:       "IN_A - DIRECT",
+				InboundTag:  "IN_A",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "==> arrow to dash",
 			line: `2026/05/02 09:11:33.401220 from 203.0.113.18:7712 accepted tcp:198.51.100.40:443 [IN_LEGACY_X1 ==> OUT_DIRECT] email: 6401`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.401220",
-				FromIP:    "203.0.113.18",
-				FromPort:  7712,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.40",
-				DestPort:  443,
-				Route:     "IN_LEGACY_X1 - OUT_DIRECT",
-				Email:     "6401",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.401220",
+				FromIP:      "203.0.113.18",
+				FromPort:    7712,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.40",
+				DestPort:    443,
+				Route:       "IN_LEGACY_X1 - OUT_DIRECT",
+				InboundTag:  "IN_LEGACY_X1",
+				OutboundTag: "OUT_DIRECT",
+				Email:       "6401",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "route already uses dash left as-is",
 			line: `2026/05/02 09:11:33.455100 from 192.0.2.44:2201 accepted tcp:cache.cdn.example:443 [IN_TCP_A - DIRECT] email: 218`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.455100",
-				FromIP:    "192.0.2.44",
-				FromPort:  2201,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "cache.cdn.example",
-				DestPort:  443,
-				Route:     "IN_TCP_A - DIRECT",
-				Email:     "218",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.455100",
+				FromIP:      "192.0.2.44",
+				FromPort:    2201,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "cache.cdn.example",
+				DestPort:    443,
+				Route:       "IN_TCP_A - DIRECT",
+				InboundTag:  "IN_TCP_A",
+				OutboundTag: "DIRECT",
+				Email:       "218",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "route kept as whole string for later splitByString",
 			line: `2026/05/02 09:11:33.500001 from 192.0.2.1:1 accepted tcp:x.example:443 [TAG_IN >> TAG_OUT] email: 9`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.500001",
-				FromIP:    "192.0.2.1",
-				FromPort:  1,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "x.example",
-				DestPort:  443,
-				Route:     "TAG_IN - TAG_OUT",
-				Email:     "9",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.500001",
+				FromIP:      "192.0.2.1",
+				FromPort:    1,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "x.example",
+				DestPort:    443,
+				Route:       "TAG_IN - TAG_OUT",
+				InboundTag:  "TAG_IN",
+				OutboundTag: "TAG_OUT",
+				Email:       "9",
+				ToAddr:      []string{},
 			},
 		},
 	}
@@ -366,6 +402,76 @@ func TestParseLog_RouteArrowNormalization(t *testing.T) {
 	}
 }
 
+func TestParseLog_RouteTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		line        string
+		wantIn      string
+		wantOut     string
+		wantChain   []string
+		wantRouteIs string
+	}{
+		{
+			name:        "inbound and outbound",
+			line:        `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A >> DIRECT] email: 1`,
+			wantIn:      "IN_A",
+			wantOut:     "DIRECT",
+			wantRouteIs: "IN_A - DIRECT",
+		},
+		{
+			name:        "balancer chain keeps every hop",
+			line:        `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A >> BALANCER_EU -> OUT_DE_2] email: 1`,
+			wantIn:      "IN_A",
+			wantOut:     "OUT_DE_2",
+			wantChain:   []string{"IN_A", "BALANCER_EU", "OUT_DE_2"},
+			wantRouteIs: "IN_A - BALANCER_EU - OUT_DE_2",
+		},
+		{
+			name:        "detour chain of four",
+			line:        `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A >> CHAIN_1 >> CHAIN_2 >> DIRECT] email: 1`,
+			wantIn:      "IN_A",
+			wantOut:     "DIRECT",
+			wantChain:   []string{"IN_A", "CHAIN_1", "CHAIN_2", "DIRECT"},
+			wantRouteIs: "IN_A - CHAIN_1 - CHAIN_2 - DIRECT",
+		},
+		{
+			name:        "tags containing the normalized separator",
+			line:        `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN - EU ==> OUT - DE] email: 1`,
+			wantIn:      "IN - EU",
+			wantOut:     "OUT - DE",
+			wantRouteIs: "IN - EU - OUT - DE",
+		},
+		{
+			name:        "inbound only",
+			line:        `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 [IN_A] email: 1`,
+			wantIn:      "IN_A",
+			wantRouteIs: "IN_A",
+		},
+		{
+			name: "no route",
+			line: `2026/05/02 09:11:33.100002 from 203.0.113.1:1000 accepted tcp:alpha.example:443 email: 1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLog(tt.line)
+			if err != nil {
+				t.Fatalf("parseLog() error = %v", err)
+			}
+			if got.InboundTag != tt.wantIn || got.OutboundTag != tt.wantOut {
+				t.Fatalf("tags = %q/%q, want %q/%q", got.InboundTag, got.OutboundTag, tt.wantIn, tt.wantOut)
+			}
+			if !reflect.DeepEqual(got.RouteChain, tt.wantChain) {
+				t.Fatalf("RouteChain = %#v, want %#v", got.RouteChain, tt.wantChain)
+			}
+			if got.Route != tt.wantRouteIs {
+				t.Fatalf("Route = %q, want %q", got.Route, tt.wantRouteIs)
+			}
+		})
+	}
+}
+
 func TestParseLog_OptionalFields(t *testing.T) {
 	tests := []struct {
 		name string
@@ -376,16 +482,18 @@ func TestParseLog_OptionalFields(t *testing.T) {
 			name: "email omitted becomes empty string",
 			line: `2026/05/02 09:11:33.501880 from 198.51.100.90:15002 accepted tcp:api.service.example:443 [PROXY_EDGE_7 >> DIRECT]`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.501880",
-				FromIP:    "198.51.100.90",
-				FromPort:  15002,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "api.service.example",
-				DestPort:  443,
-				Route:     "PROXY_EDGE_7 - DIRECT",
-				Email:     "",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.501880",
+				FromIP:      "198.51.100.90",
+				FromPort:    15002,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "api.service.example",
+				DestPort:    443,
+				Route:       "PROXY_EDGE_7 - DIRECT",
+				InboundTag:  "PROXY_EDGE_7",
+				OutboundTag: "DIRECT",
+				Email:       "",
+				ToAddr:      []string{},
 			},
 		},
 		{
@@ -424,16 +532,18 @@ func TestParseLog_OptionalFields(t *testing.T) {
 			name: "from keyword omitted",
 			line: `2026/05/02 09:11:33.640330 198.51.100.33:9911 accepted tcp:gamma.example:443 [NODE_C9 >> DIRECT] email: 3555`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.640330",
-				FromIP:    "198.51.100.33",
-				FromPort:  9911,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "gamma.example",
-				DestPort:  443,
-				Route:     "NODE_C9 - DIRECT",
-				Email:     "3555",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.640330",
+				FromIP:      "198.51.100.33",
+				FromPort:    9911,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "gamma.example",
+				DestPort:    443,
+				Route:       "NODE_C9 - DIRECT",
+				InboundTag:  "NODE_C9",
+				OutboundTag: "DIRECT",
+				Email:       "3555",
+				ToAddr:      []string{},
 			},
 		},
 		{
@@ -456,32 +566,36 @@ func TestParseLog_OptionalFields(t *testing.T) {
 			name: "email as numeric string",
 			line: `2026/05/02 09:11:33.700001 from 192.0.2.2:2 accepted tcp:x.example:443 [A >> B] email: 42`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.700001",
-				FromIP:    "192.0.2.2",
-				FromPort:  2,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "x.example",
-				DestPort:  443,
-				Route:     "A - B",
-				Email:     "42",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.700001",
+				FromIP:      "192.0.2.2",
+				FromPort:    2,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "x.example",
+				DestPort:    443,
+				Route:       "A - B",
+				InboundTag:  "A",
+				OutboundTag: "B",
+				Email:       "42",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "email as address",
 			line: `2026/05/02 09:11:33.755902 from 192.0.2.130:4433 accepted tcp:portal.example:443 [HU_PLAIN_IN >> DIRECT] email: robin@example.com`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.755902",
-				FromIP:    "192.0.2.130",
-				FromPort:  4433,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "portal.example",
-				DestPort:  443,
-				Route:     "HU_PLAIN_IN - DIRECT",
-				Email:     "robin@example.com",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.755902",
+				FromIP:      "192.0.2.130",
+				FromPort:    4433,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "portal.example",
+				DestPort:    443,
+				Route:       "HU_PLAIN_IN - DIRECT",
+				InboundTag:  "HU_PLAIN_IN",
+				OutboundTag: "DIRECT",
+				Email:       "robin@example.com",
+				ToAddr:      []string{},
 			},
 		},
 	}
@@ -503,32 +617,108 @@ func TestParseLog_StatusVariants(t *testing.T) {
 			name: "accepted",
 			line: `2026/05/02 09:11:33.010001 from 203.0.113.10:10 accepted tcp:ok.example:443 [IN >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.010001",
-				FromIP:    "203.0.113.10",
-				FromPort:  10,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "ok.example",
-				DestPort:  443,
-				Route:     "IN - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.010001",
+				FromIP:      "203.0.113.10",
+				FromPort:    10,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "ok.example",
+				DestPort:    443,
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "rejected with destination shape",
 			line: `2026/05/02 09:11:33.700441 from 203.0.113.77:0 rejected tcp:blocked.example:443 [IN_TCP_B >> DIRECT] email: 912`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.700441",
-				FromIP:    "203.0.113.77",
-				FromPort:  0,
+				Datetime:    "2026-05-02 09:11:33.700441",
+				FromIP:      "203.0.113.77",
+				FromPort:    0,
+				Status:      "rejected",
+				DestProto:   "tcp",
+				DestHost:    "blocked.example",
+				DestPort:    443,
+				Route:       "IN_TCP_B - DIRECT",
+				InboundTag:  "IN_TCP_B",
+				OutboundTag: "DIRECT",
+				Email:       "912",
+				ToAddr:      []string{},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertParseLog(t, tt.line, tt.want)
+		})
+	}
+}
+
+func TestParseLog_RejectedWithReason(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want LogEntry
+	}{
+		{
+			name: "vless websocket close",
+			line: `2026/05/02 09:11:34.000001 from 192.0.2.10:0 rejected  proxy/vless/encoding: failed to read request version > websocket: close 1000 (normal)`,
+			want: LogEntry{
+				Datetime: "2026-05-02 09:11:34.000001",
+				FromIP:   "192.0.2.10",
+				FromPort: 0,
+				Status:   "rejected",
+				Reason:   "proxy/vless/encoding: failed to read request version > websocket: close 1000 (normal)",
+			},
+		},
+		{
+			name: "invalid user with tcp source",
+			line: `2026/05/02 09:11:34.100200 from tcp:203.0.113.99:51544 rejected  proxy/vless/encoding: invalid request user id`,
+			want: LogEntry{
+				Datetime:  "2026-05-02 09:11:34.100200",
+				FromProto: "tcp",
+				FromIP:    "203.0.113.99",
+				FromPort:  51544,
 				Status:    "rejected",
-				DestProto: "tcp",
-				DestHost:  "blocked.example",
-				DestPort:  443,
-				Route:     "IN_TCP_B - DIRECT",
-				Email:     "912",
-				ToAddr:    []string{},
+				Reason:    "proxy/vless/encoding: invalid request user id",
+			},
+		},
+		{
+			name: "single-word reason",
+			line: `2026/05/02 09:11:34.200300 from 198.51.100.3:443 rejected  EOF`,
+			want: LogEntry{
+				Datetime: "2026-05-02 09:11:34.200300",
+				FromIP:   "198.51.100.3",
+				FromPort: 443,
+				Status:   "rejected",
+				Reason:   "EOF",
+			},
+		},
+		{
+			name: "reason with email",
+			line: `2026/05/02 09:11:34.300400 from 198.51.100.3:1000 rejected  proxy/vmess/encoding: invalid user: VMessAEAD is enforced email: 77`,
+			want: LogEntry{
+				Datetime: "2026-05-02 09:11:34.300400",
+				FromIP:   "198.51.100.3",
+				FromPort: 1000,
+				Status:   "rejected",
+				Reason:   "proxy/vmess/encoding: invalid user: VMessAEAD is enforced",
+				Email:    "77",
+			},
+		},
+		{
+			name: "ipv6 source",
+			line: `2026/05/02 09:11:34.400500 from [2001:db8::7]:0 rejected  common/drain: drained connection > proxy/vless/encoding: invalid request version`,
+			want: LogEntry{
+				Datetime: "2026-05-02 09:11:34.400500",
+				FromIP:   "2001:db8::7",
+				FromPort: 0,
+				Status:   "rejected",
+				Reason:   "common/drain: drained connection > proxy/vless/encoding: invalid request version",
 			},
 		},
 	}
@@ -550,119 +740,133 @@ func TestParseLog_FromEndpointSplit(t *testing.T) {
 			name: "no proto prefix → empty from_proto",
 			line: `2026/05/02 09:11:33.880000 from 203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.880000",
-				FromProto: "",
-				FromIP:    "203.0.113.47",
-				FromPort:  4821,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.88",
-				DestPort:  443,
-				Route:     "IN - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.880000",
+				FromProto:   "",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.88",
+				DestPort:    443,
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp proto prefix stripped into from_proto",
 			line: `2026/05/02 09:11:33.880001 from tcp:203.0.113.47:4821 accepted tcp:198.51.100.88:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.880001",
-				FromProto: "tcp",
-				FromIP:    "203.0.113.47",
-				FromPort:  4821,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.88",
-				DestPort:  443,
-				Route:     "IN_TCP_XTLS_A7 - DIRECT",
-				Email:     "1204",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.880001",
+				FromProto:   "tcp",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.88",
+				DestPort:    443,
+				Route:       "IN_TCP_XTLS_A7 - DIRECT",
+				InboundTag:  "IN_TCP_XTLS_A7",
+				OutboundTag: "DIRECT",
+				Email:       "1204",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "udp proto prefix stripped into from_proto with from_port 0",
 			line: `2026/05/02 09:11:33.900112 from udp:192.0.2.77:0 accepted udp:9.9.9.9:53 [IN_UDP_FAST_9 >> DIRECT] email: 7712`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.900112",
-				FromProto: "udp",
-				FromIP:    "192.0.2.77",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "9.9.9.9",
-				DestPort:  53,
-				Route:     "IN_UDP_FAST_9 - DIRECT",
-				Email:     "7712",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.900112",
+				FromProto:   "udp",
+				FromIP:      "192.0.2.77",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "9.9.9.9",
+				DestPort:    53,
+				Route:       "IN_UDP_FAST_9 - DIRECT",
+				InboundTag:  "IN_UDP_FAST_9",
+				OutboundTag: "DIRECT",
+				Email:       "7712",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "from tcp prefix with udp dest",
 			line: `2026/05/02 09:11:33.910001 from tcp:203.0.113.45:44783 accepted udp:198.51.100.13:443 [IN_REALITY_NOFLOW >> DIRECT] email: 78`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.910001",
-				FromProto: "tcp",
-				FromIP:    "203.0.113.45",
-				FromPort:  44783,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "198.51.100.13",
-				DestPort:  443,
-				Route:     "IN_REALITY_NOFLOW - DIRECT",
-				Email:     "78",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.910001",
+				FromProto:   "tcp",
+				FromIP:      "203.0.113.45",
+				FromPort:    44783,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "198.51.100.13",
+				DestPort:    443,
+				Route:       "IN_REALITY_NOFLOW - DIRECT",
+				InboundTag:  "IN_REALITY_NOFLOW",
+				OutboundTag: "DIRECT",
+				Email:       "78",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "from tcp prefix port 0 with udp dest",
 			line: `2026/05/02 09:11:33.910002 from tcp:198.51.100.169:0 accepted udp:203.0.113.139:443 [IN_HU_DIRECT >> DIRECT] email: 851`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.910002",
-				FromProto: "tcp",
-				FromIP:    "198.51.100.169",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "203.0.113.139",
-				DestPort:  443,
-				Route:     "IN_HU_DIRECT - DIRECT",
-				Email:     "851",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.910002",
+				FromProto:   "tcp",
+				FromIP:      "198.51.100.169",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "203.0.113.139",
+				DestPort:    443,
+				Route:       "IN_HU_DIRECT - DIRECT",
+				InboundTag:  "IN_HU_DIRECT",
+				OutboundTag: "DIRECT",
+				Email:       "851",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "ipv6 from brackets stripped from from_ip",
 			line: `2026/05/02 09:11:33.820001 from [2001:db8::10]:4433 accepted tcp:alpha.example:443 [IN_V6 >> DIRECT] email: 77`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.820001",
-				FromProto: "",
-				FromIP:    "2001:db8::10",
-				FromPort:  4433,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "alpha.example",
-				DestPort:  443,
-				Route:     "IN_V6 - DIRECT",
-				Email:     "77",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.820001",
+				FromProto:   "",
+				FromIP:      "2001:db8::10",
+				FromPort:    4433,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Route:       "IN_V6 - DIRECT",
+				InboundTag:  "IN_V6",
+				OutboundTag: "DIRECT",
+				Email:       "77",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp proto plus ipv6 from",
 			line: `2026/05/02 09:11:33.830001 from tcp:[2001:db8::10]:4433 accepted tcp:[2001:db8::53]:443 [IN_V6 >> DIRECT] email: 77`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.830001",
-				FromProto: "tcp",
-				FromIP:    "2001:db8::10",
-				FromPort:  4433,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "2001:db8::53",
-				DestPort:  443,
-				Route:     "IN_V6 - DIRECT",
-				Email:     "77",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.830001",
+				FromProto:   "tcp",
+				FromIP:      "2001:db8::10",
+				FromPort:    4433,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "2001:db8::53",
+				DestPort:    443,
+				Route:       "IN_V6 - DIRECT",
+				InboundTag:  "IN_V6",
+				OutboundTag: "DIRECT",
+				Email:       "77",
+				ToAddr:      []string{},
 			},
 		},
 	}
@@ -684,114 +888,128 @@ func TestParseLog_ToEndpointSplit(t *testing.T) {
 			name: "tcp ipv4 dest",
 			line: `2026/05/02 09:11:33.010001 from 203.0.113.1:1 accepted tcp:198.51.100.88:443 [IN >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.010001",
-				FromIP:    "203.0.113.1",
-				FromPort:  1,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "198.51.100.88",
-				DestPort:  443,
-				Route:     "IN - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.010001",
+				FromIP:      "203.0.113.1",
+				FromPort:    1,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "198.51.100.88",
+				DestPort:    443,
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "udp ipv4 dest",
 			line: `2026/05/02 09:11:33.010002 from 203.0.113.1:1 accepted udp:9.9.9.9:53 [IN >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.010002",
-				FromIP:    "203.0.113.1",
-				FromPort:  1,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "9.9.9.9",
-				DestPort:  53,
-				Route:     "IN - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.010002",
+				FromIP:      "203.0.113.1",
+				FromPort:    1,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "9.9.9.9",
+				DestPort:    53,
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "tcp domain dest",
 			line: `2026/05/02 09:11:33.010003 from 203.0.113.1:1 accepted tcp:probe.example-cdn.net:443 [IN >> DIRECT] email: 1`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.010003",
-				FromIP:    "203.0.113.1",
-				FromPort:  1,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "probe.example-cdn.net",
-				DestPort:  443,
-				Route:     "IN - DIRECT",
-				Email:     "1",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.010003",
+				FromIP:      "203.0.113.1",
+				FromPort:    1,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "probe.example-cdn.net",
+				DestPort:    443,
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+				Email:       "1",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "ipv6 destination brackets stripped from dest_host",
 			line: `2026/05/02 09:11:33.810227 from 198.51.100.8:12001 accepted tcp:[2001:db8::53]:443 [IN_V6_EDGE >> DIRECT] email: 4802`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.810227",
-				FromIP:    "198.51.100.8",
-				FromPort:  12001,
-				Status:    "accepted",
-				DestProto: "tcp",
-				DestHost:  "2001:db8::53",
-				DestPort:  443,
-				Route:     "IN_V6_EDGE - DIRECT",
-				Email:     "4802",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.810227",
+				FromIP:      "198.51.100.8",
+				FromPort:    12001,
+				Status:      "accepted",
+				DestProto:   "tcp",
+				DestHost:    "2001:db8::53",
+				DestPort:    443,
+				Route:       "IN_V6_EDGE - DIRECT",
+				InboundTag:  "IN_V6_EDGE",
+				OutboundTag: "DIRECT",
+				Email:       "4802",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "udp ipv6 destination brackets stripped",
 			line: `2026/05/02 09:11:33.840001 from 192.0.2.9:0 accepted udp:[2001:db8::53]:53 [IN_UDP_V6 >> DIRECT] email: 3`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.840001",
-				FromIP:    "192.0.2.9",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "udp",
-				DestHost:  "2001:db8::53",
-				DestPort:  53,
-				Route:     "IN_UDP_V6 - DIRECT",
-				Email:     "3",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.840001",
+				FromIP:      "192.0.2.9",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "udp",
+				DestHost:    "2001:db8::53",
+				DestPort:    53,
+				Route:       "IN_UDP_V6 - DIRECT",
+				InboundTag:  "IN_UDP_V6",
+				OutboundTag: "DIRECT",
+				Email:       "3",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "dest without proto → empty dest_proto",
 			line: `2026/05/02 09:11:33.910002 from 198.51.100.169:0 accepted 203.0.113.139:443 [IN_HU_DIRECT >> DIRECT] email: 851`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.910002",
-				FromProto: "",
-				FromIP:    "198.51.100.169",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "",
-				DestHost:  "203.0.113.139",
-				DestPort:  443,
-				Route:     "IN_HU_DIRECT - DIRECT",
-				Email:     "851",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.910002",
+				FromProto:   "",
+				FromIP:      "198.51.100.169",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "",
+				DestHost:    "203.0.113.139",
+				DestPort:    443,
+				Route:       "IN_HU_DIRECT - DIRECT",
+				InboundTag:  "IN_HU_DIRECT",
+				OutboundTag: "DIRECT",
+				Email:       "851",
+				ToAddr:      []string{},
 			},
 		},
 		{
 			name: "from tcp prefix and dest without proto",
 			line: `2026/05/02 09:11:33.910002 from tcp:198.51.100.169:0 accepted 203.0.113.139:443 [IN_HU_DIRECT >> DIRECT] email: 851`,
 			want: LogEntry{
-				Datetime:  "2026-05-02 09:11:33.910002",
-				FromProto: "tcp",
-				FromIP:    "198.51.100.169",
-				FromPort:  0,
-				Status:    "accepted",
-				DestProto: "",
-				DestHost:  "203.0.113.139",
-				DestPort:  443,
-				Route:     "IN_HU_DIRECT - DIRECT",
-				Email:     "851",
-				ToAddr:    []string{},
+				Datetime:    "2026-05-02 09:11:33.910002",
+				FromProto:   "tcp",
+				FromIP:      "198.51.100.169",
+				FromPort:    0,
+				Status:      "accepted",
+				DestProto:   "",
+				DestHost:    "203.0.113.139",
+				DestPort:    443,
+				Route:       "IN_HU_DIRECT - DIRECT",
+				InboundTag:  "IN_HU_DIRECT",
+				OutboundTag: "DIRECT",
+				Email:       "851",
+				ToAddr:      []string{},
 			},
 		},
 	}
@@ -809,8 +1027,8 @@ func TestParseLog_RejectsUnparseable(t *testing.T) {
 		line string
 	}{
 		{
-			name: "rejected without tcp/udp destination",
-			line: `2026/05/02 09:11:34.000001 from 192.0.2.10:0 rejected  proxy/vless/encoding: failed to read request version > websocket: close 1000 (normal)`,
+			name: "rejected with a single space and no destination",
+			line: `2026/05/02 09:11:34.000001 from 192.0.2.10:0 rejected proxy/vless/encoding: failed to read request version`,
 		},
 		{
 			name: "empty line",
@@ -824,6 +1042,10 @@ func TestParseLog_RejectsUnparseable(t *testing.T) {
 			name: "only datetime",
 			line: `2026/05/02 09:11:34.000001`,
 		},
+		{
+			name: "timestamp in no known Xray layout",
+			line: `02.05.2026 09:11:34 from 203.0.113.1:1 accepted tcp:alpha.example:443 [IN >> DIRECT] email: 1`,
+		},
 		{
 			name: "from_ip is not a valid IP",
 			line: `2026/05/02 09:11:34.100001 from not-an-ip:4433 accepted tcp:alpha.example:443 [IN >> DIRECT] email: 1`,
@@ -857,7 +1079,7 @@ func TestParseLog_JSONContract(t *testing.T) {
 			t.Fatalf("json.Marshal() error = %v", err)
 		}
 
-		want := `{"datetime":"2026-05-02 09:11:33.880001","email":"1204","from_proto":"tcp","from_ip":"203.0.113.47","from_port":4821,"dest_proto":"tcp","dest_host":"198.51.100.88","dest_port":443,"status":"accepted","route":"IN_TCP_XTLS_A7 - DIRECT","to_addr":[]}`
+		want := `{"datetime":"2026-05-02 09:11:33.880001","email":"1204","from_proto":"tcp","from_ip":"203.0.113.47","from_port":4821,"dest_proto":"tcp","dest_host":"198.51.100.88","dest_port":443,"status":"accepted","route":"IN_TCP_XTLS_A7 - DIRECT","inbound_tag":"IN_TCP_XTLS_A7","outbound_tag":"DIRECT","to_addr":[],"format":"xray"}`
 		if string(raw) != want {
 			t.Fatalf("JSON contract\n got: %s\nwant: %s", raw, want)
 		}
@@ -876,7 +1098,7 @@ func TestParseLog_JSONContract(t *testing.T) {
 			t.Fatalf("json.Marshal() error = %v", err)
 		}
 
-		want := `{"datetime":"2026-05-02 09:11:33.601102","email":"","from_proto":"","from_ip":"192.0.2.5","from_port":8080,"dest_proto":"tcp","dest_host":"beta.example","dest_port":443,"status":"accepted","route":"","to_addr":[]}`
+		want := `{"datetime":"2026-05-02 09:11:33.601102","email":"","from_proto":"","from_ip":"192.0.2.5","from_port":8080,"dest_proto":"tcp","dest_host":"beta.example","dest_port":443,"status":"accepted","route":"","inbound_tag":"","outbound_tag":"","to_addr":[],"format":"xray"}`
 		if string(raw) != want {
 			t.Fatalf("JSON contract\n got: %s\nwant: %s", raw, want)
 		}
@@ -901,6 +1123,24 @@ func TestParseLog_JSONContract(t *testing.T) {
 		}
 	})
 
+	t.Run("rejected line adds reason and keeps empty destination", func(t *testing.T) {
+		line := `2026/05/02 09:11:34.000001 from 192.0.2.10:0 rejected  proxy/vless/encoding: failed to read request version`
+		got, err := parseLog(line)
+		if err != nil {
+			t.Fatalf("parseLog() error = %v", err)
+		}
+
+		raw, err := json.Marshal(got)
+		if err != nil {
+			t.Fatalf("json.Marshal() error = %v", err)
+		}
+
+		want := `{"datetime":"2026-05-02 09:11:34.000001","email":"","from_proto":"","from_ip":"192.0.2.10","from_port":0,"dest_proto":"","dest_host":"","dest_port":0,"status":"rejected","route":"","inbound_tag":"","outbound_tag":"","to_addr":[],"reason":"proxy/vless/encoding: failed to read request version","format":"xray"}`
+		if string(raw) != want {
+			t.Fatalf("JSON contract\n got: %s\nwant: %s", raw, want)
+		}
+	})
+
 	t.Run("from_port 0 and dest_port 0 serialized as numbers", func(t *testing.T) {
 		line := `2026/05/02 09:11:33.700000 from 192.0.2.77:0 accepted tcp:alpha.example:0 [HU >> DIRECT] email: 1`
 		got, err := parseLog(line)
@@ -914,13 +1154,141 @@ func TestParseLog_JSONContract(t *testing.T) {
 			t.Fatalf("json.Marshal() error = %v", err)
 		}
 
-		want := `{"datetime":"2026-05-02 09:11:33.700000","email":"1","from_proto":"","from_ip":"192.0.2.77","from_port":0,"dest_proto":"tcp","dest_host":"alpha.example","dest_port":0,"status":"accepted","route":"HU - DIRECT","to_addr":[]}`
+		want := `{"datetime":"2026-05-02 09:11:33.700000","email":"1","from_proto":"","from_ip":"192.0.2.77","from_port":0,"dest_proto":"tcp","dest_host":"alpha.example","dest_port":0,"status":"accepted","route":"HU - DIRECT","inbound_tag":"HU","outbound_tag":"DIRECT","to_addr":[],"format":"xray"}`
 		if string(raw) != want {
 			t.Fatalf("JSON contract\n got: %s\nwant: %s", raw, want)
 		}
 	})
 }
 
+// TestParseLog_XrayReleaseCorpus is the regression corpus of access-line
+// shapes seen from different Xray (and v2ray) releases in the field. Add a
+// case here whenever a new release changes the line format.
+func TestParseLog_XrayReleaseCorpus(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want LogEntry
+	}{
+		{
+			name: "v2ray-core: no from prefix, second precision, single tag",
+			line: `2021/04/18 07:15:02 203.0.113.9:51432 accepted tcp:alpha.example:443 [proxy] email: alice@example.com`,
+			want: LogEntry{
+				Datetime:   "2021-04-18 07:15:02.000000",
+				Email:      "alice@example.com",
+				FromIP:     "203.0.113.9",
+				FromPort:   51432,
+				DestProto:  "tcp",
+				DestHost:   "alpha.example",
+				DestPort:   443,
+				Status:     "accepted",
+				Route:      "proxy",
+				InboundTag: "proxy",
+			},
+		},
+		{
+			name: "early Xray-core: second precision, no route",
+			line: `2022/01/09 18:40:11 from 203.0.113.9:51433 accepted udp:1.1.1.1:53 email: 7`,
+			want: LogEntry{
+				Datetime:  "2022-01-09 18:40:11.000000",
+				Email:     "7",
+				FromIP:    "203.0.113.9",
+				FromPort:  51433,
+				DestProto: "udp",
+				DestHost:  "1.1.1.1",
+				DestPort:  53,
+				Status:    "accepted",
+			},
+		},
+		{
+			name: "Xray-core 1.x: second precision, -> route",
+			line: `2025/02/01 22:33:25 from tcp:203.0.113.9:51434 accepted tcp:alpha.example:443 [VLESS_IN -> DIRECT] email: 12`,
+			want: LogEntry{
+				Datetime:    "2025-02-01 22:33:25.000000",
+				Email:       "12",
+				FromProto:   "tcp",
+				FromIP:      "203.0.113.9",
+				FromPort:    51434,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "VLESS_IN - DIRECT",
+				InboundTag:  "VLESS_IN",
+				OutboundTag: "DIRECT",
+			},
+		},
+		{
+			name: "Xray-core 1.x: second precision, rejected with reason",
+			line: `2025/02/01 22:33:26 from 203.0.113.9:0 rejected  proxy/vless/encoding: invalid request version`,
+			want: LogEntry{
+				Datetime: "2025-02-01 22:33:26.000000",
+				FromIP:   "203.0.113.9",
+				Status:   "rejected",
+				Reason:   "proxy/vless/encoding: invalid request version",
+			},
+		},
+		{
+			name: "current Xray-core: microseconds, >> route",
+			line: `2026/03/11 14:22:07.918304 from 203.0.113.47:4821 accepted tcp:alpha.example:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`,
+			want: LogEntry{
+				Datetime:    "2026-03-11 14:22:07.918304",
+				Email:       "1204",
+				FromIP:      "203.0.113.47",
+				FromPort:    4821,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "IN_TCP_XTLS_A7 - DIRECT",
+				InboundTag:  "IN_TCP_XTLS_A7",
+				OutboundTag: "DIRECT",
+			},
+		},
+		{
+			name: "current Xray-core: microseconds, balancer chain, ipv6 client",
+			line: `2026/03/11 14:22:08.000100 from [2001:db8::7]:40000 accepted tcp:alpha.example:443 [IN_A >> BALANCER_EU -> OUT_DE_2] email: 88`,
+			want: LogEntry{
+				Datetime:    "2026-03-11 14:22:08.000100",
+				Email:       "88",
+				FromIP:      "2001:db8::7",
+				FromPort:    40000,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "IN_A - BALANCER_EU - OUT_DE_2",
+				InboundTag:  "IN_A",
+				OutboundTag: "OUT_DE_2",
+				RouteChain:  []string{"IN_A", "BALANCER_EU", "OUT_DE_2"},
+			},
+		},
+		{
+			name: "millisecond precision from patched builds",
+			line: `2026/03/11 14:22:09.123 from 203.0.113.47:4822 accepted tcp:alpha.example:443 [IN >> DIRECT] email: 5`,
+			want: LogEntry{
+				Datetime:    "2026-03-11 14:22:09.123000",
+				Email:       "5",
+				FromIP:      "203.0.113.47",
+				FromPort:    4822,
+				DestProto:   "tcp",
+				DestHost:    "alpha.example",
+				DestPort:    443,
+				Status:      "accepted",
+				Route:       "IN - DIRECT",
+				InboundTag:  "IN",
+				OutboundTag: "DIRECT",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertParseLog(t, tt.line, tt.want)
+		})
+	}
+}
+
 func assertParseLog(t *testing.T, line string, want LogEntry) {
 	t.Helper()
 
@@ -935,6 +1303,10 @@ func assertParseLog(t *testing.T, line string, want LogEntry) {
 	if want.ToAddr == nil {
 		want.ToAddr = []string{}
 	}
+	// Fixtures are lines in the built-in shapes unless they name a format.
+	if want.Format == "" {
+		want.Format = xrayFormatName
+	}
 
 	if !reflect.DeepEqual(*got, want) {
 		t.Fatalf("parseLog()\n got: %+v\nwant: %+v", *got, want)
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var PTR_CACHE_SIZE = getEnvInt("PTR_CACHE_SIZE", 10000)
+var PTR_CACHE_MAX_TTL = getEnvDuration("PTR_CACHE_MAX_TTL", time.Hour)
+var PTR_NEGATIVE_TTL = getEnvDuration("PTR_NEGATIVE_TTL", 5*time.Minute)
+
+const (
+	// ptrCacheMinTTL keeps TTL-0 answers from defeating the cache.
+	ptrCacheMinTTL = 10 * time.Second
+	// ptrFailureTTL is how long a timeout or server failure is cached;
+	// shorter than PTR_NEGATIVE_TTL as the next query may well succeed.
+	ptrFailureTTL = 30 * time.Second
+	// dnsUDPSize is the largest UDP response accepted; bigger answers come
+	// back truncated and are retried over TCP.
+	dnsUDPSize            = 1232
+	dnsMessageContentType = "application/dns-message"
+)
+
+// Reverse lookup backends selectable with PTR_RESOLVER.
+const (
+	ptrResolverDNS    = "dns"
+	ptrResolverSystem = "system"
+	ptrResolverOff    = "off"
+)
+
+// defaultPTRDNSServers are used unless PTR_DNS_SERVERS is set (Cloudflare,
+// Google).
+const defaultPTRDNSServers = "1.1.1.1:53,1.0.0.1:53,8.8.8.8:53,8.8.4.4:53"
+
+var PTR_RESOLVER = getEnv("PTR_RESOLVER", ptrResolverDNS)
+var PTR_DNS_SERVERS = getEnv("PTR_DNS_SERVERS", defaultPTRDNSServers)
+
+// ptrLookups caches reverse lookups. It starts out with the default servers;
+// loadPTRConfig swaps in the configured resolver.
+var ptrLookups = newPTRCache(PTR_CACHE_SIZE, mustDNSPTRClient(defaultPTRDNSServers).lookupPTR)
+
+// ptrResolveFunc returns the PTR names of ip and how long they may be
+// cached, or ptrTTLUnknown. No names and a nil error mean the address has no
+// PTR record.
+type ptrResolveFunc func(ctx context.Context, ip net.IP) ([]string, time.Duration, error)
+
+// ptrTTLUnknown marks answers from resolvers that do not expose TTLs; the
+// cache then applies its own bounds.
+const ptrTTLUnknown time.Duration = -1
+
+// loadPTRConfig resolves PTR_RESOLVER and PTR_DNS_SERVERS; called once from
+// main before any ingest starts.
+func loadPTRConfig() error {
+	resolve, err := newPTRResolveFunc(PTR_RESOLVER, PTR_DNS_SERVERS)
+	if err != nil {
+		return err
+	}
+	ptrLookups.resolve = resolve
+	return nil
+}
+
+func newPTRResolveFunc(kind, servers string) (ptrResolveFunc, error) {
+	switch kind {
+	case ptrResolverOff:
+		return nil, nil
+	case ptrResolverSystem:
+		return lookupSystemPTR, nil
+	case ptrResolverDNS:
+		client, err := newDNSPTRClient(servers)
+		if err != nil {
+			return nil, fmt.Errorf("PTR_DNS_SERVERS: %w", err)
+		}
+		return client.lookupPTR, nil
+	default:
+		return nil, fmt.Errorf("PTR_RESOLVER must be %q, %q or %q, got %q",
+			ptrResolverDNS, ptrResolverSystem, ptrResolverOff, kind)
+	}
+}
+
+// lookupSystemPTR uses the system resolver, which does not report TTLs.
+func lookupSystemPTR(ctx context.Context, ip net.IP) ([]string, time.Duration, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, ptrTTLUnknown, nil
+	}
+	return names, ptrTTLUnknown, err
+}
+
+// dnsServer is one entry of PTR_DNS_SERVERS: "host[:port]" or
+// "udp://host[:port]" (port 53), "tcp://host[:port]" (53),
+// "tls://host[:port]" for DNS-over-TLS (853) or an https:// URL for
+// DNS-over-HTTPS.
+type dnsServer struct {
+	network string // "udp", "tcp", "tls" or "https"
+	addr    string // host:port, or the URL for https
+}
+
+func parseDNSServer(raw string) (dnsServer, error) {
+	if strings.HasPrefix(raw, "https://") {
+		if _, err := url.ParseRequestURI(raw); err != nil {
+			return dnsServer{}, err
+		}
+		return dnsServer{network: "https", addr: raw}, nil
+	}
+
+	network, host := "udp", raw
+	if scheme, rest, ok := strings.Cut(raw, "://"); ok {
+		network, host = scheme, rest
+	}
+	port := "53"
+	switch network {
+	case "udp", "tcp":
+	case "tls":
+		port = "853"
+	default:
+		return dnsServer{}, fmt.Errorf("unsupported DNS server %q", raw)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+	}
+	if h, _, _ := net.SplitHostPort(host); h == "" {
+		return dnsServer{}, fmt.Errorf("DNS server %q has no host", raw)
+	}
+	return dnsServer{network: network, addr: host}, nil
+}
+
+// dnsPTRClient sends PTR queries to DNS servers itself, rather than through
+// net.Resolver, so the record TTL is known. Servers are tried in order.
+type dnsPTRClient struct {
+	servers []dnsServer
+	// tlsConfig and httpClient are used for tls:// and https:// servers;
+	// nil means the system roots.
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+}
+
+func newDNSPTRClient(list string) (*dnsPTRClient, error) {
+	var servers []dnsServer
+	for _, raw := range splitList(list) {
+		server, err := parseDNSServer(raw)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no DNS servers")
+	}
+	return &dnsPTRClient{servers: servers, httpClient: http.DefaultClient}, nil
+}
+
+func mustDNSPTRClient(list string) *dnsPTRClient {
+	client, err := newDNSPTRClient(list)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+func (c *dnsPTRClient) lookupPTR(ctx context.Context, ip net.IP) ([]string, time.Duration, error) {
+	query, id, err := buildPTRQuery(ip)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var lastErr error
+	for _, server := range c.servers {
+		resp, err := c.exchange(ctx, server, query, id)
+		if err == nil {
+			return parsePTRResponse(resp)
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of ip.
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hex[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hex[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa.")
+	return b.String()
+}
+
+func buildPTRQuery(ip net.IP) ([]byte, uint16, error) {
+	name, err := dnsmessage.NewName(reverseName(ip))
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	return query, id, err
+}
+
+// exchange sends a query to one server. UDP answers that come back
+// truncated are fetched again over TCP.
+func (c *dnsPTRClient) exchange(ctx context.Context, server dnsServer, query []byte, id uint16) (*dnsmessage.Message, error) {
+	var raw []byte
+	var err error
+	switch server.network {
+	case "udp":
+		raw, err = exchangeDNSPacket(ctx, server.addr, query)
+	case "https":
+		raw, err = c.exchangeDNSHTTPS(ctx, server.addr, query)
+	default:
+		raw, err = c.exchangeDNSStream(ctx, server, query)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dns %s: %w", server.addr, err)
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, fmt.Errorf("dns %s: %w", server.addr, err)
+	}
+	if resp.ID != id || !resp.Response {
+		return nil, fmt.Errorf("dns %s: unexpected response", server.addr)
+	}
+	if resp.Truncated && server.network == "udp" {
+		return c.exchange(ctx, dnsServer{network: "tcp", addr: server.addr}, query, id)
+	}
+	return &resp, nil
+}
+
+func exchangeDNSPacket(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, dnsUDPSize)
+	n, err := conn.Read(raw)
+	if err != nil {
+		return nil, err
+	}
+	return raw[:n], nil
+}
+
+// exchangeDNSStream sends a length-prefixed query over TCP or TLS.
+func (c *dnsPTRClient) exchangeDNSStream(ctx context.Context, server dnsServer, query []byte) ([]byte, error) {
+	var conn net.Conn
+	var err error
+	if server.network == "tls" {
+		cfg := c.tlsConfig.Clone()
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(server.addr)
+		}
+		d := tls.Dialer{Config: cfg}
+		conn, err = d.DialContext(ctx, "tcp", server.addr)
+	} else {
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", server.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// exchangeDNSHTTPS posts a query as in RFC 8484.
+func (c *dnsPTRClient) exchangeDNSHTTPS(ctx context.Context, endpoint string, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageContentType)
+	req.Header.Set("Accept", dnsMessageContentType)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+}
+
+// parsePTRResponse returns the PTR names of a response with the lowest TTL
+// among them. NXDOMAIN and empty answers return no names with the negative
+// TTL from the SOA record (RFC 2308), or 0 for the cache default.
+func parsePTRResponse(resp *dnsmessage.Message) ([]string, time.Duration, error) {
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("dns: %s", resp.RCode)
+	}
+
+	var names []string
+	var ttl uint32
+	for _, answer := range resp.Answers {
+		ptr, ok := answer.Body.(*dnsmessage.PTRResource)
+		if !ok {
+			continue
+		}
+		if len(names) == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		names = append(names, ptr.PTR.String())
+	}
+	if len(names) > 0 {
+		return names, time.Duration(ttl) * time.Second, nil
+	}
+
+	for _, auth := range resp.Authorities {
+		if soa, ok := auth.Body.(*dnsmessage.SOAResource); ok {
+			return nil, time.Duration(min(auth.Header.TTL, soa.MinTTL)) * time.Second, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// ptrCache is a size-bounded LRU of reverse lookups. Answers are kept for
+// their record TTL (capped at maxTTL), addresses without a PTR record for
+// negativeTTL and failed lookups for ptrFailureTTL. Concurrent lookups of
+// one address share a single query. Queries are subject to limit; lookups
+// over budget return no names and are not cached, so a later line retries.
+type ptrCache struct {
+	maxEntries  int
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	resolve     ptrResolveFunc
+	limit       *ptrLimiter
+	now         func() time.Time
+
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	order    *list.List // front = most recently used
+	inflight map[string]*ptrFlight
+
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	merged    atomic.Uint64
+	failures  atomic.Uint64
+	evictions atomic.Uint64
+	// rateLimited and concurrencyLimited count lookups skipped because the
+	// PTR query budget was spent.
+	rateLimited        atomic.Uint64
+	concurrencyLimited atomic.Uint64
+}
+
+type ptrCacheItem struct {
+	key     string
+	names   []string
+	expires time.Time
+}
+
+// ptrFlight is a query in progress; waiters read names once done is closed.
+type ptrFlight struct {
+	done  chan struct{}
+	names []string
+}
+
+func newPTRCache(maxEntries int, resolve ptrResolveFunc) *ptrCache {
+	return &ptrCache{
+		maxEntries:  maxEntries,
+		maxTTL:      PTR_CACHE_MAX_TTL,
+		negativeTTL: PTR_NEGATIVE_TTL,
+		resolve:     resolve,
+		limit:       newPTRLimiter(PTR_RATE_LIMIT, PTR_RATE_BURST, PTR_MAX_INFLIGHT),
+		now:         time.Now,
+		items:       make(map[string]*list.Element),
+		order:       list.New(),
+		inflight:    make(map[string]*ptrFlight),
+	}
+}
+
+// lookup returns the PTR names of ip, trimmed by normalizeToAddr, or nil.
+// The returned slice is shared and must not be modified.
+func (c *ptrCache) lookup(ip net.IP) []string {
+	if c.resolve == nil {
+		return nil
+	}
+	key := ip.String()
+
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*ptrCacheItem)
+		if c.now().Before(item.expires) {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return item.names
+		}
+		c.removeLocked(el)
+	}
+	if flight, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		c.merged.Add(1)
+		<-flight.done
+		return flight.names
+	}
+	switch c.limit.acquire(c.now()) {
+	case ptrRateLimited:
+		c.mu.Unlock()
+		c.rateLimited.Add(1)
+		return nil
+	case ptrConcurrencyLimited:
+		c.mu.Unlock()
+		c.concurrencyLimited.Add(1)
+		return nil
+	}
+	flight := &ptrFlight{done: make(chan struct{})}
+	c.inflight[key] = flight
+	c.mu.Unlock()
+	c.misses.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+	names, ttl, err := c.resolve(ctx, ip)
+	cancel()
+	c.limit.release()
+	switch {
+	case err != nil:
+		c.failures.Add(1)
+		logDebug("PTR lookup %s failed: %v", key, err)
+		names, ttl = nil, ptrFailureTTL
+	case len(names) == 0:
+		if ttl <= 0 || ttl > c.negativeTTL {
+			ttl = c.negativeTTL
+		}
+	default:
+		names = normalizeToAddr(names)
+		if ttl == ptrTTLUnknown || ttl > c.maxTTL {
+			ttl = c.maxTTL
+		}
+	}
+	ttl = max(ttl, ptrCacheMinTTL)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	c.storeLocked(key, names, c.now().Add(ttl))
+	c.mu.Unlock()
+
+	flight.names = names
+	close(flight.done)
+	return names
+}
+
+// cached returns the cached PTR names of ip without sending a query, and
+// whether there was an unexpired answer. With lookups off it always reports
+// an empty answer.
+func (c *ptrCache) cached(ip net.IP) ([]string, bool) {
+	if c.resolve == nil {
+		return nil, true
+	}
+	key := ip.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok || !c.now().Before(el.Value.(*ptrCacheItem).expires) {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	return el.Value.(*ptrCacheItem).names, true
+}
+
+func (c *ptrCache) storeLocked(key string, names []string, expires time.Time) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	c.items[key] = c.order.PushFront(&ptrCacheItem{key: key, names: names, expires: expires})
+	for c.order.Len() > c.maxEntries {
+		c.removeLocked(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+func (c *ptrCache) removeLocked(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*ptrCacheItem).key)
+}
+
+// Len returns the number of cached addresses, expired ones included.
+func (c *ptrCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakePTRResolver answers from a table and counts queries per address.
+type fakePTRResolver struct {
+	mu      sync.Mutex
+	answers map[string][]string
+	ttl     time.Duration
+	err     error
+	queries map[string]int
+}
+
+func (r *fakePTRResolver) resolve(_ context.Context, ip net.IP) ([]string, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.queries == nil {
+		r.queries = make(map[string]int)
+	}
+	r.queries[ip.String()]++
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	return append([]string(nil), r.answers[ip.String()]...), r.ttl, nil
+}
+
+func (r *fakePTRResolver) count(ip string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[ip]
+}
+
+func TestPTRCache_HonoursTTL(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	resolver := &fakePTRResolver{answers: map[string][]string{"198.51.100.10": {"edge.example.net."}}, ttl: time.Minute}
+	c := newPTRCache(10, resolver.resolve)
+	c.now = clock.now
+	ip := net.ParseIP("198.51.100.10")
+
+	for i := 0; i < 3; i++ {
+		if got := c.lookup(ip); !reflect.DeepEqual(got, []string{"edge.example.net"}) {
+			t.Fatalf("lookup() = %v", got)
+		}
+	}
+	if n := resolver.count("198.51.100.10"); n != 1 {
+		t.Fatalf("queries = %d, want 1 within the TTL", n)
+	}
+
+	clock.advance(time.Minute)
+	c.lookup(ip)
+	if n := resolver.count("198.51.100.10"); n != 2 {
+		t.Fatalf("queries = %d, want 2 after the TTL", n)
+	}
+	if c.hits.Load() != 2 || c.misses.Load() != 2 {
+		t.Fatalf("hits = %d, misses = %d, want 2, 2", c.hits.Load(), c.misses.Load())
+	}
+}
+
+func TestPTRCache_NegativeCaching(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	resolver := &fakePTRResolver{}
+	c := newPTRCache(10, resolver.resolve)
+	c.now = clock.now
+	c.negativeTTL = 5 * time.Minute
+
+	// No PTR record: cached for negativeTTL.
+	ip := net.ParseIP("198.51.100.11")
+	c.lookup(ip)
+	clock.advance(4 * time.Minute)
+	c.lookup(ip)
+	if n := resolver.count("198.51.100.11"); n != 1 {
+		t.Fatalf("queries = %d, want 1 within the negative TTL", n)
+	}
+
+	// A timeout: cached for ptrFailureTTL only.
+	resolver.err = context.DeadlineExceeded
+	ip = net.ParseIP("198.51.100.12")
+	if got := c.lookup(ip); got != nil {
+		t.Fatalf("lookup() = %v, want nil on failure", got)
+	}
+	c.lookup(ip)
+	clock.advance(ptrFailureTTL)
+	c.lookup(ip)
+	if n := resolver.count("198.51.100.12"); n != 2 {
+		t.Fatalf("queries = %d, want 2", n)
+	}
+	if c.failures.Load() != 2 {
+		t.Fatalf("failures = %d, want 2", c.failures.Load())
+	}
+}
+
+func TestPTRCache_MergesConcurrentLookups(t *testing.T) {
+	release := make(chan struct{})
+	var queries atomic.Int32
+	c := newPTRCache(10, func(context.Context, net.IP) ([]string, time.Duration, error) {
+		queries.Add(1)
+		<-release
+		return []string{"cdn.example."}, time.Minute, nil
+	})
+	ip := net.ParseIP("198.51.100.13")
+
+	const lookups = 20
+	var wg sync.WaitGroup
+	results := make([][]string, lookups)
+	for i := range lookups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.lookup(ip)
+		}()
+	}
+	for c.merged.Load() < lookups-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("queries = %d, want 1", n)
+	}
+	for _, got := range results {
+		if !reflect.DeepEqual(got, []string{"cdn.example"}) {
+			t.Fatalf("lookup() = %v", got)
+		}
+	}
+}
+
+func TestPTRCache_SizeLimit(t *testing.T) {
+	resolver := &fakePTRResolver{ttl: time.Hour}
+	c := newPTRCache(2, resolver.resolve)
+
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.1", "198.51.100.3"} {
+		c.lookup(net.ParseIP(ip))
+	}
+	if c.Len() != 2 || c.evictions.Load() != 1 {
+		t.Fatalf("Len() = %d, evictions = %d, want 2, 1", c.Len(), c.evictions.Load())
+	}
+	// .2 was least recently used and is gone; .1 is still cached.
+	c.lookup(net.ParseIP("198.51.100.1"))
+	c.lookup(net.ParseIP("198.51.100.2"))
+	if resolver.count("198.51.100.1") != 1 || resolver.count("198.51.100.2") != 2 {
+		t.Fatalf("queries = %v", resolver.queries)
+	}
+}
+
+func TestParsePTRResponse(t *testing.T) {
+	name := dnsmessage.MustNewName(reverseName(net.ParseIP("198.51.100.10")))
+	hdr := func(ttl uint32, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+	}
+
+	names, ttl, err := parsePTRResponse(&dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{
+			{Header: hdr(600, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("a.example.")}},
+			{Header: hdr(120, dnsmessage.TypePTR), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("b.example.")}},
+		},
+	})
+	if err != nil || ttl != 120*time.Second || !reflect.DeepEqual(names, []string{"a.example.", "b.example."}) {
+		t.Fatalf("parsePTRResponse() = %v, %s, %v", names, ttl, err)
+	}
+
+	names, ttl, err = parsePTRResponse(&dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{
+			{Header: hdr(3600, dnsmessage.TypeSOA), Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.example."), MBox: dnsmessage.MustNewName("hostmaster.example."), MinTTL: 300,
+			}},
+		},
+	})
+	if err != nil || names != nil || ttl != 300*time.Second {
+		t.Fatalf("NXDOMAIN: parsePTRResponse() = %v, %s, %v", names, ttl, err)
+	}
+
+	if _, _, err := parsePTRResponse(&dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeServerFailure}}); err == nil {
+		t.Fatal("SERVFAIL: parsePTRResponse() error = nil")
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	if got := reverseName(net.ParseIP("198.51.100.10")); got != "10.100.51.198.in-addr.arpa." {
+		t.Fatalf("reverseName(v4) = %s", got)
+	}
+	if got := reverseName(net.ParseIP("2001:db8::1")); got != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa." {
+		t.Fatalf("reverseName(v6) = %s", got)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	prev := ptrLookups
+	t.Cleanup(func() { ptrLookups = prev })
+	ptrLookups = newPTRCache(10, (&fakePTRResolver{err: errors.New("down")}).resolve)
+	ptrLookups.lookup(net.ParseIP("198.51.100.14"))
+	ptrLookups.lookup(net.ParseIP("198.51.100.14"))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE xray_loki_proxy_ptr_cache_hits_total counter\nxray_loki_proxy_ptr_cache_hits_total 1\n",
+		"xray_loki_proxy_ptr_cache_misses_total 1\n",
+		"xray_loki_proxy_ptr_lookup_failures_total 1\n",
+		"xray_loki_proxy_ptr_cache_entries 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("/metrics missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import "strings"
+
+// scanXrayLine splits an Xray access line into its fields without regexps
+// or allocations; the fields are substrings of line. It accepts exactly what
+// the original expressions accepted:
+//
+//	^(?P<datetime>\S+\s+\S+)\s*?(from\s)?(?P<from>\S+)\s+(?P<status>rejected)\s{2,}(?P<reason>.+?)(?:\s+email:\s+(?P<email>\S+))?$
+//	^(?P<datetime>\S+\s+\S+)\s*?(from\s)?(?P<from>\S+)\s+(?P<status>\S+)\s+(?P<to>\S+)(?:\s+\[(?P<route>.*?)\])?(?:\s+email:\s+(?P<email>\S+))?$
+//
+// tried in that order: a rejected connection has an empty destination
+// (hence two spaces after the status) and a reason that often contains
+// spaces, which would otherwise be misread as a destination. The regexps
+// also match a few lines by splitting the time or taking "from" as the
+// source; those never parse into an entry, so the scanner rejects them.
+//
+// See https://github.com/XTLS/Xray-core/blob/main/common/log/access.go.
+func scanXrayLine(line string) (lineFields, bool) {
+	var fields lineFields
+
+	// datetime is the first two tokens.
+	i := skipToken(line, 0)
+	if i == 0 {
+		return fields, false
+	}
+	j := skipSpace(line, i)
+	if j == i || j == len(line) {
+		return fields, false
+	}
+	i = skipToken(line, j)
+	fields.datetime = line[:i]
+
+	// An optional "from" followed by exactly one space, then the source.
+	j = skipSpace(line, i)
+	if j == i || j == len(line) {
+		return fields, false
+	}
+	if strings.HasPrefix(line[j:], "from") && j+5 < len(line) && isSpace(line[j+4]) && !isSpace(line[j+5]) {
+		j += 5
+	}
+	i = skipToken(line, j)
+	fields.from = line[j:i]
+
+	j = skipSpace(line, i)
+	if j == i || j == len(line) {
+		return fields, false
+	}
+	if strings.HasPrefix(line[j:], "rejected") {
+		end := j + len("rejected")
+		if reason, email, ok := scanRejectReason(line, end); ok {
+			fields.status, fields.reason, fields.email = line[j:end], reason, email
+			return fields, true
+		}
+	}
+	i = skipToken(line, j)
+	fields.status = line[j:i]
+
+	j = skipSpace(line, i)
+	if j == i || j == len(line) {
+		return fields, false
+	}
+	i = skipToken(line, j)
+	fields.to = line[j:i]
+
+	var ok bool
+	fields.route, fields.email, ok = scanRouteEmail(line[i:])
+	return fields, ok
+}
+
+// scanRejectReason matches `\s{2,}(.+?)(?:\s+email:\s+(\S+))?$` at line[i:].
+// Like the regexp it prefers the longest run of spaces and then the shortest
+// reason. The trailing email, if any, is found once from the end, so each
+// start k of the reason is checked in constant time.
+func scanRejectReason(line string, i int) (reason, email string, ok bool) {
+	end := skipSpace(line, i)
+	tail, label := -1, -1
+	if t := emailTail(line[i:]); t >= 0 {
+		tail = i + t
+		label = skipSpace(line, tail)
+	}
+	// The reason cannot span lines: nl is the first newline at or after k.
+	lastNL := strings.LastIndexByte(line, '\n')
+	nl := strings.IndexByte(line[end:], '\n')
+	if nl < 0 {
+		nl = len(line)
+	} else {
+		nl += end
+	}
+	for k := end; k >= i+2; k-- {
+		if k < end && line[k] == '\n' {
+			nl = k
+		}
+		if tail >= 0 {
+			if n := max(tail, k+1); n < label && n <= nl {
+				email, _ := scanEmail(line[n:])
+				return line[k:n], email, true
+			}
+		}
+		if k < len(line) && k > lastNL {
+			return line[k:], "", true
+		}
+	}
+	return "", "", false
+}
+
+// scanRouteEmail matches `(?:\s+\[(.*?)\])?(?:\s+email:\s+(\S+))?$`, taking
+// the shortest route that lets the rest of the line match. Only two `]` can
+// end the route: the one right before a trailing email, or the last byte.
+func scanRouteEmail(s string) (route, email string, ok bool) {
+	if s == "" {
+		return "", "", true
+	}
+	if i := skipSpace(s, 0); i > 0 && i < len(s) && s[i] == '[' {
+		body := s[i+1:]
+		// The route cannot span lines.
+		end := strings.IndexByte(body, '\n')
+		if end < 0 {
+			end = len(body)
+		}
+		if n := emailTail(body) - 1; n >= 0 && n < end && body[n] == ']' {
+			email, _ := scanEmail(body[n+1:])
+			return body[:n], email, true
+		}
+		if end == len(body) && end > 0 && body[end-1] == ']' {
+			return body[:end-1], "", true
+		}
+	}
+	email, ok = scanEmail(s)
+	return "", email, ok
+}
+
+// emailTail returns where a trailing `\s+email:\s+\S+` starts in s, or -1.
+func emailTail(s string) int {
+	token := len(s)
+	for token > 0 && !isSpace(s[token-1]) {
+		token--
+	}
+	if token == len(s) || token == 0 {
+		return -1
+	}
+	label := token
+	for label > 0 && isSpace(s[label-1]) {
+		label--
+	}
+	if !strings.HasSuffix(s[:label], "email:") {
+		return -1
+	}
+	start := label - len("email:")
+	for start > 0 && isSpace(s[start-1]) {
+		start--
+	}
+	if start == label-len("email:") {
+		return -1
+	}
+	return start
+}
+
+// scanEmail matches `\s+email:\s+(\S+)$`.
+func scanEmail(s string) (string, bool) {
+	i := skipSpace(s, 0)
+	if i == 0 || !strings.HasPrefix(s[i:], "email:") {
+		return "", false
+	}
+	i += len("email:")
+	j := skipSpace(s, i)
+	if j == i || j == len(s) || skipToken(s, j) != len(s) {
+		return "", false
+	}
+	return s[j:], true
+}
+
+// isSpace reports whether c is in the regexp class \s.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+}
+
+// skipSpace returns the index of the first non-space byte of s at or after i.
+func skipSpace(s string, i int) int {
+	for i < len(s) && isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+// skipToken returns the index of the first space byte of s at or after i.
+func skipToken(s string, i int) int {
+	for i < len(s) && !isSpace(s[i]) {
+		i++
+	}
+	return i
+}
+
+// normalizeRoute rewrites the arrows Xray versions put between route hops
+// ("==>", "->", ">>", with any surrounding spaces) to " - ".
+func normalizeRoute(route string) string {
+	var b strings.Builder
+	written := 0
+	for i := 0; i < len(route); {
+		j := skipSpace(route, i)
+		n := routeArrowLen(route[j:])
+		if n == 0 {
+			i = max(i+1, j)
+			continue
+		}
+		if b.Len() == 0 {
+			b.Grow(len(route) + 2)
+		}
+		b.WriteString(route[written:i])
+		b.WriteString(" - ")
+		i = skipSpace(route, j+n)
+		written = i
+	}
+	if b.Len() == 0 {
+		return route
+	}
+	b.WriteString(route[written:])
+	return b.String()
+}
+
+func routeArrowLen(s string) int {
+	switch {
+	case strings.HasPrefix(s, "==>"):
+		return 3
+	case strings.HasPrefix(s, "->"), strings.HasPrefix(s, ">>"):
+		return 2
+	default:
+		return 0
+	}
+}
+
+// routeTags returns the first and last hop of a raw route, and every hop for
+// chains longer than inbound -> outbound. Hops are split at the arrows
+// themselves, so a tag containing " - " stays whole; only a route without
+// arrows is taken as already normalized and split at " - ".
+func routeTags(route string) (inbound, outbound string, chain []string) {
+	var hops []string
+	start := 0
+	for i := 0; i < len(route); {
+		j := skipSpace(route, i)
+		n := routeArrowLen(route[j:])
+		if n == 0 {
+			i = max(i+1, j)
+			continue
+		}
+		hops = append(hops, strings.TrimSpace(route[start:i]))
+		i = skipSpace(route, j+n)
+		start = i
+	}
+	if hops == nil {
+		hops = strings.Split(route, " - ")
+		for i := range hops {
+			hops[i] = strings.TrimSpace(hops[i])
+		}
+	} else {
+		hops = append(hops, strings.TrimSpace(route[start:]))
+	}
+	switch len(hops) {
+	case 1:
+		return hops[0], "", nil
+	case 2:
+		return hops[0], hops[1], nil
+	default:
+		return hops[0], hops[len(hops)-1], hops
+	}
+}
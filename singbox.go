@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// singboxTimeLayout is sing-box's "timestamp": true prefix.
+	singboxTimeLayout = "-0700 2006-01-02 15:04:05"
+	// singboxPendingTimeout is how long the lines of one connection may be
+	// spread out before an incomplete record is flushed.
+	singboxPendingTimeout = 30 * time.Second
+	singboxMaxPending     = 100000
+	singboxSweepInterval  = 5 * time.Second
+)
+
+/* https://github.com/SagerNet/sing-box/blob/main/log/format.go: "[+0800 2024-01-01 12:00:00 ]INFO [id elapsed] inbound/vless[tag]: [user] message" */
+var singboxLogFormat = regexp.MustCompile(`^(?:(?P<datetime>[+-]\d{4} \d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) )?(?P<level>TRACE|DEBUG|INFO|WARN|ERROR|FATAL|PANIC) \[(?P<id>\d+) [^\]]*\] (?P<component>\S+): (?:\[(?P<user>[^\]]+)\] )?(?P<message>.*)$`)
+
+var singboxComponentFormat = regexp.MustCompile(`^(inbound|outbound)/[^\[]+\[([^\]]*)\]$`)
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// singboxConns assembles sing-box connection records. Records flushed by the
+// sweep are emitted once startSingboxAssembler has run.
+var singboxConns = newSingboxAssembler(singboxMaxPending, nil)
+
+// singboxLine is the connection-relevant content of one sing-box line.
+type singboxLine struct {
+	id        uint64
+	datetime  string
+	at        time.Time
+	direction string // "inbound" or "outbound"
+	tag       string
+	user      string
+	message   string
+}
+
+// singboxConnKey identifies a connection: sing-box connection IDs are only
+// unique per instance, so they are qualified by the origin's key.
+type singboxConnKey struct {
+	origin string
+	id     uint64
+}
+
+// singboxConn collects the lines of one connection: "inbound connection
+// from", "[user] inbound connection to" and "outbound connection to".
+type singboxConn struct {
+	added    time.Time
+	origin   eventOrigin
+	datetime string
+	at       time.Time
+
+	from    string
+	to      string
+	user    string
+	inbound string
+
+	outbound    string
+	hasOutbound bool
+
+	// completedBy is the kind of line that completed the record: "from",
+	// "to" or "outbound".
+	completedBy string
+}
+
+func (c *singboxConn) complete() bool {
+	return c.from != "" && c.to != "" && c.hasOutbound
+}
+
+func (c *singboxConn) fields() lineFields {
+	route := c.inbound
+	if c.hasOutbound {
+		route += " >> " + c.outbound
+	}
+	return lineFields{
+		datetime: c.datetime,
+		from:     c.from,
+		to:       c.to,
+		email:    c.user,
+		status:   "accepted",
+		route:    strings.TrimPrefix(route, " >> "),
+	}
+}
+
+func startSingboxAssembler() {
+	batcher := newEmitBatcher("singbox", syslogBatchMax, syslogBatchInterval)
+	go batcher.run()
+	singboxConns.flushed = func(entry *LogEntry) { batcher.add(entry) }
+	go func() {
+		for range time.Tick(singboxSweepInterval) {
+			singboxConns.sweep()
+		}
+	}()
+}
+
+// isSingboxLine tells sing-box lines from Xray lines for auto detection.
+func isSingboxLine(line string) bool {
+	return singboxLogFormat.MatchString(ansiEscapeRegex.ReplaceAllString(line, ""))
+}
+
+// parseSingboxLine parses one sing-box log line. Lines that are not about an
+// inbound or outbound connection return nil without error.
+func parseSingboxLine(line string, loc *time.Location) (*singboxLine, error) {
+	line = ansiEscapeRegex.ReplaceAllString(line, "")
+	match := singboxLogFormat.FindStringSubmatch(line)
+	if match == nil {
+		return nil, errNoMatch
+	}
+	groups := make(map[string]string, len(match))
+	for i, name := range singboxLogFormat.SubexpNames() {
+		if i > 0 && name != "" {
+			groups[name] = match[i]
+		}
+	}
+
+	component := singboxComponentFormat.FindStringSubmatch(groups["component"])
+	if component == nil {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(groups["id"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without "timestamp": true the line carries no time; use arrival time.
+	at := time.Now()
+	datetime := groups["datetime"]
+	if datetime != "" {
+		if at, err = time.Parse(singboxTimeLayout, datetime); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadTimestamp, err)
+		}
+	} else {
+		datetime = at.In(loc).Format(singboxTimeLayout)
+	}
+
+	return &singboxLine{
+		id:        id,
+		datetime:  datetime,
+		at:        at,
+		direction: component[1],
+		tag:       component[2],
+		user:      groups["user"],
+		message:   groups["message"],
+	}, nil
+}
+
+// singboxAssembler joins the lines of a connection by origin and connection
+// ID. Lines may arrive in any order (ingest parses a batch concurrently); a
+// record is emitted once it has its source, destination and outbound.
+//
+// Completed records are kept for singboxPendingTimeout: when the line that
+// completed one arrives again, because the shipper retries a batch whose
+// emit failed, the record is returned again instead of opening a new
+// connection that could never complete.
+type singboxAssembler struct {
+	maxPending int
+	now        func() time.Time
+	flushed    func(*LogEntry)
+
+	mu        sync.Mutex
+	conns     map[singboxConnKey]*singboxConn
+	completed map[singboxConnKey]*singboxConn
+
+	// dropped counts lines of connections not tracked because maxPending
+	// were already incomplete.
+	dropped atomic.Uint64
+}
+
+func newSingboxAssembler(maxPending int, flushed func(*LogEntry)) *singboxAssembler {
+	return &singboxAssembler{
+		maxPending: maxPending,
+		now:        time.Now,
+		flushed:    flushed,
+		conns:      make(map[singboxConnKey]*singboxConn),
+		completed:  make(map[singboxConnKey]*singboxConn),
+	}
+}
+
+// add merges a line received from origin into its connection and returns
+// the connection's fields when the record is complete, or when the line is
+// the one that completed it earlier.
+func (a *singboxAssembler) add(l *singboxLine, origin eventOrigin) (lineFields, bool) {
+	kind := ""
+	switch {
+	case l.direction == "inbound" && strings.Contains(l.message, "connection from "):
+		kind = "from"
+	case l.direction == "inbound" && strings.Contains(l.message, "connection to "):
+		kind = "to"
+	case l.direction == "outbound" && strings.Contains(l.message, "connection to "):
+		kind = "outbound"
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	key := singboxConnKey{origin: origin.key(), id: l.id}
+	if conn, ok := a.completed[key]; ok {
+		if kind != "" && kind == conn.completedBy {
+			return conn.fields(), true
+		}
+		return lineFields{}, false
+	}
+	conn, ok := a.conns[key]
+	if !ok {
+		if len(a.conns) >= a.maxPending {
+			a.dropped.Add(1)
+			logDebug("sing-box: %d connections pending, dropping a line of connection %d", len(a.conns), l.id)
+			return lineFields{}, false
+		}
+		conn = &singboxConn{added: a.now(), origin: origin}
+		a.conns[key] = conn
+	}
+	if conn.datetime == "" || l.at.Before(conn.at) {
+		conn.datetime, conn.at = l.datetime, l.at
+	}
+
+	proto := "tcp"
+	if strings.Contains(l.message, "packet connection") {
+		proto = "udp"
+	}
+	switch kind {
+	case "from":
+		conn.from = l.message[strings.LastIndex(l.message, " ")+1:]
+		conn.inbound = l.tag
+	case "to":
+		conn.to = proto + ":" + l.message[strings.LastIndex(l.message, " ")+1:]
+		conn.inbound = l.tag
+		if l.user != "" {
+			conn.user = l.user
+		}
+	case "outbound":
+		conn.outbound, conn.hasOutbound = l.tag, true
+		if conn.to == "" {
+			conn.to = proto + ":" + l.message[strings.LastIndex(l.message, " ")+1:]
+		}
+	}
+
+	if !conn.complete() {
+		return lineFields{}, false
+	}
+	delete(a.conns, key)
+	if len(a.completed) < a.maxPending {
+		conn.added, conn.completedBy = a.now(), kind
+		a.completed[key] = conn
+	}
+	return conn.fields(), true
+}
+
+// sweep flushes records that stayed incomplete for singboxPendingTimeout.
+// Records that at least know their source and destination are still
+// emitted, without an outbound; the rest are dropped. Completed records are
+// forgotten after the same time.
+func (a *singboxAssembler) sweep() {
+	a.mu.Lock()
+	var expired []*singboxConn
+	now := a.now()
+	for key, conn := range a.completed {
+		if now.Sub(conn.added) >= singboxPendingTimeout {
+			delete(a.completed, key)
+		}
+	}
+	for key, conn := range a.conns {
+		if now.Sub(conn.added) >= singboxPendingTimeout {
+			delete(a.conns, key)
+			if conn.from != "" && conn.to != "" {
+				expired = append(expired, conn)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, conn := range expired {
+		entry, err := entryFromFields(conn.fields(), time.UTC, singboxTimeLayout)
+		if err != nil {
+			logWarn("Dropping incomplete sing-box connection: %v", err)
+			continue
+		}
+		entry.Format, entry.eventOrigin = ingestFormatSingbox, conn.origin
+		if entry = admitEntry(entry); entry != nil && a.flushed != nil {
+			a.flushed(entry)
+		}
+	}
+}
+
+// Len returns the number of incomplete connection records.
+func (a *singboxAssembler) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.conns)
+}
+
+// processSingboxLine feeds one sing-box line received from origin to the
+// assembler and returns the connection's LogEntry when this line completed
+// it, nil otherwise.
+func processSingboxLine(line string, loc *time.Location, origin eventOrigin) (*LogEntry, error) {
+	l, err := parseSingboxLine(line, loc)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	fields, ok := singboxConns.add(l, origin)
+	if !ok {
+		return nil, nil
+	}
+	entry, err := entryFromFields(fields, loc, singboxTimeLayout)
+	if err != nil {
+		return nil, err
+	}
+	entry.Format = ingestFormatSingbox
+	return admitEntry(entry), nil
+}
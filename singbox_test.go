@@ -0,0 +1,253 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func withSingboxAssembler(t *testing.T) *singboxAssembler {
+	t.Helper()
+	prev, prevRules := singboxConns, skipRules
+	t.Cleanup(func() { singboxConns, skipRules = prev, prevRules })
+	singboxConns = newSingboxAssembler(100, nil)
+	skipRules = nil
+	return singboxConns
+}
+
+var singboxTestLines = []string{
+	`+0800 2026-03-11 22:22:07 INFO [3183925412 0ms] inbound/vless[vless-in]: inbound connection from 203.0.113.47:4821`,
+	`+0800 2026-03-11 22:22:07 INFO [3183925412 1ms] inbound/vless[vless-in]: [alice] inbound connection to alpha.example:443`,
+	`+0800 2026-03-11 22:22:07 INFO [3183925412 1ms] router: match[2] domain_suffix=[example] => direct`,
+	`+0800 2026-03-11 22:22:08 INFO [3183925412 3ms] outbound/direct[direct]: outbound connection to alpha.example:443`,
+}
+
+func TestProcessSingboxLine_Assembles(t *testing.T) {
+	want := LogEntry{
+		Datetime:    "2026-03-11 14:22:07.000000",
+		Email:       "alice",
+		FromIP:      "203.0.113.47",
+		FromPort:    4821,
+		DestProto:   "tcp",
+		DestHost:    "alpha.example",
+		DestPort:    443,
+		Status:      "accepted",
+		Route:       "vless-in - direct",
+		InboundTag:  "vless-in",
+		OutboundTag: "direct",
+		ToAddr:      []string{},
+		Format:      "singbox",
+	}
+
+	orders := map[string][]int{
+		"in order": {0, 1, 2, 3},
+		"shuffled": {3, 2, 1, 0},
+	}
+	for name, order := range orders {
+		t.Run(name, func(t *testing.T) {
+			assembler := withSingboxAssembler(t)
+
+			var got []*LogEntry
+			for _, i := range order {
+				entry, err := processSingboxLine(singboxTestLines[i], time.UTC, eventOrigin{})
+				if err != nil {
+					t.Fatalf("processSingboxLine(%q) error = %v", singboxTestLines[i], err)
+				}
+				if entry != nil {
+					got = append(got, entry)
+				}
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d entries, want 1", len(got))
+			}
+			got[0].ToAddr = []string{}
+			if !reflect.DeepEqual(*got[0], want) {
+				t.Fatalf("entry\n got: %+v\nwant: %+v", *got[0], want)
+			}
+			if assembler.Len() != 0 {
+				t.Fatalf("%d records still pending", assembler.Len())
+			}
+		})
+	}
+}
+
+func TestProcessSingboxLine_UDPAndNoUser(t *testing.T) {
+	withSingboxAssembler(t)
+
+	lines := []string{
+		`INFO [77 0ms] inbound/shadowsocks[ss-in]: inbound packet connection from [2001:db8::7]:40000`,
+		`INFO [77 0ms] inbound/shadowsocks[ss-in]: inbound packet connection to 1.1.1.1:53`,
+		`INFO [77 1ms] outbound/direct[direct]: outbound packet connection to 1.1.1.1:53`,
+	}
+	var got *LogEntry
+	for _, line := range lines {
+		entry, err := processSingboxLine(line, time.UTC, eventOrigin{})
+		if err != nil {
+			t.Fatalf("processSingboxLine(%q) error = %v", line, err)
+		}
+		if entry != nil {
+			got = entry
+		}
+	}
+	if got == nil {
+		t.Fatal("no entry assembled")
+	}
+	if got.DestProto != "udp" || got.FromIP != "2001:db8::7" || got.Email != "" || got.InboundTag != "ss-in" {
+		t.Fatalf("unexpected entry %+v", got)
+	}
+}
+
+func TestParseSingboxLine(t *testing.T) {
+	if _, err := parseSingboxLine(formatTestAccessLine(1), time.UTC); err == nil {
+		t.Fatal("Xray access line parsed as sing-box")
+	}
+	l, err := parseSingboxLine("\x1b[36mINFO\x1b[0m [9 0ms] dns: exchanged alpha.example A", time.UTC)
+	if err != nil || l != nil {
+		t.Fatalf("non-connection line = %+v, %v; want nil, nil", l, err)
+	}
+}
+
+func TestSingboxAssembler_SweepFlushesIncomplete(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	var flushed []*LogEntry
+	assembler := withSingboxAssembler(t)
+	assembler.now = clock.now
+	assembler.flushed = func(entry *LogEntry) { flushed = append(flushed, entry) }
+
+	// Connection 1 never logs its outbound; connection 2 only its source.
+	origin := eventOrigin{Node: "edge-1"}
+	for _, line := range []string{
+		singboxTestLines[0],
+		singboxTestLines[1],
+		`+0800 2026-03-11 22:22:09 INFO [42 0ms] inbound/vless[vless-in]: inbound connection from 203.0.113.48:4822`,
+	} {
+		if _, err := processSingboxLine(line, time.UTC, origin); err != nil {
+			t.Fatalf("processSingboxLine() error = %v", err)
+		}
+	}
+
+	clock.advance(singboxPendingTimeout - time.Second)
+	assembler.sweep()
+	if assembler.Len() != 2 || len(flushed) != 0 {
+		t.Fatalf("swept before timeout: pending=%d flushed=%d", assembler.Len(), len(flushed))
+	}
+
+	clock.advance(time.Second)
+	assembler.sweep()
+	if assembler.Len() != 0 {
+		t.Fatalf("%d records still pending", assembler.Len())
+	}
+	if len(flushed) != 1 || flushed[0].Email != "alice" || flushed[0].OutboundTag != "" || flushed[0].InboundTag != "vless-in" {
+		t.Fatalf("flushed = %+v", flushed)
+	}
+	if flushed[0].Node != "edge-1" {
+		t.Fatalf("flushed node = %q, want edge-1", flushed[0].Node)
+	}
+}
+
+func TestSingboxAssembler_KeysByOrigin(t *testing.T) {
+	assembler := withSingboxAssembler(t)
+
+	// Two nodes log connection 3183925412; neither is complete on its own.
+	edge1 := eventOrigin{Node: "edge-1"}
+	edge2 := eventOrigin{Node: "edge-2"}
+	for _, tt := range []struct {
+		line   string
+		origin eventOrigin
+	}{
+		{singboxTestLines[0], edge1},
+		{singboxTestLines[1], edge1},
+		{singboxTestLines[3], edge2},
+	} {
+		entry, err := processSingboxLine(tt.line, time.UTC, tt.origin)
+		if err != nil {
+			t.Fatalf("processSingboxLine(%q) error = %v", tt.line, err)
+		}
+		if entry != nil {
+			t.Fatalf("lines of %s completed a record of another node: %+v", tt.origin.Node, entry)
+		}
+	}
+	if assembler.Len() != 2 {
+		t.Fatalf("%d records pending, want 2", assembler.Len())
+	}
+
+	entry, err := processSingboxLine(singboxTestLines[3], time.UTC, edge1)
+	if err != nil || entry == nil {
+		t.Fatalf("processSingboxLine() = %v, %v; want the edge-1 record", entry, err)
+	}
+}
+
+func TestProcessEvent_AutoDetectsSingbox(t *testing.T) {
+	withSingboxAssembler(t)
+
+	var events []logEvent
+	for _, line := range singboxTestLines {
+		event, err := processEvent(line, ingestOptions{format: ingestFormatAuto, loc: time.UTC})
+		if err != nil {
+			t.Fatalf("processEvent(%q) error = %v", line, err)
+		}
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if entry, ok := events[0].(*LogEntry); !ok || entry.Email != "alice" {
+		t.Fatalf("event = %#v", events[0])
+	}
+}
+
+func TestSingboxAssembler_CountsDrops(t *testing.T) {
+	assembler := withSingboxAssembler(t)
+	assembler.maxPending = 1
+
+	for _, line := range []string{
+		singboxTestLines[0],
+		`+0800 2026-03-11 22:22:09 INFO [42 0ms] inbound/vless[vless-in]: inbound connection from 203.0.113.48:4822`,
+	} {
+		if _, err := processSingboxLine(line, time.UTC, eventOrigin{}); err != nil {
+			t.Fatalf("processSingboxLine(%q) error = %v", line, err)
+		}
+	}
+	if assembler.Len() != 1 || assembler.dropped.Load() != 1 {
+		t.Fatalf("pending=%d dropped=%d, want 1 and 1", assembler.Len(), assembler.dropped.Load())
+	}
+}
+
+func TestSingboxAssembler_RetriedLineCompletesAgain(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	assembler := withSingboxAssembler(t)
+	assembler.now = clock.now
+
+	process := func(line string) *LogEntry {
+		t.Helper()
+		entry, err := processSingboxLine(line, time.UTC, eventOrigin{})
+		if err != nil {
+			t.Fatalf("processSingboxLine(%q) error = %v", line, err)
+		}
+		return entry
+	}
+	process(singboxTestLines[0])
+	process(singboxTestLines[1])
+	if process(singboxTestLines[3]) == nil {
+		t.Fatal("outbound line did not complete the record")
+	}
+
+	// The batch with the outbound line failed to emit and is retried.
+	if entry := process(singboxTestLines[3]); entry == nil || entry.Email != "alice" {
+		t.Fatalf("retried outbound line = %+v, want the record again", entry)
+	}
+	if entry := process(singboxTestLines[1]); entry != nil {
+		t.Fatalf("retried inbound line = %+v, want nil", entry)
+	}
+	if assembler.Len() != 0 {
+		t.Fatalf("%d records pending after the retry", assembler.Len())
+	}
+
+	clock.advance(singboxPendingTimeout)
+	assembler.sweep()
+	if process(singboxTestLines[3]) != nil || assembler.Len() != 1 {
+		t.Fatal("completed record kept past singboxPendingTimeout")
+	}
+}
@@ -1,16 +1,287 @@
 package main
 
 import (
+	"fmt"
 	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 )
 
+// SkipRule drops entries whose destination matches. Domain patterns follow
+// Xray's domain matcher syntax (full:, domain:, keyword:, dotless:, regexp:,
+// geosite:, ext:file:name and plain substrings); IP patterns are literal IPs,
+// CIDRs, geoip:[!]code and ext:file:[!]code.
 type SkipRule struct {
 	Domain []string `json:"domain,omitempty"`
 	IP     []string `json:"ip,omitempty"`
 }
 
+// skipPatterns holds what the regexp:, geosite:, geoip: and ext: patterns of
+// the loaded skip rules need, keyed by the pattern as written. watchXrayGeo
+// replaces it when one of its .dat files changes.
+var skipPatterns atomic.Pointer[skipPatternSet]
+
+type skipPatternSet struct {
+	regex map[string]*regexp.Regexp
+	sites map[string]geositeMatcher
+	ips   map[string]geoipMatcher
+
+	// files are the .dat files the patterns were loaded from, with their
+	// versions at load time.
+	files map[string]fileVersion
+}
+
+// geositeMatcher matches the domains of one geosite category, or only those
+// carrying all of attrs.
+type geositeMatcher struct {
+	index    *geositeIndex
+	category int
+	attrs    []string
+}
+
+func (m geositeMatcher) match(domain string) bool {
+	found := false
+	m.index.match(domain, func(ref geositeRef) {
+		if ref.category != m.category || found {
+			return
+		}
+		found = !slices.ContainsFunc(m.attrs, func(attr string) bool {
+			return !slices.Contains(ref.attrs, attr)
+		})
+	})
+	return found
+}
+
+// geoipMatcher matches the addresses of one geoip category, or with negate
+// every other address.
+type geoipMatcher struct {
+	index    *geoipIndex
+	category int
+	negate   bool
+}
+
+func (m geoipMatcher) match(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	return m.index.contains(m.category, addr.Unmap()) != m.negate
+}
+
+// geoPattern is a geosite:, geoip: or ext: pattern: the .dat file, the
+// category as parseGeosite and parseGeoIPDat name it, and its modifiers.
+type geoPattern struct {
+	file     string
+	category string
+	attrs    []string // geosite only
+	negate   bool     // geoip only
+}
+
+// parseGeoPattern parses pattern as a geosite (site) or geoip category
+// reference. ok is false for patterns of any other kind.
+func parseGeoPattern(pattern string, site bool) (ref geoPattern, ok bool, err error) {
+	kind, defaultFile := "geoip", XRAY_GEOIP_PATH
+	if site {
+		kind, defaultFile = "geosite", XRAY_GEOSITE_PATH
+	}
+
+	var name string
+	if rest, found := cutPrefixFold(pattern, kind+":"); found {
+		ref.file, name = defaultFile, rest
+		if ref.file == "" {
+			ref.file = xrayAssetPath(kind + ".dat")
+		}
+	} else if rest, found := cutPrefixFold(pattern, "ext:"); found {
+		file, category, found := strings.Cut(rest, ":")
+		if !found || file == "" {
+			return ref, true, fmt.Errorf("%q is not ext:<file>:<name>", pattern)
+		}
+		ref.file, name = xrayAssetPath(file), category
+	} else {
+		return ref, false, nil
+	}
+
+	name = strings.ToLower(name)
+	if site {
+		parts := strings.Split(name, "@")
+		name, ref.attrs = parts[0], parts[1:]
+	} else {
+		name, ref.negate = strings.CutPrefix(name, "!")
+	}
+	if name == "" {
+		return ref, true, fmt.Errorf("%q has no category", pattern)
+	}
+	ref.category = kind + ":" + name
+	return ref, true, nil
+}
+
+// xrayAssetPath resolves a .dat file name against XRAY_LOCATION_ASSET.
+func xrayAssetPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(XRAY_LOCATION_ASSET, name)
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// loadSkipPatterns compiles the regexp: patterns of rules and loads the
+// categories their geosite:, geoip: and ext: patterns name, reading each
+// .dat file once.
+func loadSkipPatterns(rules []SkipRule) (*skipPatternSet, error) {
+	set := &skipPatternSet{
+		regex: make(map[string]*regexp.Regexp),
+		sites: make(map[string]geositeMatcher),
+		ips:   make(map[string]geoipMatcher),
+		files: make(map[string]fileVersion),
+	}
+	siteRefs := make(map[string]geoPattern)
+	ipRefs := make(map[string]geoPattern)
+	for _, rule := range rules {
+		for _, pattern := range rule.Domain {
+			if expr, ok := cutPrefixFold(pattern, "regexp:"); ok {
+				re, err := regexp.Compile(expr)
+				if err != nil {
+					return nil, fmt.Errorf("skip rule %q: %w", pattern, err)
+				}
+				set.regex[pattern] = re
+				continue
+			}
+			ref, ok, err := parseGeoPattern(pattern, true)
+			if err != nil {
+				return nil, fmt.Errorf("skip rule: %w", err)
+			}
+			if ok {
+				siteRefs[pattern] = ref
+			}
+		}
+		for _, pattern := range rule.IP {
+			ref, ok, err := parseGeoPattern(pattern, false)
+			if err != nil {
+				return nil, fmt.Errorf("skip rule: %w", err)
+			}
+			if ok {
+				ipRefs[pattern] = ref
+			}
+		}
+	}
+
+	siteIndexes, err := loadGeoFiles(siteRefs, set.files, func(raw []byte, filter map[string]bool) (any, []string, error) {
+		ix, err := parseGeosite(raw, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ix, ix.names, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for pattern, ref := range siteRefs {
+		ix := siteIndexes[ref.file].(*geositeIndex)
+		set.sites[pattern] = geositeMatcher{index: ix, category: slices.Index(ix.names, ref.category), attrs: ref.attrs}
+	}
+
+	ipIndexes, err := loadGeoFiles(ipRefs, set.files, func(raw []byte, filter map[string]bool) (any, []string, error) {
+		ix, err := parseGeoIPDat(raw, filter)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ix, ix.names, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for pattern, ref := range ipRefs {
+		ix := ipIndexes[ref.file].(*geoipIndex)
+		set.ips[pattern] = geoipMatcher{index: ix, category: slices.Index(ix.names, ref.category), negate: ref.negate}
+	}
+	return set, nil
+}
+
+// loadGeoFiles parses every file refs name with only the categories they
+// use, and checks that each category exists. The version of each file read
+// is recorded in versions.
+func loadGeoFiles(refs map[string]geoPattern, versions map[string]fileVersion, parse func(raw []byte, filter map[string]bool) (any, []string, error)) (map[string]any, error) {
+	filters := make(map[string]map[string]bool)
+	for _, ref := range refs {
+		if filters[ref.file] == nil {
+			filters[ref.file] = make(map[string]bool)
+		}
+		filters[ref.file][ref.category] = true
+	}
+
+	indexes := make(map[string]any, len(filters))
+	for file, filter := range filters {
+		versions[file] = statFile(file)
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("skip rules: %w", err)
+		}
+		ix, names, err := parse(raw, filter)
+		if err != nil {
+			return nil, fmt.Errorf("skip rules: %s: %w", file, err)
+		}
+		for category := range filter {
+			if !slices.Contains(names, category) {
+				return nil, fmt.Errorf("skip rules: %s has no category %s", file, category)
+			}
+		}
+		indexes[file] = ix
+	}
+	return indexes, nil
+}
+
+// loadedFiles returns the .dat files of s with their versions at load time.
+func (s *skipPatternSet) loadedFiles() map[string]fileVersion {
+	if s == nil {
+		return nil
+	}
+	return s.files
+}
+
+// changedFiles reports whether a .dat file of s differs from its version in
+// seen, and returns the versions now on disk.
+func (s *skipPatternSet) changedFiles(seen map[string]fileVersion) (map[string]fileVersion, bool) {
+	if s == nil || len(s.files) == 0 {
+		return seen, false
+	}
+	current := make(map[string]fileVersion, len(s.files))
+	changed := false
+	for file := range s.files {
+		current[file] = statFile(file)
+		changed = changed || current[file].changed(seen[file])
+	}
+	return current, changed
+}
+
+// reloadSkipPatterns rebuilds the skip patterns from their .dat files. On
+// error the previous patterns stay in use.
+func reloadSkipPatterns() {
+	next, err := loadSkipPatterns(skipRules)
+	if err != nil {
+		logError("Keeping previous skip rule patterns: %v", err)
+		return
+	}
+	skipPatterns.Store(next)
+	logInfo("Reloaded skip rule patterns from %d .dat files", len(next.files))
+}
+
 func isIPInRange(ip net.IP, pattern string) bool {
+	if patterns := skipPatterns.Load(); patterns != nil {
+		if m, ok := patterns.ips[pattern]; ok {
+			return m.match(ip)
+		}
+	}
 	if !strings.Contains(pattern, "/") {
 		return ip.String() == pattern
 	}
@@ -23,8 +294,17 @@ func isIPInRange(ip net.IP, pattern string) bool {
 }
 
 func matchDomain(pattern, domain string) bool {
-	pattern = strings.ToLower(pattern)
 	domain = strings.ToLower(domain)
+	if patterns := skipPatterns.Load(); patterns != nil {
+		if re, ok := patterns.regex[pattern]; ok {
+			return re.MatchString(domain)
+		}
+		if m, ok := patterns.sites[pattern]; ok {
+			return m.match(domain)
+		}
+	}
+
+	pattern = strings.ToLower(pattern)
 
 	if strings.HasPrefix(pattern, "full:") {
 		return domain == strings.TrimPrefix(pattern, "full:")
@@ -35,6 +315,22 @@ func matchDomain(pattern, domain string) bool {
 		return domain == targetDomain || strings.HasSuffix(domain, "."+targetDomain)
 	}
 
+	if strings.HasPrefix(pattern, "keyword:") {
+		return strings.Contains(domain, strings.TrimPrefix(pattern, "keyword:"))
+	}
+
+	if strings.HasPrefix(pattern, "dotless:") {
+		return !strings.Contains(domain, ".") && strings.Contains(domain, strings.TrimPrefix(pattern, "dotless:"))
+	}
+
+	// regexp:, geosite: and ext: patterns only match once loadSkipPatterns
+	// has prepared them.
+	for _, prefix := range []string{"regexp:", "geosite:", "ext:"} {
+		if strings.HasPrefix(pattern, prefix) {
+			return false
+		}
+	}
+
 	return strings.Contains(domain, pattern)
 }
 
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withSkipPatterns writes the test .dat files into a fresh asset directory,
+// also as ext.dat, and loads the patterns of rules from there.
+func withSkipPatterns(t *testing.T, rules []SkipRule) error {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "geosite.dat"), encodeGeosite(testGeositeData), 0o644)
+	os.WriteFile(filepath.Join(dir, "geoip.dat"), encodeGeoIPDat(t, testGeoIPData), 0o644)
+	os.WriteFile(filepath.Join(dir, "ext.dat"), encodeGeosite(testGeositeData), 0o644)
+
+	prevAsset, prevSite, prevIP := XRAY_LOCATION_ASSET, XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH
+	prevRules, prevPatterns := skipRules, skipPatterns.Load()
+	t.Cleanup(func() {
+		XRAY_LOCATION_ASSET, XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH = prevAsset, prevSite, prevIP
+		skipRules = prevRules
+		skipPatterns.Store(prevPatterns)
+	})
+	XRAY_LOCATION_ASSET, XRAY_GEOSITE_PATH, XRAY_GEOIP_PATH = dir, "", ""
+	skipRules = rules
+
+	patterns, err := loadSkipPatterns(rules)
+	if err != nil {
+		return err
+	}
+	skipPatterns.Store(patterns)
+	return nil
+}
+
+func TestMatchDomain(t *testing.T) {
+	patterns := []string{
+		"regexp:^api[0-9]+\\.example\\.com$",
+		"geosite:google",
+		"geosite:google@cn",
+		"ext:ext.dat:category-ads",
+	}
+	if err := withSkipPatterns(t, []SkipRule{{Domain: patterns}}); err != nil {
+		t.Fatalf("loadSkipPatterns() error = %v", err)
+	}
+
+	tests := []struct {
+		pattern string
+		domain  string
+		want    bool
+	}{
+		{pattern: "full:example.com", domain: "Example.com", want: true},
+		{pattern: "full:example.com", domain: "www.example.com", want: false},
+		{pattern: "domain:example.com", domain: "www.example.com", want: true},
+		{pattern: "domain:example.com", domain: "notexample.com", want: false},
+		{pattern: "keyword:tracker", domain: "eu.tracker.net", want: true},
+		{pattern: "dotless:nas", domain: "nas-01", want: true},
+		{pattern: "dotless:nas", domain: "nas.lan", want: false},
+		{pattern: "example", domain: "www.example.com", want: true},
+		{pattern: "regexp:^api[0-9]+\\.example\\.com$", domain: "API7.example.com", want: true},
+		{pattern: "regexp:^api[0-9]+\\.example\\.com$", domain: "api.example.com", want: false},
+		{pattern: "geosite:google", domain: "mail.google.com", want: true},
+		{pattern: "geosite:google", domain: "example.com", want: false},
+		{pattern: "geosite:google@cn", domain: "maps.google.cn", want: true},
+		{pattern: "geosite:google@cn", domain: "mail.google.com", want: false},
+		{pattern: "ext:ext.dat:category-ads", domain: "ad.doubleclick.net", want: true},
+		// Not loaded, so never a substring match.
+		{pattern: "geosite:netflix", domain: "geosite:netflix", want: false},
+	}
+	for _, tt := range tests {
+		if got := matchDomain(tt.pattern, tt.domain); got != tt.want {
+			t.Errorf("matchDomain(%q, %q) = %v, want %v", tt.pattern, tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestIsIPInRange(t *testing.T) {
+	patterns := []string{"geoip:private", "geoip:!ru", "ext:geoip.dat:ru"}
+	if err := withSkipPatterns(t, []SkipRule{{IP: patterns}}); err != nil {
+		t.Fatalf("loadSkipPatterns() error = %v", err)
+	}
+
+	tests := []struct {
+		pattern string
+		ip      string
+		want    bool
+	}{
+		{pattern: "203.0.113.5", ip: "203.0.113.5", want: true},
+		{pattern: "203.0.113.0/24", ip: "203.0.113.200", want: true},
+		{pattern: "203.0.113.0/24", ip: "198.51.100.1", want: false},
+		{pattern: "geoip:private", ip: "192.168.1.1", want: true},
+		{pattern: "geoip:private", ip: "::ffff:10.0.0.1", want: true},
+		{pattern: "geoip:private", ip: "198.51.100.1", want: false},
+		{pattern: "geoip:!ru", ip: "203.0.113.5", want: false},
+		{pattern: "geoip:!ru", ip: "198.51.100.1", want: true},
+		{pattern: "ext:geoip.dat:ru", ip: "2001:db8:1::1", want: true},
+	}
+	for _, tt := range tests {
+		if got := isIPInRange(net.ParseIP(tt.ip), tt.pattern); got != tt.want {
+			t.Errorf("isIPInRange(%s, %q) = %v, want %v", tt.ip, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestLoadSkipPatterns_Errors(t *testing.T) {
+	for _, rule := range []SkipRule{
+		{Domain: []string{"regexp:("}},
+		{Domain: []string{"geosite:netflix"}},
+		{Domain: []string{"ext:missing.dat:google"}},
+		{Domain: []string{"ext:google"}},
+		{IP: []string{"geoip:"}},
+		{IP: []string{"geoip:cn"}},
+	} {
+		if err := withSkipPatterns(t, []SkipRule{rule}); err == nil {
+			t.Errorf("loadSkipPatterns(%+v) error = nil", rule)
+		}
+	}
+}
+
+func TestSkipPatterns_ReloadOnChange(t *testing.T) {
+	if err := withSkipPatterns(t, []SkipRule{{Domain: []string{"geosite:google"}}}); err != nil {
+		t.Fatalf("loadSkipPatterns() error = %v", err)
+	}
+	seen := skipPatterns.Load().loadedFiles()
+	if _, changed := skipPatterns.Load().changedFiles(seen); changed {
+		t.Fatal("changedFiles() = true before any change")
+	}
+
+	sitePath := filepath.Join(XRAY_LOCATION_ASSET, "geosite.dat")
+	os.WriteFile(sitePath, encodeGeosite(map[string][]testGeoDomain{
+		"GOOGLE": {{kind: geositeDomain, value: "google.org"}, {kind: geositeDomain, value: "youtube.com"}},
+	}), 0o644)
+	seen, changed := skipPatterns.Load().changedFiles(seen)
+	if !changed {
+		t.Fatal("changedFiles() = false after the file was rewritten")
+	}
+	reloadSkipPatterns()
+	if matchDomain("geosite:google", "google.com") || !matchDomain("geosite:google", "www.youtube.com") {
+		t.Fatal("skip patterns still use the previous geosite.dat")
+	}
+
+	// A file that no longer has the category keeps the previous patterns.
+	os.WriteFile(sitePath, encodeGeosite(map[string][]testGeoDomain{"OTHER": {{kind: geositeDomain, value: "example.com"}}}), 0o644)
+	if _, changed := skipPatterns.Load().changedFiles(seen); !changed {
+		t.Fatal("changedFiles() = false after the second rewrite")
+	}
+	reloadSkipPatterns()
+	if !matchDomain("geosite:google", "www.youtube.com") {
+		t.Fatal("a failed reload replaced the skip patterns")
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var SYSLOG_UDP_ADDR = getEnv("SYSLOG_UDP_ADDR", "")
+var SYSLOG_TCP_ADDR = getEnv("SYSLOG_TCP_ADDR", "")
+
+const (
+	syslogBatchMax      = 500
+	syslogBatchInterval = time.Second
+	// syslogMaxMessage caps one syslog message (UDP datagram or TCP frame).
+	syslogMaxMessage = 64 * 1024
+	// syslogOctetCountDigits is the longest octet count prefix accepted.
+	syslogOctetCountDigits = 5
+	// syslogUDPWorkers parse UDP datagrams, matching the parse concurrency of
+	// the ingest handlers; syslogUDPQueue bounds the datagrams waiting for them.
+	syslogUDPWorkers = vectorParseConcurrency
+	syslogUDPQueue   = 4096
+	// syslogTCPIdleTimeout closes TCP senders that stay silent this long.
+	syslogTCPIdleTimeout = 10 * time.Minute
+	syslogUTF8BOM        = "\xef\xbb\xbf"
+)
+
+var syslogBatcher *emitBatcher
+
+// syslogUDPDropped counts datagrams dropped because the workers fell behind.
+var syslogUDPDropped atomic.Uint64
+
+// syslogMessage is the part of a syslog record the proxy cares about.
+type syslogMessage struct {
+	Hostname string
+	Content  string
+}
+
+// startSyslogServers starts the UDP and/or TCP listeners that are configured.
+// Listen errors are returned so main can fail fast on a bad address.
+func startSyslogServers() error {
+	if SYSLOG_UDP_ADDR == "" && SYSLOG_TCP_ADDR == "" {
+		return nil
+	}
+
+	syslogBatcher = newEmitBatcher("syslog", syslogBatchMax, syslogBatchInterval)
+	go syslogBatcher.run()
+
+	if SYSLOG_UDP_ADDR != "" {
+		conn, err := net.ListenPacket("udp", SYSLOG_UDP_ADDR)
+		if err != nil {
+			return fmt.Errorf("syslog udp listen %s: %w", SYSLOG_UDP_ADDR, err)
+		}
+		logInfo("Syslog listening on udp %s", conn.LocalAddr())
+		go serveSyslogUDP(conn)
+	}
+
+	if SYSLOG_TCP_ADDR != "" {
+		ln, err := net.Listen("tcp", SYSLOG_TCP_ADDR)
+		if err != nil {
+			return fmt.Errorf("syslog tcp listen %s: %w", SYSLOG_TCP_ADDR, err)
+		}
+		logInfo("Syslog listening on tcp %s", ln.Addr())
+		go serveSyslogTCP(ln)
+	}
+	return nil
+}
+
+// serveSyslogUDP only receives: datagrams are parsed by syslogUDPWorkers
+// workers, so a slow PTR lookup does not hold up the socket. Datagrams that
+// arrive while syslogUDPQueue are already waiting are dropped and counted.
+func serveSyslogUDP(conn net.PacketConn) {
+	queue := make(chan string, syslogUDPQueue)
+	defer close(queue)
+	for i := 0; i < syslogUDPWorkers; i++ {
+		go func() {
+			for raw := range queue {
+				handleSyslogMessage(raw)
+			}
+		}()
+	}
+
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logError("Syslog udp read: %v", err)
+			continue
+		}
+		select {
+		case queue <- string(buf[:n]):
+		default:
+			syslogUDPDropped.Add(1)
+			logDebug("Syslog udp: queue full, dropping datagram")
+		}
+	}
+}
+
+func serveSyslogTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logError("Syslog tcp accept: %v", err)
+			continue
+		}
+		go serveSyslogConn(conn)
+	}
+}
+
+func serveSyslogConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		conn.SetReadDeadline(time.Now().Add(syslogTCPIdleTimeout))
+		frame, err := readSyslogFrame(r)
+		if frame != "" {
+			handleSyslogMessage(frame)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logWarn("Syslog tcp %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+// readSyslogFrame reads one message from a TCP stream. Both RFC 6587
+// framings are accepted and may be mixed per frame: octet counting
+// ("<len> <msg>") when the frame starts with a digit, otherwise
+// newline-terminated (non-transparent) framing.
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return "", err
+		}
+		if b[0] != '\n' && b[0] != '\r' {
+			break
+		}
+		r.Discard(1)
+	}
+
+	b, _ := r.Peek(1)
+	if b[0] >= '0' && b[0] <= '9' {
+		n, err := readSyslogOctetCount(r)
+		if err != nil {
+			return "", err
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return "", fmt.Errorf("octet-counted frame: %w", err)
+		}
+		return string(msg), nil
+	}
+
+	// ReadSlice keeps what is buffered per call bounded, so a sender that
+	// never ends its line is cut off at syslogMaxMessage.
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > syslogMaxMessage {
+			return "", fmt.Errorf("frame exceeds %d bytes", syslogMaxMessage)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return strings.TrimRight(string(line), "\r\n"), err
+	}
+}
+
+// readSyslogOctetCount reads the "<len> " prefix of an octet-counted frame.
+// At most syslogOctetCountDigits digits are read, enough for any length up
+// to syslogMaxMessage.
+func readSyslogOctetCount(r *bufio.Reader) (int, error) {
+	var digits []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, fmt.Errorf("octet count: %w", err)
+		}
+		if c == ' ' && len(digits) > 0 {
+			break
+		}
+		if c < '0' || c > '9' || len(digits) == syslogOctetCountDigits {
+			return 0, fmt.Errorf("invalid octet count %q", append(digits, c))
+		}
+		digits = append(digits, c)
+	}
+	n, _ := strconv.Atoi(string(digits))
+	if n <= 0 || n > syslogMaxMessage {
+		return 0, fmt.Errorf("invalid octet count %q", digits)
+	}
+	return n, nil
+}
+
+// handleSyslogMessage unwraps one syslog record and runs its message through
+// the same pipeline as /vector/ingest.
+func handleSyslogMessage(raw string) {
+	msg, err := parseSyslog(raw)
+	if err != nil {
+		logWarn("Skipping malformed syslog message: %v", err)
+		return
+	}
+
+	opts := ingestOptions{format: INGEST_FORMAT, loc: nodeLocation(msg.Hostname), origin: eventOrigin{Node: msg.Hostname}}
+	entry, err := processEvent(msg.Content, opts)
+	if err != nil {
+		deadLetter(msg.Content, opts, msg.Hostname, err)
+		return
+	}
+	if entry == nil {
+		return
+	}
+	syslogBatcher.add(entry)
+}
+
+// parseSyslog parses an RFC 5424 or RFC 3164 record. Only the hostname and
+// the free-form message are kept; the message is the raw Xray line.
+func parseSyslog(raw string) (syslogMessage, error) {
+	raw = strings.TrimRight(raw, "\r\n\x00")
+
+	rest, err := trimSyslogPRI(raw)
+	if err != nil {
+		return syslogMessage{}, err
+	}
+
+	if strings.HasPrefix(rest, "1 ") {
+		return parseSyslog5424(rest[2:])
+	}
+	return parseSyslog3164(rest)
+}
+
+func trimSyslogPRI(raw string) (string, error) {
+	if !strings.HasPrefix(raw, "<") {
+		return "", fmt.Errorf("missing PRI")
+	}
+	end := strings.IndexByte(raw, '>')
+	if end < 2 || end > 4 {
+		return "", fmt.Errorf("invalid PRI")
+	}
+	pri, err := strconv.Atoi(raw[1:end])
+	if err != nil || pri > 191 {
+		return "", fmt.Errorf("invalid PRI %q", raw[1:end])
+	}
+	return raw[end+1:], nil
+}
+
+// parseSyslog5424 parses "TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]".
+func parseSyslog5424(s string) (syslogMessage, error) {
+	fields := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		field, rest, ok := strings.Cut(s, " ")
+		if !ok {
+			return syslogMessage{}, fmt.Errorf("rfc5424: truncated header")
+		}
+		fields = append(fields, field)
+		s = rest
+	}
+
+	s, err := skipStructuredData(s)
+	if err != nil {
+		return syslogMessage{}, err
+	}
+	s = strings.TrimPrefix(s, " ")
+	s = strings.TrimPrefix(s, syslogUTF8BOM)
+
+	host := fields[1]
+	if host == "-" {
+		host = ""
+	}
+	return syslogMessage{Hostname: host, Content: s}, nil
+}
+
+// skipStructuredData drops the RFC 5424 STRUCTURED-DATA part, which is either
+// "-" or one or more [id param="value"] elements with \" \] \\ escapes.
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return "", fmt.Errorf("rfc5424: invalid structured data")
+	}
+
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && inQuotes:
+			i++
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == ']' && !inQuotes:
+			if i+1 == len(s) || s[i+1] != '[' {
+				return s[i+1:], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("rfc5424: unterminated structured data")
+}
+
+// parseSyslog3164 parses "TIMESTAMP HOSTNAME TAG: MSG". The timestamp may be
+// the classic "Jan _2 15:04:05" or an RFC 3339 stamp as rsyslog forwards it.
+// A missing tag is tolerated; the message then starts right after hostname.
+func parseSyslog3164(s string) (syslogMessage, error) {
+	if len(s) >= len(time.Stamp) && isSyslogStamp(s[:len(time.Stamp)]) {
+		s = s[len(time.Stamp):]
+	} else {
+		ts, rest, ok := strings.Cut(s, " ")
+		if !ok {
+			return syslogMessage{}, fmt.Errorf("rfc3164: truncated header")
+		}
+		if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			return syslogMessage{}, fmt.Errorf("rfc3164: invalid timestamp %q", ts)
+		}
+		s = rest
+	}
+
+	host, rest, ok := strings.Cut(strings.TrimLeft(s, " "), " ")
+	if !ok {
+		return syslogMessage{}, fmt.Errorf("rfc3164: missing message")
+	}
+
+	if tag, msg, ok := strings.Cut(rest, " "); ok && strings.HasSuffix(tag, ":") {
+		rest = msg
+	}
+	return syslogMessage{Hostname: host, Content: strings.TrimLeft(rest, " ")}, nil
+}
+
+func isSyslogStamp(s string) bool {
+	_, err := time.Parse(time.Stamp, s)
+	return err == nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const syslogTestLine = `2026/07/23 10:11:12.100000 from 203.0.113.47:4821 accepted tcp:probe.example-cdn.net:443 [IN_TCP_XTLS_A7 >> DIRECT] email: 1204`
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want syslogMessage
+	}{
+		{
+			name: "rfc3164 with tag and pid",
+			raw:  "<14>Jul 23 10:11:12 edge-1 xray[812]: " + syslogTestLine,
+			want: syslogMessage{Hostname: "edge-1", Content: syslogTestLine},
+		},
+		{
+			name: "rfc3164 space-padded day and trailing newline",
+			raw:  "<14>Jul  3 10:11:12 edge-1 xray: " + syslogTestLine + "\n",
+			want: syslogMessage{Hostname: "edge-1", Content: syslogTestLine},
+		},
+		{
+			name: "rfc3164 without tag",
+			raw:  "<14>Jul 23 10:11:12 edge-1 " + syslogTestLine,
+			want: syslogMessage{Hostname: "edge-1", Content: syslogTestLine},
+		},
+		{
+			name: "rfc3164 with rfc3339 timestamp",
+			raw:  "<14>2026-07-23T10:11:12.100000+03:00 edge-2 xray: " + syslogTestLine,
+			want: syslogMessage{Hostname: "edge-2", Content: syslogTestLine},
+		},
+		{
+			name: "rfc5424 nil structured data",
+			raw:  "<165>1 2026-07-23T10:11:12.1Z edge-3 xray 812 - - " + syslogTestLine,
+			want: syslogMessage{Hostname: "edge-3", Content: syslogTestLine},
+		},
+		{
+			name: "rfc5424 structured data with escapes and BOM",
+			raw:  `<165>1 2026-07-23T10:11:12.1Z edge-4 xray - ID47 [meta a="x\]y" b="\"q\""][origin ip="192.0.2.1"] ` + syslogUTF8BOM + syslogTestLine,
+			want: syslogMessage{Hostname: "edge-4", Content: syslogTestLine},
+		},
+		{
+			name: "rfc5424 nil hostname",
+			raw:  "<165>1 - - - - - - " + syslogTestLine,
+			want: syslogMessage{Hostname: "", Content: syslogTestLine},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSyslog(tt.raw)
+			if err != nil {
+				t.Fatalf("parseSyslog() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseSyslog()\n got: %+v\nwant: %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSyslog_Rejects(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		syslogTestLine,
+		"<999>Jul 23 10:11:12 edge-1 xray: x",
+		"<14>yesterday edge-1 xray: x",
+		"<165>1 2026-07-23T10:11:12Z edge xray",
+		"<165>1 2026-07-23T10:11:12Z edge xray - - [unterminated a=\"b\"",
+	} {
+		if _, err := parseSyslog(raw); err == nil {
+			t.Errorf("parseSyslog(%q) error = nil, want error", raw)
+		}
+	}
+}
+
+func TestReadSyslogFrame_MixedFraming(t *testing.T) {
+	stream := "13 <14>octet one" +
+		"<14>newline two\r\n" +
+		"\n" +
+		"17 <14>has\nnewline 3" +
+		"<14>unterminated four"
+	r := bufio.NewReader(strings.NewReader(stream))
+
+	want := []string{"<14>octet one", "<14>newline two", "<14>has\nnewline 3", "<14>unterminated four"}
+	var got []string
+	for {
+		frame, err := readSyslogFrame(r)
+		if frame != "" {
+			got = append(got, frame)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("readSyslogFrame() error = %v", err)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("frames\n got: %q\nwant: %q", got, want)
+	}
+}
+
+// endlessReader yields the same byte forever and counts what was read.
+type endlessReader struct {
+	b    byte
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestReadSyslogFrame_Bounded(t *testing.T) {
+	for _, b := range []byte{'a', '7'} {
+		src := &endlessReader{b: b}
+		if _, err := readSyslogFrame(bufio.NewReader(src)); err == nil {
+			t.Fatalf("readSyslogFrame() error = nil for an endless %q frame", b)
+		}
+		if src.read > syslogMaxMessage+8192 {
+			t.Fatalf("read %d bytes of an endless %q frame", src.read, b)
+		}
+	}
+}
+
+func TestHandleSyslogMessage_KeepsNode(t *testing.T) {
+	prevFile, prevVector, prevLoki, prevRules, prevBatcher := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, syslogBatcher
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, syslogBatcher = prevFile, prevVector, prevLoki, prevRules, prevBatcher
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = t.TempDir()+"/out.ndjson", "", "", nil
+	syslogBatcher = newEmitBatcher("syslog", syslogBatchMax, time.Hour)
+
+	handleSyslogMessage("<14>Jul 23 10:11:12 edge-1 xray: " + syslogTestLine)
+	handleSyslogMessage("<14>Jul 23 10:11:12 edge-1 xray: not an access line")
+	syslogBatcher.flush()
+
+	data, err := os.ReadFile(OUTPUT_FILE)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d lines, want 1", len(lines))
+	}
+	var got LogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if got.Node != "edge-1" || got.Email != "1204" {
+		t.Fatalf("unexpected entry: %+v", got)
+	}
+}
+
+func TestServeSyslogUDP_ParsesOffTheReceiveLoop(t *testing.T) {
+	concurrent := make(chan struct{})
+	var mu sync.Mutex
+	var calls int
+	withPTRResolver(t, func(ctx context.Context, ip net.IP) ([]string, time.Duration, error) {
+		mu.Lock()
+		if calls++; calls == 2 {
+			close(concurrent)
+		}
+		mu.Unlock()
+		select {
+		case <-concurrent:
+		case <-ctx.Done():
+		}
+		return nil, 0, nil
+	})
+	prevFile, prevVector, prevLoki, prevRules, prevBatcher := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, syslogBatcher
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules, syslogBatcher = prevFile, prevVector, prevLoki, prevRules, prevBatcher
+	})
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = t.TempDir()+"/out.ndjson", "", "", nil
+	syslogBatcher = newEmitBatcher("syslog", syslogBatchMax, time.Hour)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	defer conn.Close()
+	go serveSyslogUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	// Each lookup waits for the other, which only arrives before the first
+	// lookup times out if the second datagram is read while the first is
+	// still being parsed.
+	for _, dest := range []string{"198.51.100.11", "198.51.100.12"} {
+		line := strings.Replace(formatTestAccessLine(1), "198.51.100.10", dest, 1)
+		client.Write([]byte("<14>Jul 23 10:11:12 edge-1 xray: " + line))
+	}
+	select {
+	case <-concurrent:
+	case <-time.After(ptrLookupTimeout * 3 / 4):
+		t.Fatal("datagrams were not parsed concurrently")
+	}
+
+	// Let the workers finish before the test state is restored.
+	for {
+		syslogBatcher.mu.Lock()
+		n := len(syslogBatcher.queue)
+		syslogBatcher.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var TAIL_FILE = getEnv("TAIL_FILE", "")
+var TAIL_CHECKPOINT_FILE = getEnv("TAIL_CHECKPOINT_FILE", "")
+var TAIL_BATCH_LINES = getEnvInt("TAIL_BATCH_LINES", 500)
+var TAIL_BATCH_INTERVAL = getEnvDuration("TAIL_BATCH_INTERVAL", time.Second)
+
+const (
+	tailPollInterval = 250 * time.Millisecond
+	tailReadChunk    = 64 * 1024
+	// tailFingerprintBytes is how much of the file head identifies a file
+	// across renames and truncation.
+	tailFingerprintBytes = 256
+	tailRetryDelay       = 2 * time.Second
+)
+
+// tailCheckpoint is persisted after every emitted batch. Offset always points
+// just past the last emitted line.
+type tailCheckpoint struct {
+	Path           string `json:"path"`
+	Offset         int64  `json:"offset"`
+	Fingerprint    string `json:"fingerprint"`
+	FingerprintLen int64  `json:"fingerprint_len"`
+}
+
+// fileTailer follows one log file like `tail -F`, surviving rotation by
+// rename and by copytruncate.
+type fileTailer struct {
+	path           string
+	checkpointPath string
+	batchLines     int
+	batchInterval  time.Duration
+
+	file *os.File
+	info os.FileInfo
+	// fromStart makes the next open ignore the checkpoint; set on rotation.
+	fromStart bool
+	// offset is committed (emitted); readOffset is how far lines were read.
+	offset     int64
+	readOffset int64
+	fpLen      int64
+	fp         string
+
+	partial []byte
+	// skipping discards the rest of a line longer than vectorScannerMaxLine,
+	// which started at skipStart.
+	skipping  bool
+	skipStart int64
+	pending   []string
+	lastFlush time.Time
+}
+
+func startFileTail() {
+	if TAIL_FILE == "" {
+		return
+	}
+
+	t := &fileTailer{
+		path:           TAIL_FILE,
+		checkpointPath: TAIL_CHECKPOINT_FILE,
+		batchLines:     TAIL_BATCH_LINES,
+		batchInterval:  TAIL_BATCH_INTERVAL,
+	}
+	if t.checkpointPath == "" {
+		logWarn("TAIL_CHECKPOINT_FILE not set; tailing %s from its current end", t.path)
+	}
+	go t.run()
+}
+
+func (t *fileTailer) run() {
+	logInfo("Tailing %s (batch=%d lines / %s)", t.path, t.batchLines, t.batchInterval)
+	for {
+		if err := t.step(); err != nil {
+			logError("tail %s: %v", t.path, err)
+			time.Sleep(tailRetryDelay)
+			continue
+		}
+		time.Sleep(tailPollInterval)
+	}
+}
+
+// step does one poll: open if needed, read new lines, flush when due, and
+// handle rotation once the current file is drained.
+func (t *fileTailer) step() error {
+	if t.file == nil {
+		if err := t.open(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	if err := t.readAvailable(); err != nil {
+		return err
+	}
+	if err := t.flushIfDue(); err != nil {
+		return err
+	}
+	return t.checkRotation()
+}
+
+// open opens the path and positions it from the checkpoint when the
+// checkpoint still describes this file. A file that replaced a rotated one
+// is always read from its start.
+func (t *fileTailer) open() error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	start, err := t.resumeOffset(f, info)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	t.file, t.info = f, info
+	t.fromStart = false
+	t.offset, t.readOffset = start, start
+	t.partial = t.partial[:0]
+	t.skipping = false
+	t.fpLen = min(info.Size(), tailFingerprintBytes)
+	t.fp, err = fileFingerprint(f, t.fpLen)
+	if err != nil {
+		return err
+	}
+	logInfo("tail %s: reading from offset %d", t.path, start)
+	return nil
+}
+
+func (t *fileTailer) resumeOffset(f *os.File, info os.FileInfo) (int64, error) {
+	if t.fromStart {
+		return 0, nil
+	}
+	if t.checkpointPath == "" {
+		// Nothing to resume from: behave like tail -F.
+		return info.Size(), nil
+	}
+
+	cp, err := loadTailCheckpoint(t.checkpointPath)
+	if err != nil {
+		return 0, err
+	}
+	if cp == nil || cp.Path != t.path || cp.Offset > info.Size() {
+		return 0, nil
+	}
+	fp, err := fileFingerprint(f, cp.FingerprintLen)
+	if err != nil {
+		return 0, err
+	}
+	if fp != cp.Fingerprint {
+		return 0, nil
+	}
+	return cp.Offset, nil
+}
+
+func (t *fileTailer) readAvailable() error {
+	buf := make([]byte, tailReadChunk)
+	for len(t.pending) < t.batchLines {
+		n, err := t.file.ReadAt(buf, t.readOffset)
+		if n > 0 {
+			t.consume(buf[:n])
+		}
+		if err == io.EOF || n == 0 {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read: %w", err)
+		}
+	}
+	return nil
+}
+
+// consume splits freshly read bytes into complete lines; a trailing partial
+// line is kept until its newline arrives. A line that grows past
+// vectorScannerMaxLine is dropped up to and including its newline.
+func (t *fileTailer) consume(chunk []byte) {
+	t.readOffset += int64(len(chunk))
+	if t.skipping {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			return
+		}
+		chunk, t.skipping = chunk[i+1:], false
+	}
+	data := append(t.partial, chunk...)
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(data[:i], "\r"))
+		if line != "" {
+			t.pending = append(t.pending, line)
+		}
+		data = data[i+1:]
+	}
+	if len(data) > vectorScannerMaxLine {
+		logWarn("tail %s: dropping line longer than %d bytes", t.path, vectorScannerMaxLine)
+		t.skipping, t.skipStart = true, t.readOffset-int64(len(data))
+		data = data[:0]
+	}
+	t.partial = append(t.partial[:0], data...)
+}
+
+// flushIfDue emits pending lines when the batch is full or the interval
+// passed. The checkpoint only moves after a successful emit, so a failed
+// emit is retried with the same lines.
+func (t *fileTailer) flushIfDue() error {
+	if len(t.pending) == 0 {
+		t.lastFlush = time.Now()
+		return nil
+	}
+	if len(t.pending) < t.batchLines && time.Since(t.lastFlush) < t.batchInterval {
+		return nil
+	}
+	return t.flush()
+}
+
+func (t *fileTailer) flush() error {
+	if len(t.pending) > 0 {
+		opts := defaultIngestOptions()
+		parsed, rejected := processEventsParallel(t.pending, opts)
+		if err := emitBatch(parsed); err != nil {
+			return fmt.Errorf("emit %d lines: %w", len(t.pending), err)
+		}
+		deadLetterRejected(rejected, opts)
+		logDebug("tail %s: lines=%d forwarded=%d", t.path, len(t.pending), len(parsed))
+	}
+
+	t.pending = t.pending[:0]
+	t.offset = t.readOffset - int64(len(t.partial))
+	if t.skipping {
+		// Resume at the dropped line, so it is dropped again whole.
+		t.offset = t.skipStart
+	}
+	t.lastFlush = time.Now()
+	return t.saveCheckpoint()
+}
+
+// checkRotation detects rename rotation (path now names a different file)
+// and copytruncate (file shrank or its head changed) once the current file
+// is drained, then switches to the new file from its start.
+func (t *fileTailer) checkRotation() error {
+	if len(t.pending) > 0 {
+		return nil
+	}
+
+	info, err := os.Stat(t.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Renamed away and not recreated yet: keep draining the old file.
+			return nil
+		}
+		return err
+	}
+
+	rotated := !os.SameFile(t.info, info)
+	truncated := false
+	if !rotated {
+		if info.Size() < t.readOffset {
+			truncated = true
+		} else if fp, err := fileFingerprint(t.file, t.fpLen); err != nil {
+			return err
+		} else if fp != t.fp {
+			truncated = true
+		}
+	}
+	if !rotated && !truncated {
+		if t.fpLen < tailFingerprintBytes && info.Size() > t.fpLen {
+			t.fpLen = min(info.Size(), tailFingerprintBytes)
+			t.fp, err = fileFingerprint(t.file, t.fpLen)
+		}
+		return err
+	}
+
+	if rotated {
+		// Drain the old file so lines written just before the rename are kept.
+		for {
+			if err := t.readAvailable(); err != nil {
+				return err
+			}
+			if len(t.pending) == 0 {
+				break
+			}
+			if err := t.flush(); err != nil {
+				return err
+			}
+		}
+		logInfo("tail %s: file rotated, reopening", t.path)
+	} else {
+		logInfo("tail %s: file truncated, restarting from offset 0", t.path)
+	}
+
+	t.file.Close()
+	t.file = nil
+	t.fromStart = true
+	t.partial = t.partial[:0]
+	t.skipping = false
+	if err := t.open(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (t *fileTailer) saveCheckpoint() error {
+	if t.checkpointPath == "" {
+		return nil
+	}
+	return saveTailCheckpoint(t.checkpointPath, tailCheckpoint{
+		Path:           t.path,
+		Offset:         t.offset,
+		Fingerprint:    t.fp,
+		FingerprintLen: t.fpLen,
+	})
+}
+
+func fileFingerprint(f *os.File, n int64) (string, error) {
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", fmt.Errorf("fingerprint: %w", err)
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func loadTailCheckpoint(path string) (*tailCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	var cp tailCheckpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		logWarn("Ignoring corrupt tail checkpoint %s: %v", path, err)
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+// saveTailCheckpoint writes via a temp file and rename so a crash never
+// leaves a half-written checkpoint.
+func saveTailCheckpoint(path string, cp tailCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("marshal checkpoint: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	return nil
+}
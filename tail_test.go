@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tailTestLine(email int) string {
+	return formatTestAccessLine(email) + "\n"
+}
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+// emittedEmails reads the file sink and returns the emails seen so far.
+func emittedEmails(t *testing.T) []string {
+	t.Helper()
+	data, err := os.ReadFile(OUTPUT_FILE)
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	out := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e LogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Unmarshal %q: %v", line, err)
+		}
+		out = append(out, e.Email)
+	}
+	return out
+}
+
+func newTestTailer(t *testing.T, path, checkpoint string) *fileTailer {
+	t.Helper()
+	return &fileTailer{path: path, checkpointPath: checkpoint, batchLines: 100, batchInterval: time.Nanosecond}
+}
+
+func stepTailer(t *testing.T, tl *fileTailer) {
+	t.Helper()
+	if err := tl.step(); err != nil {
+		t.Fatalf("step() error = %v", err)
+	}
+}
+
+func setupTailTest(t *testing.T) (dir string) {
+	t.Helper()
+	prevFile, prevVector, prevLoki, prevRules := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules
+	t.Cleanup(func() {
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = prevFile, prevVector, prevLoki, prevRules
+	})
+	dir = t.TempDir()
+	OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT, skipRules = dir+"/out.ndjson", "", "", nil
+	return dir
+}
+
+func emails(from, to int) []string {
+	out := []string{}
+	for i := from; i <= to; i++ {
+		out = append(out, fmt.Sprint(i))
+	}
+	return out
+}
+
+func TestFileTailer_CheckpointResume(t *testing.T) {
+	dir := setupTailTest(t)
+	logPath, cpPath := dir+"/access.log", dir+"/tail.checkpoint"
+
+	appendFile(t, logPath, tailTestLine(1)+tailTestLine(2)+"2026/07/23 10:11:12.000000 from 203.0.113")
+	tl := newTestTailer(t, logPath, cpPath)
+	stepTailer(t, tl)
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(1, 2)) {
+		t.Fatalf("after first step got %v", got)
+	}
+
+	// Finish the partial line and add another; a fresh tailer must resume
+	// from the checkpoint without repeating 1 and 2.
+	appendFile(t, logPath, ".50:1000 accepted tcp:198.51.100.10:443 [SMOKE_IN >> DIRECT] email: 3\n"+tailTestLine(4))
+	restarted := newTestTailer(t, logPath, cpPath)
+	stepTailer(t, restarted)
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(1, 4)) {
+		t.Fatalf("after restart got %v", got)
+	}
+}
+
+func TestFileTailer_RenameRotation(t *testing.T) {
+	dir := setupTailTest(t)
+	logPath := dir + "/access.log"
+
+	appendFile(t, logPath, tailTestLine(1))
+	tl := newTestTailer(t, logPath, dir+"/tail.checkpoint")
+	stepTailer(t, tl)
+
+	appendFile(t, logPath, tailTestLine(2))
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	appendFile(t, logPath, tailTestLine(3))
+
+	stepTailer(t, tl) // reads 2 from the old file, notices rotation, opens new
+	stepTailer(t, tl) // reads 3 from the new file
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(1, 3)) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestFileTailer_CopyTruncate(t *testing.T) {
+	dir := setupTailTest(t)
+	logPath := dir + "/access.log"
+
+	appendFile(t, logPath, tailTestLine(1)+tailTestLine(2))
+	tl := newTestTailer(t, logPath, dir+"/tail.checkpoint")
+	stepTailer(t, tl)
+
+	if err := os.Truncate(logPath, 0); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	appendFile(t, logPath, tailTestLine(3))
+
+	stepTailer(t, tl) // notices truncation
+	stepTailer(t, tl) // reads 3 from offset 0
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(1, 3)) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestFileTailer_NoCheckpointStartsAtEnd(t *testing.T) {
+	dir := setupTailTest(t)
+	logPath := dir + "/access.log"
+
+	appendFile(t, logPath, tailTestLine(1))
+	tl := newTestTailer(t, logPath, "")
+	stepTailer(t, tl)
+	appendFile(t, logPath, tailTestLine(2))
+	stepTailer(t, tl)
+
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(2, 2)) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestFileTailer_DropsOverlongLine(t *testing.T) {
+	dir := setupTailTest(t)
+	tl := newTestTailer(t, dir+"/access.log", dir+"/tail.checkpoint")
+
+	tl.consume([]byte(tailTestLine(1)))
+	tl.consume([]byte(strings.Repeat("x", vectorScannerMaxLine+1)))
+	if err := tl.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	// A restart reads the dropped line again from its start.
+	if want := int64(len(tailTestLine(1))); tl.offset != want {
+		t.Fatalf("offset = %d, want %d", tl.offset, want)
+	}
+
+	// The rest of the long line arrives over two reads, then line 2.
+	tl.consume([]byte("more of the long line "))
+	tl.consume([]byte("and its end\n" + tailTestLine(2)))
+	if !reflect.DeepEqual(tl.pending, []string{strings.TrimSuffix(tailTestLine(2), "\n")}) {
+		t.Fatalf("pending = %q, want only line 2", tl.pending)
+	}
+	if err := tl.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if tl.offset != tl.readOffset {
+		t.Fatalf("offset = %d, want %d", tl.offset, tl.readOffset)
+	}
+	if got := emittedEmails(t); !reflect.DeepEqual(got, emails(1, 2)) {
+		t.Fatalf("got %v", got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	_ "time/tzdata" // IANA names must resolve in scratch images too
+)
+
+var SOURCE_TIMEZONE = getEnv("SOURCE_TIMEZONE", "UTC")
+var NODE_TIMEZONES = getEnv("NODE_TIMEZONES", "")
+var OUTPUT_TIME_FORMAT = getEnv("OUTPUT_TIME_FORMAT", outputTimeLegacy)
+
+// Output formats for event datetimes. epoch_ms stays a JSON string so the
+// field keeps one type whatever the configuration.
+const (
+	outputTimeLegacy      = "legacy"
+	outputTimeRFC3339Nano = "rfc3339nano"
+	outputTimeEpochMS     = "epoch_ms"
+)
+
+// sourceLocation is the timezone Xray writes its local timestamps in.
+var sourceLocation = time.UTC
+
+// nodeLocations overrides sourceLocation per syslog hostname.
+var nodeLocations = map[string]*time.Location{}
+
+// loadTimeConfig resolves SOURCE_TIMEZONE, NODE_TIMEZONES and
+// OUTPUT_TIME_FORMAT; called once from main before any ingest starts.
+func loadTimeConfig() error {
+	switch OUTPUT_TIME_FORMAT {
+	case outputTimeLegacy, outputTimeRFC3339Nano, outputTimeEpochMS:
+	default:
+		return fmt.Errorf("OUTPUT_TIME_FORMAT must be %q, %q or %q, got %q",
+			outputTimeLegacy, outputTimeRFC3339Nano, outputTimeEpochMS, OUTPUT_TIME_FORMAT)
+	}
+
+	loc, err := loadLocation(SOURCE_TIMEZONE)
+	if err != nil {
+		return fmt.Errorf("SOURCE_TIMEZONE: %w", err)
+	}
+	sourceLocation = loc
+
+	names, err := parseStaticLabels(NODE_TIMEZONES)
+	if err != nil {
+		return fmt.Errorf("NODE_TIMEZONES: %w", err)
+	}
+	nodes := make(map[string]*time.Location, len(names))
+	for node, name := range names {
+		if nodes[node], err = loadLocation(name); err != nil {
+			return fmt.Errorf("NODE_TIMEZONES: %s: %w", node, err)
+		}
+	}
+	nodeLocations = nodes
+	return nil
+}
+
+var locationCache sync.Map // name -> *time.Location
+
+// loadLocation resolves an IANA name ("Europe/Berlin"), "UTC", "Local" or a
+// fixed offset such as "+03:00".
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locationCache.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	var loc *time.Location
+	if offset, err := time.Parse("-07:00", name); err == nil {
+		_, secs := offset.Zone()
+		loc = time.FixedZone(name, secs)
+	} else if loc, err = time.LoadLocation(name); err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	locationCache.Store(name, loc)
+	return loc, nil
+}
+
+// nodeLocation returns the source timezone of a node, falling back to
+// SOURCE_TIMEZONE.
+func nodeLocation(node string) *time.Location {
+	if loc, ok := nodeLocations[node]; ok {
+		return loc
+	}
+	return sourceLocation
+}
+
+// xrayTimeLayouts are the timestamp layouts Xray has written over its
+// releases, tried in order for every line so mixed fleets can share an
+// endpoint. Current builds log microseconds (log.Lmicroseconds); older Xray
+// and v2ray builds log whole seconds. The seconds layout also accepts any
+// other fractional precision, as time.Parse allows extra fractional digits.
+var xrayTimeLayouts = []string{
+	xrayTimeLayout,
+	"2006/01/02 15:04:05",
+}
+
+// parseXrayTime parses an Xray timestamp written in local time of loc.
+func parseXrayTime(raw string, loc *time.Location) (time.Time, error) {
+	var firstErr error
+	for _, layout := range xrayTimeLayouts {
+		t, err := time.ParseInLocation(layout, raw, loc)
+		if err == nil {
+			return t, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return time.Time{}, firstErr
+}
+
+// formatXrayDatetime converts an Xray timestamp, written in local time of
+// loc, to the configured output format in UTC.
+func formatXrayDatetime(raw string, loc *time.Location) (string, error) {
+	t, err := parseXrayTime(raw, loc)
+	if err != nil {
+		return "", err
+	}
+	return formatEventTime(t), nil
+}
+
+func formatEventTime(t time.Time) string {
+	t = t.UTC()
+	switch OUTPUT_TIME_FORMAT {
+	case outputTimeRFC3339Nano:
+		return t.Format(time.RFC3339Nano)
+	case outputTimeEpochMS:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.Format(outputTimeLayout)
+	}
+}
+
+// parseEventTime reverses formatEventTime for any of the output formats.
+func parseEventTime(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation(outputTimeLayout, s, time.UTC); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unrecognised datetime %q", s)
+	}
+	return time.UnixMilli(ms).UTC(), nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func withTimeConfig(t *testing.T, source, nodes, format string) {
+	t.Helper()
+	prevSource, prevNodes, prevFormat := SOURCE_TIMEZONE, NODE_TIMEZONES, OUTPUT_TIME_FORMAT
+	prevLoc, prevNodeLocs := sourceLocation, nodeLocations
+	t.Cleanup(func() {
+		SOURCE_TIMEZONE, NODE_TIMEZONES, OUTPUT_TIME_FORMAT = prevSource, prevNodes, prevFormat
+		sourceLocation, nodeLocations = prevLoc, prevNodeLocs
+	})
+	SOURCE_TIMEZONE, NODE_TIMEZONES, OUTPUT_TIME_FORMAT = source, nodes, format
+}
+
+func TestFormatXrayDatetime(t *testing.T) {
+	tests := []struct {
+		name   string
+		tz     string
+		format string
+		want   string
+	}{
+		{name: "utc legacy", tz: "UTC", format: outputTimeLegacy, want: "2026-03-11 14:22:07.918304"},
+		{name: "berlin legacy", tz: "Europe/Berlin", format: outputTimeLegacy, want: "2026-03-11 13:22:07.918304"},
+		{name: "fixed offset", tz: "+03:00", format: outputTimeLegacy, want: "2026-03-11 11:22:07.918304"},
+		{name: "tokyo rfc3339nano", tz: "Asia/Tokyo", format: outputTimeRFC3339Nano, want: "2026-03-11T05:22:07.918304Z"},
+		{name: "utc epoch ms", tz: "UTC", format: outputTimeEpochMS, want: "1773238927918"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTimeConfig(t, tt.tz, "", tt.format)
+			if err := loadTimeConfig(); err != nil {
+				t.Fatalf("loadTimeConfig() error = %v", err)
+			}
+			got, err := formatXrayDatetime("2026/03/11 14:22:07.918304", sourceLocation)
+			if err != nil {
+				t.Fatalf("formatXrayDatetime() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("formatXrayDatetime() = %q, want %q", got, tt.want)
+			}
+
+			back, err := parseEventTime(got)
+			if err != nil {
+				t.Fatalf("parseEventTime(%q) error = %v", got, err)
+			}
+			want, _ := time.ParseInLocation(xrayTimeLayout, "2026/03/11 14:22:07.918304", sourceLocation)
+			if tt.format == outputTimeEpochMS {
+				want = want.Truncate(time.Millisecond)
+			}
+			if !back.Equal(want) {
+				t.Fatalf("parseEventTime(%q) = %s, want %s", got, back, want)
+			}
+		})
+	}
+}
+
+func TestLoadTimeConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name, source, nodes, format string
+	}{
+		{name: "unknown source", source: "Mars/Olympus", format: outputTimeLegacy},
+		{name: "unknown node zone", source: "UTC", nodes: "edge-1=Nowhere/City", format: outputTimeLegacy},
+		{name: "malformed nodes", source: "UTC", nodes: "edge-1", format: outputTimeLegacy},
+		{name: "unknown format", source: "UTC", format: "unix"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withTimeConfig(t, tt.source, tt.nodes, tt.format)
+			if err := loadTimeConfig(); err == nil {
+				t.Fatal("loadTimeConfig() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestNodeLocation(t *testing.T) {
+	withTimeConfig(t, "Europe/Berlin", "edge-1=Asia/Tokyo, edge-2=UTC", outputTimeLegacy)
+	if err := loadTimeConfig(); err != nil {
+		t.Fatalf("loadTimeConfig() error = %v", err)
+	}
+
+	for node, want := range map[string]string{"edge-1": "Asia/Tokyo", "edge-2": "UTC", "edge-3": "Europe/Berlin"} {
+		if got := nodeLocation(node).String(); got != want {
+			t.Errorf("nodeLocation(%q) = %s, want %s", node, got, want)
+		}
+	}
+}
+
+func TestRequestIngestOptions(t *testing.T) {
+	withTimeConfig(t, "UTC", "", outputTimeLegacy)
+	if err := loadTimeConfig(); err != nil {
+		t.Fatalf("loadTimeConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		target     string
+		wantFormat string
+		wantTZ     string
+		wantErr    bool
+	}{
+		{target: "/vector/ingest", wantFormat: INGEST_FORMAT, wantTZ: "UTC"},
+		{target: "/vector/ingest?tz=America/New_York&format=error", wantFormat: ingestFormatError, wantTZ: "America/New_York"},
+		{target: "/vector/ingest?tz=Nowhere/City", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			opts, err := requestIngestOptions(httptest.NewRequest(http.MethodPost, tt.target, nil))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("requestIngestOptions() error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("requestIngestOptions() error = %v", err)
+			}
+			if opts.format != tt.wantFormat || opts.loc.String() != tt.wantTZ {
+				t.Fatalf("requestIngestOptions() = %s/%s, want %s/%s", opts.format, opts.loc, tt.wantFormat, tt.wantTZ)
+			}
+		})
+	}
+}
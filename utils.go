@@ -2,6 +2,9 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func getEnv(key, fallback string) string {
@@ -10,3 +13,77 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// splitList splits a comma-separated env value, dropping blanks.
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// getEnvInt reads a positive integer, falling back on unset or invalid values.
+func getEnvInt(key string, fallback int) int {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(raw))
+	if err != nil || n <= 0 {
+		logWarn("Invalid %s=%q, using %d", key, raw, fallback)
+		return fallback
+	}
+	return n
+}
+
+// getEnvDuration reads a positive Go duration such as "500ms" or "2s",
+// falling back on unset or invalid values.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(raw))
+	if err != nil || d <= 0 {
+		logWarn("Invalid %s=%q, using %s", key, raw, fallback)
+		return fallback
+	}
+	return d
+}
+
+// getEnvBool reads a boolean such as "true" or "0", falling back on unset or
+// invalid values.
+func getEnvBool(key string, fallback bool) bool {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(raw))
+	if err != nil {
+		logWarn("Invalid %s=%q, using %t", key, raw, fallback)
+		return fallback
+	}
+	return b
+}
+
+// fileVersion identifies one version of a file for change polling; the zero
+// value means the file does not exist.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
+}
+
+func (v fileVersion) changed(prev fileVersion) bool {
+	return !v.modTime.Equal(prev.modTime) || v.size != prev.size
+}
@@ -6,9 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"sync"
 	"time"
@@ -24,32 +22,59 @@ const (
 	vectorContentType      = "application/x-ndjson"
 )
 
+var INGEST_CHUNK_LINES = getEnvInt("INGEST_CHUNK_LINES", 1000)
+var INGEST_SPOOL_MEMORY = getEnvInt("INGEST_SPOOL_MEMORY", 4<<20)
+var INGEST_MAX_INFLIGHT = getEnvInt("INGEST_MAX_INFLIGHT", 16)
+
 var vectorHTTPClient = &http.Client{Timeout: 30 * time.Second}
 
-// forwardedBatches remembers sha256 of bodies already emitted successfully.
-var forwardedBatches sync.Map // batchID(string) -> struct{}
+// ingestSlots caps concurrently processed ingest requests; together with
+// INGEST_SPOOL_MEMORY and INGEST_CHUNK_LINES it bounds ingest memory.
+var ingestSlots = make(chan struct{}, INGEST_MAX_INFLIGHT)
 
-// processLine parses a raw Xray access log line into a structured event.
-// Returns nil when the line should be skipped/filtered.
-func processLine(line string) (*LogEntry, error) {
-	entry, err := parseLog(line)
+// processLine parses a raw Xray access log line, written in timezone loc, into
+// a structured event. Returns nil when the line should be skipped/filtered.
+func processLine(line string, loc *time.Location) (*LogEntry, error) {
+	entry, err := parseLogInZone(line, loc)
 	if err != nil {
 		return nil, err
 	}
+	return admitEntry(entry), nil
+}
 
+// admitEntry runs the torrent check and the skip rules on a parsed access
+// entry. Returns nil when the entry should be skipped/filtered. Entries
+// waiting for their PTR names are checked by the delay queue instead.
+func admitEntry(entry *LogEntry) *LogEntry {
 	notifyTorrentIfNeeded(entry)
 
-	if isSkipped(entry, skipRules) {
-		return nil, nil
+	if !entry.ptrPending && isSkipped(entry, skipRules) {
+		return nil
 	}
 
-	return entry, nil
+	return entry
 }
 
-// processLinesParallel parses lines concurrently (bounded) and returns a dense
-// list of events to forward, preserving input order.
+// processLinesParallel parses access log lines concurrently (bounded) and
+// returns a dense list of events to forward, preserving input order.
+// Rejected lines are dead-lettered right away.
 func processLinesParallel(rawLines []string) []*LogEntry {
-	slots := make([]*LogEntry, len(rawLines))
+	opts := ingestOptions{format: ingestFormatAccess, loc: sourceLocation}
+	events, rejected := processEventsParallel(rawLines, opts)
+	deadLetterRejected(rejected, opts)
+	out := make([]*LogEntry, 0, len(events))
+	for _, event := range events {
+		out = append(out, event.(*LogEntry))
+	}
+	return out
+}
+
+// processEventsParallel is processLinesParallel for any log format. Lines
+// that fail to parse are returned as rejected for the caller to dead-letter
+// once the events were emitted.
+func processEventsParallel(rawLines []string, opts ingestOptions) ([]logEvent, []rejectedLine) {
+	slots := make([]logEvent, len(rawLines))
+	errs := make([]error, len(rawLines))
 	sem := make(chan struct{}, vectorParseConcurrency)
 	var wg sync.WaitGroup
 
@@ -60,9 +85,9 @@ func processLinesParallel(rawLines []string) []*LogEntry {
 			defer wg.Done()
 			defer func() { <-sem }()
 
-			entry, err := processLine(line)
+			entry, err := processEvent(line, opts)
 			if err != nil {
-				logWarn("Skipping unparsable log: %s", line)
+				errs[i] = err
 				return
 			}
 			if entry != nil {
@@ -72,13 +97,17 @@ func processLinesParallel(rawLines []string) []*LogEntry {
 	}
 	wg.Wait()
 
-	out := make([]*LogEntry, 0, len(rawLines))
-	for _, entry := range slots {
+	out := make([]logEvent, 0, len(rawLines))
+	var rejected []rejectedLine
+	for i, entry := range slots {
 		if entry != nil {
 			out = append(out, entry)
 		}
+		if errs[i] != nil {
+			rejected = append(rejected, rejectedLine{line: rawLines[i], err: errs[i]})
+		}
 	}
-	return out
+	return out, rejected
 }
 
 // hashBatch returns a stable content id for the raw HTTP body.
@@ -87,11 +116,23 @@ func hashBatch(body []byte) string {
 	return hex.EncodeToString(sum[:])
 }
 
-func emitBatch(entries []*LogEntry) error {
-	if len(entries) == 0 {
-		return nil
+// emitBatch emits entries to the configured sink. Entries waiting for their
+// PTR names are passed to the delay queue, which emits them later, but only
+// once the rest are emitted: a failed batch is retried whole.
+func emitBatch(entries []logEvent) error {
+	entries, held := holdPTRPending(entries)
+	if len(entries) > 0 {
+		if err := emitToSink(entries); err != nil {
+			ptrDelayed.release(held)
+			return err
+		}
+		observeSessions(entries)
 	}
+	ptrDelayed.start(held)
+	return nil
+}
 
+func emitToSink(entries []logEvent) error {
 	if OUTPUT_FILE != "" {
 		for _, entry := range entries {
 			if err := appendJSONLine(OUTPUT_FILE, entry); err != nil {
@@ -101,6 +142,13 @@ func emitBatch(entries []*LogEntry) error {
 		return nil
 	}
 
+	if LOKI_ENDPOINT != "" {
+		if err := pushToLoki(entries); err != nil {
+			return fmt.Errorf("push: %w", err)
+		}
+		return nil
+	}
+
 	var buf bytes.Buffer
 	encoder := json.NewEncoder(&buf)
 	for _, entry := range entries {
@@ -114,41 +162,102 @@ func emitBatch(entries []*LogEntry) error {
 	return nil
 }
 
-// vectorIngestHandler reads a newline-delimited batch of raw Xray log lines,
-// processes each one, and emits the surviving events to the configured sink.
+// vectorIngestHandler reads a newline-delimited batch of raw Xray log lines
+// and streams it through the parser and the sink in chunks of
+// INGEST_CHUNK_LINES, so memory per request stays bounded by configuration
+// rather than by body size. The body is spooled (and hashed) first so a
+// retried batch is still recognised before anything is emitted.
 func vectorIngestHandler(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
-	r.Body = http.MaxBytesReader(w, r.Body, vectorMaxBodyBytes)
-	body, err := io.ReadAll(r.Body)
+	select {
+	case ingestSlots <- struct{}{}:
+		defer func() { <-ingestSlots }()
+	case <-r.Context().Done():
+		return
+	}
+
+	opts, err := requestIngestOptions(r)
+	if err != nil {
+		logError("vector_ingest batch=- status=%d total=%s err=options: %v", http.StatusBadRequest, time.Since(start), err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	spool, batchID, status, err := spoolIngestBody(w, r)
 	if err != nil {
-		status := http.StatusInternalServerError
-		var maxBytesErr *http.MaxBytesError
-		if errors.As(err, &maxBytesErr) {
-			status = http.StatusRequestEntityTooLarge
-		}
 		logError("vector_ingest batch=- status=%d total=%s err=body: %v", status, time.Since(start), err)
 		http.Error(w, "Error reading request body", status)
 		return
 	}
+	defer spool.Close()
 
-	batchID := hashBatch(body)
-	if _, ok := forwardedBatches.Load(batchID); ok {
+	if forwardedBatches.Seen(batchID) {
 		w.WriteHeader(http.StatusOK)
 		logDebug("vector_ingest batch=%s status=%d dedup=1 total=%s",
 			batchID, http.StatusOK, time.Since(start))
 		return
 	}
 
-	scanner := bufio.NewScanner(bytes.NewReader(body))
+	body, err := spool.Reader()
+	if err != nil {
+		logError("vector_ingest batch=%s status=%d total=%s err=spool: %v",
+			batchID, http.StatusInternalServerError, time.Since(start), err)
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	// Chunks emitted before a later one fails are recorded as batchID#index,
+	// so the shipper's retry resumes after them instead of sending them
+	// again. The last chunk is covered by the batch itself.
+	var lines, forwarded, chunks, resumed int
+	var parseDur, emitDur time.Duration
+	processChunk := func(rawLines []string, last bool) (int, error) {
+		chunkID := fmt.Sprintf("%s#%d", batchID, chunks)
+		chunks++
+		if forwardedBatches.Seen(chunkID) {
+			resumed += len(rawLines)
+			return http.StatusOK, nil
+		}
+
+		parseStart := time.Now()
+		parsed, rejected := processEventsParallel(rawLines, opts)
+		parseDur += time.Since(parseStart)
+
+		lines += len(rawLines)
+		forwarded += len(parsed)
+
+		status, dur, err := emitParsed(parsed)
+		emitDur += dur
+		if err != nil {
+			return status, err
+		}
+		deadLetterRejected(rejected, opts)
+		if !last {
+			markForwarded(chunkID)
+		}
+		return status, nil
+	}
+
+	scanner := bufio.NewScanner(body)
 	scanner.Buffer(make([]byte, 0, 64*1024), vectorScannerMaxLine)
-	rawLines := make([]string, 0, 256)
+	rawLines := make([]string, 0, INGEST_CHUNK_LINES)
 	for scanner.Scan() {
 		line := scanner.Text()
 		if line == "" {
 			continue
 		}
 		rawLines = append(rawLines, line)
+		if len(rawLines) < INGEST_CHUNK_LINES {
+			continue
+		}
+		if status, err := processChunk(rawLines, false); err != nil {
+			logError("vector_ingest batch=%s status=%d lines=%d skipped=%d forwarded=%d resumed=%d chunks=%d parse=%s emit=%s total=%s err=emit: %v",
+				batchID, status, lines, lines-forwarded, forwarded, resumed, chunks, parseDur, emitDur, time.Since(start), err)
+			http.Error(w, "Error emitting events", status)
+			return
+		}
+		rawLines = rawLines[:0]
 	}
 	if err := scanner.Err(); err != nil {
 		logError("vector_ingest batch=%s status=%d total=%s err=scan: %v",
@@ -156,34 +265,50 @@ func vectorIngestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Error reading request body", http.StatusInternalServerError)
 		return
 	}
-
-	parseStart := time.Now()
-	parsed := processLinesParallel(rawLines)
-	parseDur := time.Since(parseStart)
-	forwarded := len(parsed)
-	skipped := len(rawLines) - forwarded
-
-	var emitDur time.Duration
-	if forwarded > 0 {
-		t0 := time.Now()
-		if err := emitBatch(parsed); err != nil {
-			emitDur = time.Since(t0)
-			status := http.StatusBadGateway
-			if OUTPUT_FILE != "" {
-				status = http.StatusInternalServerError
-			}
-			logError("vector_ingest batch=%s status=%d lines=%d skipped=%d forwarded=%d parse=%s emit=%s total=%s err=emit: %v",
-				batchID, status, len(rawLines), skipped, forwarded, parseDur, emitDur, time.Since(start), err)
+	if len(rawLines) > 0 {
+		if status, err := processChunk(rawLines, true); err != nil {
+			logError("vector_ingest batch=%s status=%d lines=%d skipped=%d forwarded=%d resumed=%d chunks=%d parse=%s emit=%s total=%s err=emit: %v",
+				batchID, status, lines, lines-forwarded, forwarded, resumed, chunks, parseDur, emitDur, time.Since(start), err)
 			http.Error(w, "Error emitting events", status)
 			return
 		}
-		emitDur = time.Since(t0)
-		forwardedBatches.Store(batchID, struct{}{})
+	}
+
+	if forwarded > 0 || resumed > 0 {
+		markForwarded(batchID)
 	}
 
 	w.WriteHeader(http.StatusOK)
-	logDebug("vector_ingest batch=%s status=%d lines=%d skipped=%d forwarded=%d parse=%s emit=%s total=%s",
-		batchID, http.StatusOK, len(rawLines), skipped, forwarded, parseDur, emitDur, time.Since(start))
+	logDebug("vector_ingest batch=%s status=%d lines=%d skipped=%d forwarded=%d resumed=%d chunks=%d parse=%s emit=%s total=%s",
+		batchID, http.StatusOK, lines, lines-forwarded, forwarded, resumed, chunks, parseDur, emitDur, time.Since(start))
+}
+
+// emitIngested emits the parsed events of one ingest batch and remembers the
+// batch as forwarded on success. On failure it returns the HTTP status the
+// ingest handler should answer with so the shipper retries.
+func emitIngested(batchID string, parsed []logEvent) (int, time.Duration, error) {
+	status, dur, err := emitParsed(parsed)
+	if err == nil && len(parsed) > 0 {
+		markForwarded(batchID)
+	}
+	return status, dur, err
+}
+
+// emitParsed emits events without touching the dedup state.
+func emitParsed(parsed []logEvent) (int, time.Duration, error) {
+	if len(parsed) == 0 {
+		return http.StatusOK, 0, nil
+	}
+
+	t0 := time.Now()
+	if err := emitBatch(parsed); err != nil {
+		status := http.StatusBadGateway
+		if OUTPUT_FILE != "" {
+			status = http.StatusInternalServerError
+		}
+		return status, time.Since(t0), err
+	}
+	return http.StatusOK, time.Since(t0), nil
 }
 
 func forwardToVector(payload []byte) error {
@@ -38,40 +38,49 @@ func TestProcessLinesParallel(t *testing.T) {
 			wantEmails: []string{"1204", "8831", "7712"},
 			want: []LogEntry{
 				{
-					Datetime:  "2026-07-23 10:11:12.100000",
-					FromIP:    "203.0.113.47",
-					FromPort:  4821,
-					Status:    "accepted",
-					DestProto: "tcp",
-					DestHost:  "198.51.100.88",
-					DestPort:  443,
-					Route:     "IN_TCP_XTLS_A7 - DIRECT",
-					Email:     "1204",
-					ToAddr:    []string{},
+					Datetime:    "2026-07-23 10:11:12.100000",
+					FromIP:      "203.0.113.47",
+					FromPort:    4821,
+					Status:      "accepted",
+					DestProto:   "tcp",
+					DestHost:    "198.51.100.88",
+					DestPort:    443,
+					Route:       "IN_TCP_XTLS_A7 - DIRECT",
+					InboundTag:  "IN_TCP_XTLS_A7",
+					OutboundTag: "DIRECT",
+					Email:       "1204",
+					ToAddr:      []string{},
+					Format:      "xray",
 				},
 				{
-					Datetime:  "2026-07-23 10:11:12.200000",
-					FromIP:    "198.51.100.14",
-					FromPort:  29104,
-					Status:    "accepted",
-					DestProto: "tcp",
-					DestHost:  "probe.example-cdn.net",
-					DestPort:  443,
-					Route:     "PROXY_EDGE_42 - DIRECT",
-					Email:     "8831",
-					ToAddr:    []string{},
+					Datetime:    "2026-07-23 10:11:12.200000",
+					FromIP:      "198.51.100.14",
+					FromPort:    29104,
+					Status:      "accepted",
+					DestProto:   "tcp",
+					DestHost:    "probe.example-cdn.net",
+					DestPort:    443,
+					Route:       "PROXY_EDGE_42 - DIRECT",
+					InboundTag:  "PROXY_EDGE_42",
+					OutboundTag: "DIRECT",
+					Email:       "8831",
+					ToAddr:      []string{},
+					Format:      "xray",
 				},
 				{
-					Datetime:  "2026-07-23 10:11:12.300000",
-					FromIP:    "203.0.113.9",
-					FromPort:  0,
-					Status:    "accepted",
-					DestProto: "udp",
-					DestHost:  "9.9.9.9",
-					DestPort:  53,
-					Route:     "IN_UDP_FAST_9 - DIRECT",
-					Email:     "7712",
-					ToAddr:    []string{},
+					Datetime:    "2026-07-23 10:11:12.300000",
+					FromIP:      "203.0.113.9",
+					FromPort:    0,
+					Status:      "accepted",
+					DestProto:   "udp",
+					DestHost:    "9.9.9.9",
+					DestPort:    53,
+					Route:       "IN_UDP_FAST_9 - DIRECT",
+					InboundTag:  "IN_UDP_FAST_9",
+					OutboundTag: "DIRECT",
+					Email:       "7712",
+					ToAddr:      []string{},
+					Format:      "xray",
 				},
 			},
 		},
@@ -190,26 +199,29 @@ func TestHashBatch_Stable(t *testing.T) {
 }
 
 func TestValidateSinkConfig(t *testing.T) {
-	prevFile, prevVector := OUTPUT_FILE, VECTOR_ENDPOINT
+	prevFile, prevVector, prevLoki := OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT
 	t.Cleanup(func() {
-		OUTPUT_FILE, VECTOR_ENDPOINT = prevFile, prevVector
+		OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT = prevFile, prevVector, prevLoki
 	})
 
 	tests := []struct {
 		name   string
 		file   string
 		vector string
+		loki   string
 		wantOK bool
 	}{
 		{name: "neither", wantOK: false},
 		{name: "both", file: "/tmp/out.json", vector: "http://vector:8080", wantOK: false},
+		{name: "file and loki", file: "/tmp/out.json", loki: "http://loki:3100/loki/api/v1/push", wantOK: false},
 		{name: "file only", file: "/tmp/out.json", wantOK: true},
 		{name: "vector only", vector: "http://vector:8080", wantOK: true},
+		{name: "loki only", loki: "http://loki:3100/loki/api/v1/push", wantOK: true},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			OUTPUT_FILE, VECTOR_ENDPOINT = tt.file, tt.vector
+			OUTPUT_FILE, VECTOR_ENDPOINT, LOKI_ENDPOINT = tt.file, tt.vector, tt.loki
 			err := validateSinkConfig()
 			if tt.wantOK && err != nil {
 				t.Fatalf("validateSinkConfig() error = %v, want nil", err)
@@ -232,18 +244,20 @@ func TestEmitBatch_File(t *testing.T) {
 	OUTPUT_FILE = path
 	VECTOR_ENDPOINT = ""
 
-	entries := []*LogEntry{
-		{
-			Datetime:  "2026-07-23 10:11:12.100000",
-			Email:     "1204",
-			FromIP:    "203.0.113.47",
-			FromPort:  4821,
-			DestProto: "tcp",
-			DestHost:  "198.51.100.88",
-			DestPort:  443,
-			Status:    "accepted",
-			Route:     "IN_TCP_XTLS_A7 - DIRECT",
-			ToAddr:    []string{},
+	entries := []logEvent{
+		&LogEntry{
+			Datetime:    "2026-07-23 10:11:12.100000",
+			Email:       "1204",
+			FromIP:      "203.0.113.47",
+			FromPort:    4821,
+			DestProto:   "tcp",
+			DestHost:    "198.51.100.88",
+			DestPort:    443,
+			Status:      "accepted",
+			Route:       "IN_TCP_XTLS_A7 - DIRECT",
+			InboundTag:  "IN_TCP_XTLS_A7",
+			OutboundTag: "DIRECT",
+			ToAddr:      []string{},
 		},
 	}
 